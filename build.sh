@@ -6,10 +6,24 @@ echo "cleaning..."
 rm -fr dist/gps_dumper/gps_dumper 2>&1 || true
 rm -fr dist/packet_dumper/packet_dumper 2>&1 || true
 rm -fr dist/ssh_dumper/ssh_dumper 2>&1 || true
+rm -fr dist/udp_probe_dumper/udp_probe_dumper 2>&1 || true
+rm -fr dist/udp_reflector/udp_reflector 2>&1 || true
+rm -fr dist/twamp_dumper/twamp_dumper 2>&1 || true
+rm -fr dist/twamp_reflector/twamp_reflector 2>&1 || true
+rm -fr dist/reachability_dumper/reachability_dumper 2>&1 || true
+rm -fr dist/http_probe_dumper/http_probe_dumper 2>&1 || true
+rm -fr dist/packet_matcher/packet_matcher 2>&1 || true
 echo ""
 
 echo "building..."
 go build -v -o dist/gps_dumper/gps_dumper cmd/gps_dumper/main.go
 go build -v -o dist/packet_dumper/packet_dumper cmd/packet_dumper/main.go
 go build -v -o dist/ssh_dumper/ssh_dumper cmd/ssh_dumper/main.go
+go build -v -o dist/udp_probe_dumper/udp_probe_dumper cmd/udp_probe_dumper/main.go
+go build -v -o dist/udp_reflector/udp_reflector cmd/udp_reflector/main.go
+go build -v -o dist/twamp_dumper/twamp_dumper cmd/twamp_dumper/main.go
+go build -v -o dist/twamp_reflector/twamp_reflector cmd/twamp_reflector/main.go
+go build -v -o dist/reachability_dumper/reachability_dumper cmd/reachability_dumper/main.go
+go build -v -o dist/http_probe_dumper/http_probe_dumper cmd/http_probe_dumper/main.go
+go build -v -o dist/packet_matcher/packet_matcher cmd/packet_matcher/main.go
 echo ""
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/initialed85/drive_test/pkg/file_writer"
+	"github.com/initialed85/drive_test/pkg/http_probe_dumper"
+	"io/ioutil"
+	"log"
+)
+
+type Args struct {
+	ConfigPath string
+	OutputPath string
+}
+
+var args Args
+
+func getArgs() (Args, error) {
+	target := Args{}
+
+	flag.StringVar(&target.ConfigPath, "config-path", "config.json", "Path to JSON config file")
+	flag.StringVar(&target.OutputPath, "output-path", "http_probe_output.jsonl", "Path to JSON Lines output file")
+
+	flag.Parse()
+
+	return target, nil
+}
+
+func getConfig(path string) (http_probe_dumper.Config, error) {
+	config := http_probe_dumper.Config{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+func callback(output http_probe_dumper.Output) error {
+	return file_writer.WriteIndentedJSONToFile(output, args.OutputPath)
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	var err error
+
+	args, err = getArgs()
+	if err != nil {
+		panic(err)
+	}
+
+	config, err := getConfig(args.ConfigPath)
+	if err != nil {
+		panic(err)
+	}
+
+	err = http_probe_dumper.Watch(config, callback)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -7,12 +7,15 @@ import (
 	"github.com/initialed85/drive_test/pkg/packet_dumper"
 	"io/ioutil"
 	"log"
+	"strings"
 )
 
 type Args struct {
 	Interface  string
+	PcapPath   string
 	ConfigPath string
 	OutputPath string
+	Trigger    string
 }
 
 var args Args
@@ -20,21 +23,19 @@ var args Args
 func getArgs() (Args, error) {
 	target := Args{}
 
-	flag.StringVar(&target.Interface, "interface", "", "Interface to capture on")
+	flag.StringVar(&target.Interface, "interface", "", "Interface(s) to capture on (comma separated); overrides \"interfaces\" in the config")
+	flag.StringVar(&target.PcapPath, "pcap-path", "", "Path to a pcap file to read instead of capturing on an interface")
 	flag.StringVar(&target.ConfigPath, "config-path", "config.json", "Path to JSON config file")
 	flag.StringVar(&target.OutputPath, "output-path", "packet_output.jsonl", "Path to JSON Lines output file")
+	flag.StringVar(&target.Trigger, "trigger", "", "Trigger a ring buffer capture in a running packet_dumper (with this reason) and exit")
 
 	flag.Parse()
 
 	return target, nil
 }
 
-type Config struct {
-	Filter string `json:"filter"`
-}
-
-func getConfig(path string) (Config, error) {
-	config := Config{}
+func getConfig(path string) (packet_dumper.Config, error) {
+	config := packet_dumper.Config{}
 
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -49,6 +50,25 @@ func getConfig(path string) (Config, error) {
 	return config, nil
 }
 
+// getInterfaces gets the named interfaces, with their settings from the config where it has them
+func getInterfaces(names string, configured []packet_dumper.InterfaceConfig) []packet_dumper.InterfaceConfig {
+	interfaces := make([]packet_dumper.InterfaceConfig, 0)
+
+	for _, name := range strings.Split(names, ",") {
+		iface := packet_dumper.InterfaceConfig{Name: name}
+
+		for _, c := range configured {
+			if c.Name == name {
+				iface = c
+			}
+		}
+
+		interfaces = append(interfaces, iface)
+	}
+
+	return interfaces
+}
+
 func callback(output packet_dumper.Output) error {
 	return file_writer.WriteIndentedJSONToFile(output, args.OutputPath)
 }
@@ -68,7 +88,18 @@ func main() {
 		panic(err)
 	}
 
-	err = packet_dumper.Watch(args.Interface, config.Filter, callback)
+	if args.Trigger != "" {
+		err = packet_dumper.Trigger(config, args.Trigger)
+	} else if args.PcapPath != "" {
+		err = packet_dumper.ReadFile(args.PcapPath, config, callback)
+	} else {
+		interfaces := config.Interfaces
+		if args.Interface != "" {
+			interfaces = getInterfaces(args.Interface, config.Interfaces)
+		}
+
+		err = packet_dumper.WatchInterfaces(interfaces, config, callback)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"github.com/initialed85/drive_test/pkg/file_writer"
+	"github.com/initialed85/drive_test/pkg/packet_matcher"
+	"log"
+)
+
+type Args struct {
+	APcapPath  string
+	BPcapPath  string
+	Filter     string
+	HashBytes  int
+	MaxDelay   float64
+	Interval   float64
+	PerPacket  bool
+	OutputPath string
+}
+
+var args Args
+
+func getArgs() (Args, error) {
+	target := Args{}
+
+	flag.StringVar(&target.APcapPath, "a-pcap-path", "", "Path to the pcap file from one capture point (e.g. the vehicle)")
+	flag.StringVar(&target.BPcapPath, "b-pcap-path", "", "Path to the pcap file from the other capture point (e.g. the core)")
+	flag.StringVar(&target.Filter, "filter", "", "Filter (in tcpdump / pcap format) to apply to both captures")
+	flag.IntVar(&target.HashBytes, "hash-bytes", 64, "Bytes of each packet's IP payload to include in matching it (both captures need at least this much)")
+	flag.Float64Var(&target.MaxDelay, "max-delay", 5, "Time in seconds after which a packet not seen at the other capture point is lost")
+	flag.Float64Var(&target.Interval, "interval", 1, "Period to report at in seconds")
+	flag.BoolVar(&target.PerPacket, "per-packet", false, "Write a record per matched packet too")
+	flag.StringVar(&target.OutputPath, "output-path", "packet_matcher_output.jsonl", "Path to JSON Lines output file")
+
+	flag.Parse()
+
+	return target, nil
+}
+
+func callback(output packet_matcher.Output) error {
+	return file_writer.WriteIndentedJSONToFile(output, args.OutputPath)
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	var err error
+
+	args, err = getArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if args.APcapPath == "" || args.BPcapPath == "" {
+		log.Fatal("both -a-pcap-path and -b-pcap-path are needed")
+	}
+
+	err = packet_matcher.MatchFiles(
+		args.APcapPath,
+		args.BPcapPath,
+		args.Filter,
+		args.HashBytes,
+		args.MaxDelay,
+		args.Interval,
+		args.PerPacket,
+		callback,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"github.com/initialed85/drive_test/internal/twamp"
+	"github.com/initialed85/drive_test/pkg/file_writer"
+	"github.com/initialed85/drive_test/pkg/twamp_dumper"
+	"log"
+)
+
+type Args struct {
+	Host               string
+	Port               int
+	Rate               float64
+	Size               int
+	Interval           float64
+	Timeout            float64
+	Synchronized       bool
+	OutputPath         string
+	TriggerAddress     string
+	TriggerLossPercent float64
+}
+
+var args Args
+
+func getArgs() (Args, error) {
+	target := Args{}
+
+	flag.StringVar(&target.Host, "host", "localhost", "IP, host or FQDN of the TWAMP-Light session-reflector")
+	flag.IntVar(&target.Port, "port", twamp.DefaultPort, "Port of the TWAMP-Light session-reflector")
+	flag.Float64Var(&target.Rate, "rate", 10, "Test packets to send per second")
+	flag.IntVar(&target.Size, "size", twamp.ReflectorHeaderSize, "Size of each test packet's UDP payload in bytes (minimum 14)")
+	flag.Float64Var(&target.Interval, "interval", 1, "Period to report at in seconds")
+	flag.Float64Var(&target.Timeout, "timeout", 1, "Time in seconds after which an unanswered test packet is lost")
+	flag.BoolVar(&target.Synchronized, "synchronized", false, "Clock is synchronized to UTC (e.g. by GPS or NTP); enables one-way delay")
+	flag.StringVar(&target.OutputPath, "output-path", "twamp_output.jsonl", "Path to JSON Lines output file")
+	flag.StringVar(&target.TriggerAddress, "trigger-address", "", "http_address of a running packet_dumper's ring buffer to trigger a capture at on a loss burst")
+	flag.Float64Var(&target.TriggerLossPercent, "trigger-loss-percent", 50, "Loss in an interval (as a percentage of the test packets sent) that's a loss burst")
+
+	flag.Parse()
+
+	return target, nil
+}
+
+func callback(output twamp_dumper.Output) error {
+	return file_writer.WriteIndentedJSONToFile(output, args.OutputPath)
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	var err error
+
+	args, err = getArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var lossTrigger *twamp_dumper.LossTrigger
+
+	if args.TriggerAddress != "" {
+		lossTrigger = &twamp_dumper.LossTrigger{
+			Address: args.TriggerAddress,
+			Percent: args.TriggerLossPercent,
+		}
+	}
+
+	err = twamp_dumper.Watch(
+		args.Host,
+		args.Port,
+		args.Rate,
+		args.Size,
+		args.Interval,
+		args.Timeout,
+		args.Synchronized,
+		lossTrigger,
+		callback,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
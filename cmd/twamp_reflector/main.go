@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"github.com/initialed85/drive_test/internal/twamp"
+	"github.com/initialed85/drive_test/pkg/twamp_reflector"
+	"log"
+)
+
+type Args struct {
+	Host         string
+	Port         int
+	Synchronized bool
+}
+
+func getArgs() (Args, error) {
+	target := Args{}
+
+	flag.StringVar(&target.Host, "host", "0.0.0.0", "IP to listen on")
+	flag.IntVar(&target.Port, "port", twamp.DefaultPort, "Port to listen on")
+	flag.BoolVar(&target.Synchronized, "synchronized", false, "Clock is synchronized to UTC (e.g. by GPS or NTP)")
+
+	flag.Parse()
+
+	return target, nil
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	args, err := getArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = twamp_reflector.Serve(args.Host, args.Port, args.Synchronized)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"github.com/initialed85/drive_test/pkg/udp_reflector"
+	"log"
+)
+
+type Args struct {
+	Host string
+	Port int
+}
+
+func getArgs() (Args, error) {
+	target := Args{}
+
+	flag.StringVar(&target.Host, "host", "0.0.0.0", "IP to listen on")
+	flag.IntVar(&target.Port, "port", 4747, "Port to listen on")
+
+	flag.Parse()
+
+	return target, nil
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	args, err := getArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = udp_reflector.Serve(args.Host, args.Port)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
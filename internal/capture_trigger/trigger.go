@@ -0,0 +1,45 @@
+package capture_trigger
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const timeout = time.Second * 5
+
+// Fire asks a running packet_dumper (at its ring buffer's http_address) to dump a capture, giving it the reason
+func Fire(address string, reason string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if host == "" {
+		host = "localhost"
+	}
+
+	triggerURL := url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort(host, port),
+		Path:     "/trigger",
+		RawQuery: url.Values{"reason": {reason}}.Encode(),
+	}
+
+	client := http.Client{Timeout: timeout}
+
+	response, err := client.Get(triggerURL.String())
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("trigger failed: %v", response.Status)
+	}
+
+	return nil
+}
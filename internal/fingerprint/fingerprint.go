@@ -0,0 +1,150 @@
+package fingerprint
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"hash/fnv"
+)
+
+// Fingerprint identifies the innermost IP packet of a captured one (so tunnels added or removed along the way don't
+// matter) whatever a router does to it in transit; Protocol is the transport (TCP, UDP, ICMPv4, ICMPv6) or failing that
+// the IP version, TTL is the TTL / hop limit, Complete is whether all the payload asked for was captured and Distinct is
+// whether a packet sent again on purpose would (almost certainly) hash differently
+type Fingerprint struct {
+	Key           uint64
+	Protocol      string
+	SourceIP      string
+	DestinationIP string
+	Length        int
+	TTL           int
+	Complete      bool
+	Distinct      bool
+}
+
+// distinctIPv6 is whether an IPv6 packet has something in it (a sequence number, a timestamp or application data) that
+// keeps it apart from the same packet sent again on purpose; IPv6 has no ID and its flow label is the same for the whole
+// flow, so e.g. duplicate ACKs (without TCP timestamps) and neighbour discovery / MLD retransmissions are identical
+func distinctIPv6(protocol layers.IPProtocol, payload []byte, payloadLength int) bool {
+	switch protocol {
+	case layers.IPProtocolTCP:
+		if len(payload) < 13 {
+			return false
+		}
+
+		return payloadLength > int(payload[12]>>4)*4
+	case layers.IPProtocolUDP:
+		return payloadLength > 8
+	case layers.IPProtocolICMPv6:
+		// only echo requests / replies have an identifier and sequence number
+		return len(payload) > 0 && (payload[0] == layers.ICMPv6TypeEchoRequest || payload[0] == layers.ICMPv6TypeEchoReply)
+	case layers.IPProtocolIPv6HopByHop:
+		// a router alert, i.e. MLD (or RSVP) control traffic
+		return false
+	}
+
+	return true
+}
+
+// Get hashes the innermost IP packet leaving out what can change in transit (TTL / hop limit, DSCP / ECN and
+// checksums), with up to hashBytes of its payload (less if that's all that was captured); the IPv4 ID keeps otherwise
+// identical packets (e.g. keepalives) apart (IPv6 has only its flow label, see Distinct), and it's not ok if there's no
+// IP layer
+func Get(packet gopacket.Packet, hashBytes int) (Fingerprint, bool) {
+	packetLayers := packet.Layers()
+
+	for i := len(packetLayers) - 1; i >= 0; i-- {
+		var header, payload []byte
+		var payloadLength int
+		var protocol layers.IPProtocol
+
+		// only the first fragment has the transport header
+		transport := true
+
+		fingerprint := Fingerprint{}
+
+		switch l := packetLayers[i].(type) {
+		case *layers.IPv4:
+			header = append([]byte{}, l.Contents...)
+			header[1] = 0                 // DSCP / ECN
+			header[8] = 0                 // TTL
+			header[10], header[11] = 0, 0 // checksum
+
+			payload = l.Payload
+			payloadLength = int(l.Length) - len(l.Contents)
+			protocol = l.Protocol
+
+			transport = l.FragOffset == 0
+
+			fingerprint.Protocol, fingerprint.SourceIP, fingerprint.DestinationIP = "IPv4", l.SrcIP.String(), l.DstIP.String()
+			fingerprint.Length = int(l.Length)
+			fingerprint.TTL = int(l.TTL)
+			fingerprint.Distinct = true
+
+		case *layers.IPv6:
+			header = append([]byte{}, l.Contents...)
+			header[0] &= 0xf0 // traffic class (the flow label is kept)
+			header[1] &= 0x0f
+			header[7] = 0 // hop limit
+
+			payload = l.Payload
+			payloadLength = int(l.Length)
+			protocol = l.NextHeader
+
+			fingerprint.Protocol, fingerprint.SourceIP, fingerprint.DestinationIP = "IPv6", l.SrcIP.String(), l.DstIP.String()
+			fingerprint.Length = len(l.Contents) + int(l.Length)
+			fingerprint.TTL = int(l.HopLimit)
+			fingerprint.Distinct = distinctIPv6(protocol, payload, payloadLength)
+
+		default:
+			continue
+		}
+
+		length := hashBytes
+		if payloadLength < length {
+			length = payloadLength
+		}
+
+		fingerprint.Complete = length >= 0 && len(payload) >= length
+
+		if length < 0 {
+			length = 0
+		}
+
+		if len(payload) < length {
+			length = len(payload)
+		}
+
+		payload = append([]byte{}, payload[:length]...)
+
+		checksumOffset := -1
+
+		switch protocol {
+		case layers.IPProtocolTCP:
+			checksumOffset = 16
+			fingerprint.Protocol = "TCP"
+		case layers.IPProtocolUDP:
+			checksumOffset = 6
+			fingerprint.Protocol = "UDP"
+		case layers.IPProtocolICMPv4:
+			checksumOffset = 2
+			fingerprint.Protocol = "ICMPv4"
+		case layers.IPProtocolICMPv6:
+			checksumOffset = 2
+			fingerprint.Protocol = "ICMPv6"
+		}
+
+		if transport && checksumOffset != -1 && checksumOffset+2 <= len(payload) {
+			payload[checksumOffset], payload[checksumOffset+1] = 0, 0
+		}
+
+		h := fnv.New64a()
+		_, _ = h.Write(header)
+		_, _ = h.Write(payload)
+
+		fingerprint.Key = h.Sum64()
+
+		return fingerprint, true
+	}
+
+	return Fingerprint{}, false
+}
@@ -0,0 +1,427 @@
+package probe_session
+
+import (
+	"fmt"
+	"github.com/initialed85/drive_test/internal/capture_trigger"
+	"github.com/initialed85/drive_test/internal/probe_stats"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Interval is shared by udp_probe_dumper and twamp_dumper; the forward / reverse loss is only known if the reflector
+// counts what it's seen and the one-way delays only if both clocks are synchronized
+type Interval struct {
+	IntervalStart time.Time            `json:"interval_start"`
+	IntervalEnd   time.Time            `json:"interval_end"`
+	Sent          int                  `json:"sent"`
+	Received      int                  `json:"received"`
+	Lost          int                  `json:"lost"`
+	LossPercent   float64              `json:"loss_percent"`
+	ForwardLost   *int                 `json:"forward_lost,omitempty"`
+	ReverseLost   *int                 `json:"reverse_lost,omitempty"`
+	Reordered     int                  `json:"reordered"`
+	Duplicates    int                  `json:"duplicates"`
+	RTT           probe_stats.Summary  `json:"rtt"`
+	ForwardDelay  *probe_stats.Summary `json:"forward_delay,omitempty"`
+	ReverseDelay  *probe_stats.Summary `json:"reverse_delay,omitempty"`
+	Jitter        float64              `json:"jitter_ms"`
+	ForwardJitter float64              `json:"forward_jitter_ms"`
+	ReverseJitter float64              `json:"reverse_jitter_ms"`
+}
+
+// Reply is what a codec gets out of a reflected packet; the reflector's receive / send times are zero if it didn't
+// stamp them, Turnaround is how much of the round trip was spent in the reflector (left out of the RTT),
+// ReflectorCount (if Counted) is how many packets the reflector had seen as of this one and Synchronized is whether
+// both clocks claim to be synchronized
+type Reply struct {
+	Sequence             uint32
+	ReflectorReceiveTime time.Time
+	ReflectorSendTime    time.Time
+	Turnaround           time.Duration
+	Counted              bool
+	ReflectorCount       uint32
+	Synchronized         bool
+}
+
+// Codec is a dumper's wire format
+type Codec interface {
+	Marshal(sequence uint32, sentAt time.Time) []byte
+	Unmarshal(data []byte) (Reply, error)
+}
+
+// LossTrigger asks a packet_dumper (at its ring buffer's http_address) to dump a capture when an interval's loss
+// reaches Percent; it fires once per burst, so not again until an interval's loss is back below Percent
+type LossTrigger struct {
+	Address  string
+	Percent  float64
+	bursting bool
+}
+
+func (l *LossTrigger) check(target string, interval Interval) {
+	if interval.Sent == 0 {
+		return
+	}
+
+	bursting := interval.LossPercent >= l.Percent
+
+	if !bursting || l.bursting {
+		l.bursting = bursting
+
+		return
+	}
+
+	l.bursting = true
+
+	reason := fmt.Sprintf("%.1f%% probe loss to %v from %v", interval.LossPercent, target, interval.IntervalStart)
+
+	// not holding up the probes while packet_dumper answers
+	go func() {
+		err := capture_trigger.Fire(l.Address, reason)
+		if err != nil {
+			log.Printf("warning: failed to trigger a capture at %v: %v", l.Address, err)
+		}
+	}()
+}
+
+type probe struct {
+	bucket  int64
+	sentAt  time.Time
+	replies int
+}
+
+type bucket struct {
+	firstSequence  uint32
+	lastSequence   uint32
+	sent           int
+	received       int
+	duplicates     int
+	reordered      int
+	rtts           []float64
+	forwardDelays  []float64
+	reverseDelays  []float64
+	replied        bool
+	highestReplied uint32
+	reflectorCount uint32
+	counted        bool
+}
+
+// tracker attributes each probe to the interval it was sent in and only reports on an interval once its
+// probes have had timeout to come back
+type tracker struct {
+	mu                sync.Mutex
+	codec             Codec
+	start             time.Time
+	interval          time.Duration
+	timeout           time.Duration
+	nextSequence      uint32
+	probes            map[uint32]*probe
+	buckets           map[int64]*bucket
+	nextReport        int64
+	highestReceived   uint32
+	received          bool
+	counted           bool
+	rttJitter         probe_stats.Jitter
+	forwardJitter     probe_stats.Jitter
+	reverseJitter     probe_stats.Jitter
+	lastForwardLosses int64
+}
+
+func newTracker(codec Codec, interval, timeout time.Duration) *tracker {
+	return &tracker{
+		codec:    codec,
+		start:    time.Now(),
+		interval: interval,
+		timeout:  timeout,
+		probes:   make(map[uint32]*probe),
+		buckets:  make(map[int64]*bucket),
+	}
+}
+
+func (t *tracker) send() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	sequence := t.nextSequence
+	t.nextSequence++
+
+	index := int64(now.Sub(t.start) / t.interval)
+
+	b, ok := t.buckets[index]
+	if !ok {
+		b = &bucket{firstSequence: sequence}
+		t.buckets[index] = b
+	}
+
+	b.lastSequence = sequence
+	b.sent++
+
+	t.probes[sequence] = &probe{
+		bucket: index,
+		sentAt: now,
+	}
+
+	return t.codec.Marshal(sequence, now)
+}
+
+func (t *tracker) receive(reply Reply, arrival time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.probes[reply.Sequence]
+	if !ok {
+		return // too late; already reported as lost
+	}
+
+	b := t.buckets[p.bucket]
+
+	p.replies++
+	if p.replies > 1 {
+		b.duplicates++
+
+		return
+	}
+
+	b.received++
+
+	rtt := arrival.Sub(p.sentAt) - reply.Turnaround
+	b.rtts = append(b.rtts, probe_stats.Milliseconds(rtt))
+
+	if t.received && reply.Sequence < t.highestReceived {
+		b.reordered++
+	} else {
+		t.highestReceived = reply.Sequence
+		t.received = true
+	}
+
+	if reply.Counted && (!b.replied || reply.Sequence > b.highestReplied) {
+		b.highestReplied = reply.Sequence
+		b.reflectorCount = reply.ReflectorCount
+		b.replied = true
+		b.counted = true
+		t.counted = true
+	}
+
+	t.rttJitter.Update(rtt)
+
+	if reply.ReflectorReceiveTime.IsZero() || reply.ReflectorSendTime.IsZero() {
+		return
+	}
+
+	// T1 = p.sentAt, T2 = reply.ReflectorReceiveTime, T3 = reply.ReflectorSendTime, T4 = arrival
+	forward := reply.ReflectorReceiveTime.Sub(p.sentAt)
+	reverse := arrival.Sub(reply.ReflectorSendTime)
+
+	// one-way delays are only meaningful if both clocks are synchronized (unlike their jitter)
+	if reply.Synchronized {
+		b.forwardDelays = append(b.forwardDelays, probe_stats.Milliseconds(forward))
+		b.reverseDelays = append(b.reverseDelays, probe_stats.Milliseconds(reverse))
+	}
+
+	t.forwardJitter.Update(forward)
+	t.reverseJitter.Update(reverse)
+}
+
+// report returns the intervals that are complete (and their timeouts elapsed) as of now
+func (t *tracker) report(now time.Time) []Interval {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	intervals := make([]Interval, 0)
+
+	for {
+		intervalStart := t.start.Add(time.Duration(t.nextReport) * t.interval)
+		intervalEnd := intervalStart.Add(t.interval)
+
+		if now.Before(intervalEnd.Add(t.timeout)) {
+			break
+		}
+
+		interval := Interval{
+			IntervalStart: intervalStart,
+			IntervalEnd:   intervalEnd,
+			Jitter:        t.rttJitter.Milliseconds(),
+			ForwardJitter: t.forwardJitter.Milliseconds(),
+			ReverseJitter: t.reverseJitter.Milliseconds(),
+		}
+
+		b, ok := t.buckets[t.nextReport]
+		if ok {
+			interval.Sent = b.sent
+			interval.Received = b.received
+			interval.Lost = b.sent - b.received
+			interval.Reordered = b.reordered
+			interval.Duplicates = b.duplicates
+			interval.RTT = probe_stats.Summarise(b.rtts)
+
+			if b.sent > 0 {
+				interval.LossPercent = float64(interval.Lost) / float64(b.sent) * 100
+			}
+
+			// the reflector tells us how many probes it had seen as of the highest replied sequence, so the
+			// difference is how many were lost on the way there; the rest of the loss was on the way back
+			if b.counted {
+				forwardLosses := int64(b.highestReplied) + 1 - int64(b.reflectorCount)
+
+				forwardLost := int(forwardLosses - t.lastForwardLosses)
+				if forwardLost < 0 {
+					forwardLost = 0
+				}
+
+				if forwardLost > interval.Lost {
+					forwardLost = interval.Lost
+				}
+
+				reverseLost := interval.Lost - forwardLost
+
+				interval.ForwardLost = &forwardLost
+				interval.ReverseLost = &reverseLost
+
+				t.lastForwardLosses = forwardLosses
+			} else if t.counted && interval.Lost > 0 {
+				// nothing came back to say how many the reflector saw, so it's taken as none of them (a later
+				// reply's count puts the running total right if some were)
+				forwardLost := interval.Lost
+				reverseLost := 0
+
+				interval.ForwardLost = &forwardLost
+				interval.ReverseLost = &reverseLost
+
+				t.lastForwardLosses += int64(forwardLost)
+			}
+
+			if len(b.forwardDelays) > 0 {
+				forwardDelay := probe_stats.Summarise(b.forwardDelays)
+				reverseDelay := probe_stats.Summarise(b.reverseDelays)
+
+				interval.ForwardDelay = &forwardDelay
+				interval.ReverseDelay = &reverseDelay
+			}
+
+			// counting rather than comparing, as the sequence numbers may have wrapped
+			for i := uint64(0); i <= uint64(b.lastSequence-b.firstSequence); i++ {
+				delete(t.probes, b.firstSequence+uint32(i))
+			}
+
+			delete(t.buckets, t.nextReport)
+		}
+
+		intervals = append(intervals, interval)
+
+		t.nextReport++
+	}
+
+	return intervals
+}
+
+func isConnectionRefused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+
+	syscallErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+
+	return syscallErr.Err == syscall.ECONNREFUSED
+}
+
+func receiveReplies(conn *net.UDPConn, t *tracker, errs chan error) {
+	buf := make([]byte, 65536)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			// the reflector isn't (yet) listening; keep probing and count it as loss
+			if isConnectionRefused(err) {
+				continue
+			}
+
+			errs <- err
+
+			return
+		}
+
+		arrival := time.Now()
+
+		reply, err := t.codec.Unmarshal(buf[0:n])
+		if err != nil {
+			continue
+		}
+
+		t.receive(reply, arrival)
+	}
+}
+
+// Watch sends probes (in the codec's wire format) at rate (per second) to a reflector and calls back with the target
+// and the stats for every interval (in seconds); probes not returned within timeout (in seconds) are lost, and a burst
+// of loss fires the loss trigger (if there is one)
+func Watch(host string, port int, rate float64, interval, timeout float64, codec Codec, lossTrigger *LossTrigger, callback func(target string, interval Interval) error) error {
+	if rate <= 0 {
+		return fmt.Errorf("rate must be positive; got %v", rate)
+	}
+
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive; got %v", interval)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%v:%v", host, port))
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	t := newTracker(
+		codec,
+		time.Duration(interval*float64(time.Second)),
+		time.Duration(timeout*float64(time.Second)),
+	)
+
+	errs := make(chan error, 1)
+
+	go receiveReplies(conn, t, errs)
+
+	sendTicker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer sendTicker.Stop()
+
+	reportTicker := time.NewTicker(time.Millisecond * 100)
+	defer reportTicker.Stop()
+
+	for {
+		select {
+		case <-sendTicker.C:
+			_, err := conn.Write(t.send())
+			if err != nil && !isConnectionRefused(err) {
+				return err
+			}
+		case now := <-reportTicker.C:
+			for _, i := range t.report(now) {
+				if lossTrigger != nil {
+					lossTrigger.check(addr.String(), i)
+				}
+
+				err := callback(addr.String(), i)
+				if err != nil {
+					return err
+				}
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
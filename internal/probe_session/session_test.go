@@ -0,0 +1,75 @@
+package probe_session
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type testCodec struct{}
+
+func (testCodec) Marshal(sequence uint32, sentAt time.Time) []byte {
+	return nil
+}
+
+func (testCodec) Unmarshal(data []byte) (Reply, error) {
+	return Reply{}, nil
+}
+
+// TestReportLastSequence has an interval's probes end at math.MaxUint32 (the last before the sequence numbers wrap)
+func TestReportLastSequence(t *testing.T) {
+	tr := newTracker(testCodec{}, time.Hour, time.Second)
+	tr.nextSequence = math.MaxUint32 - 1
+
+	for i := 0; i < 2; i++ {
+		tr.send()
+	}
+
+	tr.receive(Reply{Sequence: math.MaxUint32}, time.Now())
+
+	intervals := tr.report(tr.start.Add(time.Hour + time.Second))
+
+	if len(intervals) != 1 {
+		t.Fatalf("got %v intervals, want 1", len(intervals))
+	}
+
+	if intervals[0].Sent != 2 || intervals[0].Received != 1 || intervals[0].Lost != 1 {
+		t.Errorf("got %+v, want 2 sent, 1 received, 1 lost", intervals[0])
+	}
+
+	if len(tr.probes) != 0 {
+		t.Errorf("got %v probes still tracked, want none", len(tr.probes))
+	}
+}
+
+// TestReportAllLost has a counted reply in the first interval and every probe lost in the second
+func TestReportAllLost(t *testing.T) {
+	tr := newTracker(testCodec{}, time.Hour, time.Second)
+
+	// the probes are attributed to intervals by when they're sent relative to the start
+	tr.start = time.Now().Add(-time.Minute)
+
+	tr.send()
+	tr.receive(Reply{Sequence: 0, Counted: true, ReflectorCount: 1}, time.Now())
+
+	tr.start = tr.start.Add(-time.Hour)
+
+	tr.send()
+	tr.send()
+
+	intervals := tr.report(tr.start.Add(time.Hour*2 + time.Second))
+
+	if len(intervals) != 2 {
+		t.Fatalf("got %v intervals, want 2", len(intervals))
+	}
+
+	first, second := intervals[0], intervals[1]
+
+	if first.ForwardLost == nil || *first.ForwardLost != 0 || first.ReverseLost == nil || *first.ReverseLost != 0 {
+		t.Errorf("got forward / reverse lost %v / %v in the first interval, want 0 / 0", first.ForwardLost, first.ReverseLost)
+	}
+
+	if second.Lost != 2 || second.ForwardLost == nil || *second.ForwardLost != 2 || second.ReverseLost == nil || *second.ReverseLost != 0 {
+		t.Errorf("got %v lost, forward / reverse lost %v / %v in the second interval, want 2, 2 / 0", second.Lost, second.ForwardLost, second.ReverseLost)
+	}
+}
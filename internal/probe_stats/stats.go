@@ -0,0 +1,162 @@
+package probe_stats
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Summary describes a set of latency samples in milliseconds
+type Summary struct {
+	Samples int     `json:"samples"`
+	Min     float64 `json:"min_ms"`
+	Avg     float64 `json:"avg_ms"`
+	Max     float64 `json:"max_ms"`
+	P50     float64 `json:"p50_ms"`
+	P90     float64 `json:"p90_ms"`
+	P99     float64 `json:"p99_ms"`
+}
+
+func Milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Percentile uses the nearest-rank method on an already sorted slice
+func Percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+
+	return sorted[rank-1]
+}
+
+func Summarise(values []float64) Summary {
+	summary := Summary{
+		Samples: len(values),
+	}
+
+	if len(values) == 0 {
+		return summary
+	}
+
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	total := 0.0
+	for _, value := range sorted {
+		total += value
+	}
+
+	summary.Min = sorted[0]
+	summary.Avg = total / float64(len(sorted))
+	summary.Max = sorted[len(sorted)-1]
+	summary.P50 = Percentile(sorted, 50)
+	summary.P90 = Percentile(sorted, 90)
+	summary.P99 = Percentile(sorted, 99)
+
+	return summary
+}
+
+// Reservoir summarises any number of samples in bounded memory; the count, min, avg and max are exact and the
+// percentiles come from a uniform random sample of up to size of them (Vitter's algorithm R), so they're exact too
+// until there are more than size samples
+type Reservoir struct {
+	size    int
+	count   int
+	min     float64
+	max     float64
+	total   float64
+	samples []float64
+	state   uint64
+}
+
+func NewReservoir(size int) *Reservoir {
+	return &Reservoir{
+		size:    size,
+		samples: make([]float64, 0),
+		state:   0x9e3779b97f4a7c15,
+	}
+}
+
+// random is xorshift64 (so a reservoir doesn't need a math/rand source of its own, which is large)
+func (r *Reservoir) random(n int) int {
+	r.state ^= r.state << 13
+	r.state ^= r.state >> 7
+	r.state ^= r.state << 17
+
+	return int(r.state % uint64(n))
+}
+
+func (r *Reservoir) Add(value float64) {
+	if r.count == 0 || value < r.min {
+		r.min = value
+	}
+
+	if r.count == 0 || value > r.max {
+		r.max = value
+	}
+
+	r.count++
+	r.total += value
+
+	if len(r.samples) < r.size {
+		r.samples = append(r.samples, value)
+
+		return
+	}
+
+	i := r.random(r.count)
+	if i < r.size {
+		r.samples[i] = value
+	}
+}
+
+func (r *Reservoir) Summary() Summary {
+	summary := Summarise(r.samples)
+
+	summary.Samples = r.count
+
+	if r.count > 0 {
+		summary.Min = r.min
+		summary.Avg = r.total / float64(r.count)
+		summary.Max = r.max
+	}
+
+	return summary
+}
+
+// Jitter is the RFC 3550 (section 6.4.1) interarrival jitter estimator; because it only ever looks at the
+// difference between successive transit times, any constant clock offset between sender and receiver cancels out
+type Jitter struct {
+	lastTransit time.Duration
+	started     bool
+	jitter      float64
+}
+
+func (j *Jitter) Update(transit time.Duration) {
+	if !j.started {
+		j.lastTransit = transit
+		j.started = true
+
+		return
+	}
+
+	d := float64(transit - j.lastTransit)
+	j.lastTransit = transit
+
+	j.jitter += (math.Abs(d) - j.jitter) / 16
+}
+
+func (j *Jitter) Milliseconds() float64 {
+	return j.jitter / float64(time.Millisecond)
+}
@@ -0,0 +1,31 @@
+package scheduler
+
+import (
+	"time"
+)
+
+// Every calls fn straight away and then once every period until stop is closed; if fn takes longer than period the
+// missed ticks are dropped rather than queued up
+func Every(period time.Duration, stop chan struct{}, fn func()) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	fn()
+
+	for {
+		select {
+		case <-ticker.C:
+			fn()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func SecondsToDuration(seconds, defaultSeconds float64) time.Duration {
+	if seconds <= 0 {
+		seconds = defaultSeconds
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
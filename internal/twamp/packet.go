@@ -0,0 +1,134 @@
+package twamp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// unauthenticated mode TWAMP-Test packet layouts as per RFC 5357 sections 4.1.2 and 4.2.1
+const (
+	DefaultPort         = 862
+	SenderHeaderSize    = 14
+	ReflectorHeaderSize = 41
+	ntpEpochOffset      = 2208988800
+)
+
+func PutTimestamp(b []byte, t time.Time) {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+
+	binary.BigEndian.PutUint32(b[0:4], uint32(seconds))
+	binary.BigEndian.PutUint32(b[4:8], uint32(fraction))
+}
+
+func GetTimestamp(b []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	fraction := uint64(binary.BigEndian.Uint32(b[4:8]))
+
+	return time.Unix(seconds, int64((fraction*uint64(time.Second))>>32))
+}
+
+// ErrorEstimate is the RFC 4656 section 4.1.2 S / Z / Scale / Multiplier field
+type ErrorEstimate uint16
+
+func NewErrorEstimate(synchronized bool, scale, multiplier uint8) ErrorEstimate {
+	e := ErrorEstimate(scale&0x3f)<<8 | ErrorEstimate(multiplier)
+
+	if synchronized {
+		e |= 0x8000
+	}
+
+	return e
+}
+
+// Synchronized is true if the clock that generated the timestamp is synchronized to UTC (e.g. by GPS or NTP)
+func (e ErrorEstimate) Synchronized() bool {
+	return e&0x8000 != 0
+}
+
+func (e ErrorEstimate) Seconds() float64 {
+	scale := uint(e>>8) & 0x3f
+	multiplier := float64(e & 0xff)
+
+	return multiplier * float64(uint64(1)<<scale) / float64(uint64(1)<<32)
+}
+
+type SenderPacket struct {
+	Sequence      uint32
+	Timestamp     time.Time
+	ErrorEstimate ErrorEstimate
+}
+
+func (p *SenderPacket) Marshal(size int) []byte {
+	if size < SenderHeaderSize {
+		size = SenderHeaderSize
+	}
+
+	data := make([]byte, size)
+
+	binary.BigEndian.PutUint32(data[0:4], p.Sequence)
+	PutTimestamp(data[4:12], p.Timestamp)
+	binary.BigEndian.PutUint16(data[12:14], uint16(p.ErrorEstimate))
+
+	return data
+}
+
+func UnmarshalSenderPacket(data []byte) (SenderPacket, error) {
+	if len(data) < SenderHeaderSize {
+		return SenderPacket{}, fmt.Errorf("sender packet too short; wanted at least %v bytes, got %v", SenderHeaderSize, len(data))
+	}
+
+	return SenderPacket{
+		Sequence:      binary.BigEndian.Uint32(data[0:4]),
+		Timestamp:     GetTimestamp(data[4:12]),
+		ErrorEstimate: ErrorEstimate(binary.BigEndian.Uint16(data[12:14])),
+	}, nil
+}
+
+type ReflectorPacket struct {
+	Sequence            uint32
+	Timestamp           time.Time
+	ErrorEstimate       ErrorEstimate
+	ReceiveTimestamp    time.Time
+	SenderSequence      uint32
+	SenderTimestamp     time.Time
+	SenderErrorEstimate ErrorEstimate
+	SenderTTL           uint8
+}
+
+func (p *ReflectorPacket) Marshal(size int) []byte {
+	if size < ReflectorHeaderSize {
+		size = ReflectorHeaderSize
+	}
+
+	data := make([]byte, size)
+
+	binary.BigEndian.PutUint32(data[0:4], p.Sequence)
+	PutTimestamp(data[4:12], p.Timestamp)
+	binary.BigEndian.PutUint16(data[12:14], uint16(p.ErrorEstimate))
+	PutTimestamp(data[16:24], p.ReceiveTimestamp)
+	binary.BigEndian.PutUint32(data[24:28], p.SenderSequence)
+	PutTimestamp(data[28:36], p.SenderTimestamp)
+	binary.BigEndian.PutUint16(data[36:38], uint16(p.SenderErrorEstimate))
+	data[40] = p.SenderTTL
+
+	return data
+}
+
+func UnmarshalReflectorPacket(data []byte) (ReflectorPacket, error) {
+	if len(data) < ReflectorHeaderSize {
+		return ReflectorPacket{}, fmt.Errorf("reflector packet too short; wanted at least %v bytes, got %v", ReflectorHeaderSize, len(data))
+	}
+
+	return ReflectorPacket{
+		Sequence:            binary.BigEndian.Uint32(data[0:4]),
+		Timestamp:           GetTimestamp(data[4:12]),
+		ErrorEstimate:       ErrorEstimate(binary.BigEndian.Uint16(data[12:14])),
+		ReceiveTimestamp:    GetTimestamp(data[16:24]),
+		SenderSequence:      binary.BigEndian.Uint32(data[24:28]),
+		SenderTimestamp:     GetTimestamp(data[28:36]),
+		SenderErrorEstimate: ErrorEstimate(binary.BigEndian.Uint16(data[36:38])),
+		SenderTTL:           data[40],
+	}, nil
+}
@@ -0,0 +1,88 @@
+package udp_probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	Magic      = 0x44545052 // "DTPR"
+	HeaderSize = 40
+)
+
+// Probe is the wire format shared by udp_probe_dumper and udp_reflector; the sender fills in the first half and the
+// reflector stamps the second half before echoing it back
+type Probe struct {
+	SessionID            uint32
+	Sequence             uint32
+	SendTime             time.Time
+	ReflectorCount       uint32
+	ReflectorReceiveTime time.Time
+	ReflectorSendTime    time.Time
+}
+
+func putTime(b []byte, t time.Time) {
+	if t.IsZero() {
+		binary.BigEndian.PutUint64(b, 0)
+
+		return
+	}
+
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+}
+
+func getTime(b []byte) time.Time {
+	nanos := int64(binary.BigEndian.Uint64(b))
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanos)
+}
+
+// Marshal encodes the probe, zero-padding it out to size (if size is larger than the header)
+func (p *Probe) Marshal(size int) []byte {
+	if size < HeaderSize {
+		size = HeaderSize
+	}
+
+	data := make([]byte, size)
+
+	binary.BigEndian.PutUint32(data[0:4], Magic)
+	binary.BigEndian.PutUint32(data[4:8], p.SessionID)
+	binary.BigEndian.PutUint32(data[8:12], p.Sequence)
+	putTime(data[12:20], p.SendTime)
+	binary.BigEndian.PutUint32(data[20:24], p.ReflectorCount)
+	putTime(data[24:32], p.ReflectorReceiveTime)
+	putTime(data[32:40], p.ReflectorSendTime)
+
+	return data
+}
+
+func Unmarshal(data []byte) (Probe, error) {
+	if len(data) < HeaderSize {
+		return Probe{}, fmt.Errorf("probe too short; wanted at least %v bytes, got %v", HeaderSize, len(data))
+	}
+
+	magic := binary.BigEndian.Uint32(data[0:4])
+	if magic != Magic {
+		return Probe{}, fmt.Errorf("bad probe magic %#x", magic)
+	}
+
+	return Probe{
+		SessionID:            binary.BigEndian.Uint32(data[4:8]),
+		Sequence:             binary.BigEndian.Uint32(data[8:12]),
+		SendTime:             getTime(data[12:20]),
+		ReflectorCount:       binary.BigEndian.Uint32(data[20:24]),
+		ReflectorReceiveTime: getTime(data[24:32]),
+		ReflectorSendTime:    getTime(data[32:40]),
+	}, nil
+}
+
+// Stamp fills in the reflector half of an already-received probe in place (leaving any padding untouched)
+func Stamp(data []byte, count uint32, receiveTime, sendTime time.Time) {
+	binary.BigEndian.PutUint32(data[20:24], count)
+	putTime(data[24:32], receiveTime)
+	putTime(data[32:40], sendTime)
+}
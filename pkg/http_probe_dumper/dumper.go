@@ -0,0 +1,291 @@
+package http_probe_dumper
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/initialed85/drive_test/internal/probe_stats"
+	"github.com/initialed85/drive_test/internal/scheduler"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPeriod  = 10
+	defaultTimeout = 5
+
+	phaseDNS     = "dns"
+	phaseConnect = "connect"
+	phaseTLS     = "tls"
+	phaseHTTP    = "http"
+)
+
+type Target struct {
+	Name     string  `json:"name"`
+	URL      string  `json:"url"`
+	Period   float64 `json:"period"`
+	Timeout  float64 `json:"timeout"`
+	Insecure bool    `json:"insecure"`
+}
+
+type Config struct {
+	Targets []Target `json:"targets"`
+}
+
+// Result has a duration for each phase of the request; phases that didn't happen (e.g. DNS for an IP literal or
+// TLS for plain HTTP) are left out
+type Result struct {
+	URL           string   `json:"url"`
+	Success       bool     `json:"success"`
+	RemoteAddress string   `json:"remote_address,omitempty"`
+	DNS           *float64 `json:"dns_ms,omitempty"`
+	Connect       *float64 `json:"connect_ms,omitempty"`
+	TLS           *float64 `json:"tls_ms,omitempty"`
+	TLSVersion    string   `json:"tls_version,omitempty"`
+	FirstByte     *float64 `json:"first_byte_ms,omitempty"`
+	Transfer      *float64 `json:"transfer_ms,omitempty"`
+	Total         float64  `json:"total_ms"`
+	StatusCode    int      `json:"status_code,omitempty"`
+	Bytes         int64    `json:"bytes"`
+	ErrorPhase    string   `json:"error_phase,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type Output struct {
+	Timestamp time.Time `json:"timestamp"`
+	Target    string    `json:"target"`
+	Result    *Result   `json:"result,omitempty"`
+}
+
+// timings are filled in by httptrace hooks, which may be called from other goroutines (e.g. when racing IPv4 / IPv6)
+type timings struct {
+	mu            sync.Mutex
+	dnsStart      time.Time
+	dnsDone       time.Time
+	connectStart  time.Time
+	connectDone   time.Time
+	tlsStart      time.Time
+	tlsDone       time.Time
+	wroteRequest  time.Time
+	firstByte     time.Time
+	remoteAddress string
+	tlsVersion    uint16
+	errorPhase    string
+}
+
+func (t *timings) setErrorPhase(phase string, err error) {
+	if err != nil && t.errorPhase == "" {
+		t.errorPhase = phase
+	}
+}
+
+func (t *timings) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsDone = time.Now()
+			t.setErrorPhase(phaseDNS, info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if err == nil && t.connectDone.IsZero() {
+				t.connectDone = time.Now()
+				t.remoteAddress = addr
+			}
+			t.setErrorPhase(phaseConnect, err)
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsDone = time.Now()
+			t.tlsVersion = state.Version
+			t.setErrorPhase(phaseTLS, err)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.firstByte = time.Now()
+		},
+	}
+}
+
+func between(start, end time.Time) *float64 {
+	if start.IsZero() || end.IsZero() {
+		return nil
+	}
+
+	ms := probe_stats.Milliseconds(end.Sub(start))
+
+	return &ms
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	case 0:
+		return ""
+	}
+
+	return fmt.Sprintf("%#04x", version)
+}
+
+// probe does a GET on a fresh connection every time (so every phase is measured) and doesn't follow redirects
+func probe(target Target, timeout time.Duration) Result {
+	t := &timings{}
+
+	result := Result{
+		URL: target.URL,
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: target.Insecure,
+			},
+		},
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+
+	request, err := http.NewRequest(http.MethodGet, target.URL, nil)
+	if err == nil {
+		request = request.WithContext(httptrace.WithClientTrace(request.Context(), t.trace()))
+
+		var response *http.Response
+
+		response, err = client.Do(request)
+		if err == nil {
+			result.StatusCode = response.StatusCode
+
+			result.Bytes, err = io.Copy(ioutil.Discard, response.Body)
+
+			_ = response.Body.Close()
+		}
+	}
+
+	end := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result.Total = probe_stats.Milliseconds(end.Sub(start))
+	result.RemoteAddress = t.remoteAddress
+	result.DNS = between(t.dnsStart, t.dnsDone)
+	result.Connect = between(t.connectStart, t.connectDone)
+	result.TLS = between(t.tlsStart, t.tlsDone)
+	result.TLSVersion = tlsVersionName(t.tlsVersion)
+	result.FirstByte = between(t.wroteRequest, t.firstByte)
+
+	if err == nil {
+		result.Success = true
+		result.Transfer = between(t.firstByte, end)
+	} else {
+		result.Error = err.Error()
+
+		result.ErrorPhase = t.errorPhase
+		if result.ErrorPhase == "" {
+			result.ErrorPhase = phaseHTTP
+		}
+	}
+
+	return result
+}
+
+type targetResult struct {
+	name      string
+	timestamp time.Time
+	result    Result
+}
+
+func probeForever(name string, target Target, results chan targetResult) {
+	timeout := scheduler.SecondsToDuration(target.Timeout, defaultTimeout)
+
+	scheduler.Every(scheduler.SecondsToDuration(target.Period, defaultPeriod), nil, func() {
+		timestamp := time.Now()
+
+		results <- targetResult{name, timestamp, probe(target, timeout)}
+	})
+}
+
+// Watch does a DNS lookup, TCP connect, TLS handshake (for HTTPS) and HTTP GET against each of the targets on its
+// own period and calls back with the duration of each phase
+func Watch(config Config, callback func(Output) error) error {
+	if len(config.Targets) == 0 {
+		return fmt.Errorf("no targets configured")
+	}
+
+	names := make(map[string]Target)
+
+	for _, target := range config.Targets {
+		name := target.Name
+		if name == "" {
+			name = target.URL
+		}
+
+		if _, ok := names[name]; ok {
+			return fmt.Errorf("duplicate target name %#+v", name)
+		}
+
+		names[name] = target
+	}
+
+	results := make(chan targetResult)
+
+	for name, target := range names {
+		go probeForever(name, target, results)
+	}
+
+	for r := range results {
+		result := r.result
+
+		err := callback(Output{
+			Timestamp: r.timestamp,
+			Target:    r.name,
+			Result:    &result,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
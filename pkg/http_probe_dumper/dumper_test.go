@@ -0,0 +1,152 @@
+package http_probe_dumper
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTimeout = time.Second * 5
+
+func newTestHandler(statusCode int, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+		_, _ = w.Write([]byte(body))
+	})
+}
+
+func checkPhases(t *testing.T, result Result, dns, connect, tls, firstByte, transfer bool) {
+	t.Helper()
+
+	for _, phase := range []struct {
+		name   string
+		value  *float64
+		wanted bool
+	}{
+		{"dns", result.DNS, dns},
+		{"connect", result.Connect, connect},
+		{"tls", result.TLS, tls},
+		{"first byte", result.FirstByte, firstByte},
+		{"transfer", result.Transfer, transfer},
+	} {
+		if (phase.value != nil) != phase.wanted {
+			t.Errorf("got %v timing %v, wanted it present: %v", phase.name, phase.value, phase.wanted)
+		}
+
+		if phase.value != nil && *phase.value < 0 {
+			t.Errorf("got negative %v timing %v", phase.name, *phase.value)
+		}
+	}
+
+	if result.Total <= 0 {
+		t.Errorf("got total %v, want > 0", result.Total)
+	}
+}
+
+func TestProbeHTTP(t *testing.T) {
+	server := httptest.NewServer(newTestHandler(http.StatusOK, "hello world"))
+	defer server.Close()
+
+	result := probe(Target{URL: server.URL}, testTimeout)
+
+	if !result.Success || result.StatusCode != http.StatusOK || result.Bytes != 11 {
+		t.Errorf("got %+v, want success with status 200 and 11 bytes", result)
+	}
+
+	if result.Error != "" || result.ErrorPhase != "" {
+		t.Errorf("got error %#+v in phase %#+v, want none", result.Error, result.ErrorPhase)
+	}
+
+	if result.RemoteAddress != server.Listener.Addr().String() {
+		t.Errorf("got remote address %#+v, want %#+v", result.RemoteAddress, server.Listener.Addr().String())
+	}
+
+	// an IP literal needs no lookup and plain HTTP no handshake
+	checkPhases(t, result, false, true, false, true, true)
+}
+
+func TestProbeHTTPLookup(t *testing.T) {
+	server := httptest.NewServer(newTestHandler(http.StatusOK, "hello world"))
+	defer server.Close()
+
+	result := probe(Target{URL: strings.Replace(server.URL, "127.0.0.1", "localhost", 1)}, testTimeout)
+
+	if !result.Success {
+		t.Errorf("got %+v, want success", result)
+	}
+
+	checkPhases(t, result, true, true, false, true, true)
+}
+
+func TestProbeHTTPErrorStatus(t *testing.T) {
+	server := httptest.NewServer(newTestHandler(http.StatusNotFound, "not found"))
+	defer server.Close()
+
+	result := probe(Target{URL: server.URL}, testTimeout)
+
+	// the request worked, whatever the status
+	if !result.Success || result.StatusCode != http.StatusNotFound || result.Bytes != 9 || result.Error != "" {
+		t.Errorf("got %+v, want success with status 404 and 9 bytes", result)
+	}
+
+	checkPhases(t, result, false, true, false, true, true)
+}
+
+func TestProbeHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(newTestHandler(http.StatusOK, "hello world"))
+	defer server.Close()
+
+	result := probe(Target{URL: server.URL, Insecure: true}, testTimeout)
+
+	if !result.Success || result.StatusCode != http.StatusOK || result.Bytes != 11 {
+		t.Errorf("got %+v, want success with status 200 and 11 bytes", result)
+	}
+
+	if !strings.HasPrefix(result.TLSVersion, "TLS 1.") {
+		t.Errorf("got tls version %#+v, want TLS 1.x", result.TLSVersion)
+	}
+
+	checkPhases(t, result, false, true, true, true, true)
+}
+
+func TestProbeHTTPSUntrusted(t *testing.T) {
+	server := httptest.NewUnstartedServer(newTestHandler(http.StatusOK, "hello world"))
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // it logs the handshake we refuse
+	server.StartTLS()
+	defer server.Close()
+
+	// the test server's certificate isn't signed by anything trusted
+	result := probe(Target{URL: server.URL}, testTimeout)
+
+	if result.Success || result.StatusCode != 0 || result.Bytes != 0 {
+		t.Errorf("got %+v, want failure with no status or bytes", result)
+	}
+
+	if result.ErrorPhase != phaseTLS || result.Error == "" {
+		t.Errorf("got error %#+v in phase %#+v, want an error in phase %#+v", result.Error, result.ErrorPhase, phaseTLS)
+	}
+
+	checkPhases(t, result, false, true, true, false, false)
+}
+
+func TestProbeConnectionRefused(t *testing.T) {
+	server := httptest.NewServer(newTestHandler(http.StatusOK, "hello world"))
+	url := server.URL
+	server.Close()
+
+	result := probe(Target{URL: url}, testTimeout)
+
+	if result.Success || result.StatusCode != 0 {
+		t.Errorf("got %+v, want failure with no status", result)
+	}
+
+	if result.ErrorPhase != phaseConnect || result.Error == "" {
+		t.Errorf("got error %#+v in phase %#+v, want an error in phase %#+v", result.Error, result.ErrorPhase, phaseConnect)
+	}
+
+	checkPhases(t, result, false, false, false, false, false)
+}
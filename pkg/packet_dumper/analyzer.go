@@ -0,0 +1,142 @@
+package packet_dumper
+
+import (
+	"github.com/google/gopacket"
+	"github.com/initialed85/drive_test/internal/scheduler"
+)
+
+// analyzer is fed every packet (along with what handlePacket has already decoded from it) and may call back with
+// records of its own, e.g. per-interval aggregates or events
+type analyzer interface {
+	handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error
+	flush(callback func(output Output) error) error
+}
+
+// the names rules use to select analyzers
+const (
+	analyzerDHCP       = "dhcp"
+	analyzerThroughput = "throughput"
+	analyzerWiFi       = "wifi"
+	analyzerRoam       = "roam"
+	analyzerNeighbour  = "neighbour"
+	analyzerDiscovery  = "discovery"
+	analyzerDNS        = "dns"
+	analyzerTCP        = "tcp"
+	analyzerRTP        = "rtp"
+	analyzerBFD        = "bfd"
+	analyzerOSPF       = "ospf"
+	analyzerSTP        = "stp"
+	analyzerMulticast  = "multicast"
+	analyzerDuplicates = "duplicates"
+)
+
+var analyzerNames = []string{
+	analyzerDHCP,
+	analyzerThroughput,
+	analyzerWiFi,
+	analyzerRoam,
+	analyzerNeighbour,
+	analyzerDiscovery,
+	analyzerDNS,
+	analyzerTCP,
+	analyzerRTP,
+	analyzerBFD,
+	analyzerOSPF,
+	analyzerSTP,
+	analyzerMulticast,
+	analyzerDuplicates,
+}
+
+type namedAnalyzer struct {
+	name string
+	analyzer
+}
+
+func getAnalyzers(local localAddresses, config Config) []namedAnalyzer {
+	analyzers := make([]namedAnalyzer, 0)
+
+	// first, so that any change to our address is seen by the other analyzers for the same packet
+	if config.DHCPTracker {
+		analyzers = append(analyzers, namedAnalyzer{analyzerDHCP, newDHCPTracker(local)})
+	}
+
+	if config.Aggregate {
+		aggregator := newThroughputAggregator(scheduler.SecondsToDuration(config.AggregateInterval, defaultInterval.Seconds()), local)
+
+		analyzers = append(analyzers, namedAnalyzer{analyzerThroughput, aggregator})
+	}
+
+	if config.WiFiAggregate {
+		aggregator := newWiFiAggregator(scheduler.SecondsToDuration(config.WiFiAggregateInterval, defaultInterval.Seconds()))
+
+		analyzers = append(analyzers, namedAnalyzer{analyzerWiFi, aggregator})
+	}
+
+	if config.RoamAnalyzer {
+		timeout := scheduler.SecondsToDuration(config.RoamTimeout, defaultRoamTimeout.Seconds())
+
+		analyzers = append(analyzers, namedAnalyzer{analyzerRoam, newRoamAnalyzer(timeout)})
+	}
+
+	if config.NeighbourTracker {
+		analyzers = append(analyzers, namedAnalyzer{analyzerNeighbour, newNeighbourTracker(config.GatewayIP)})
+	}
+
+	if config.DiscoveryTracker {
+		analyzers = append(analyzers, namedAnalyzer{analyzerDiscovery, newDiscoveryTracker(local)})
+	}
+
+	if config.DNSTracker {
+		timeout := scheduler.SecondsToDuration(config.DNSTimeout, defaultDNSTimeout.Seconds())
+
+		analyzers = append(analyzers, namedAnalyzer{analyzerDNS, newDNSTracker(timeout)})
+	}
+
+	if config.TCPAnalyzer {
+		interval := scheduler.SecondsToDuration(config.TCPInterval, defaultInterval.Seconds())
+		timeout := scheduler.SecondsToDuration(config.TCPTimeout, defaultTCPTimeout.Seconds())
+
+		analyzers = append(analyzers, namedAnalyzer{analyzerTCP, newTCPAnalyzer(interval, timeout)})
+	}
+
+	if config.RTPAnalyzer {
+		rtp := newRTPAnalyzer(scheduler.SecondsToDuration(config.RTPInterval, defaultInterval.Seconds()), config.RTPPorts)
+
+		analyzers = append(analyzers, namedAnalyzer{analyzerRTP, rtp})
+	}
+
+	if config.BFDTracker {
+		analyzers = append(analyzers, namedAnalyzer{analyzerBFD, newBFDTracker()})
+	}
+
+	if config.OSPFTracker {
+		analyzers = append(analyzers, namedAnalyzer{analyzerOSPF, newOSPFTracker()})
+	}
+
+	if config.STPTracker {
+		analyzers = append(analyzers, namedAnalyzer{analyzerSTP, newSTPTracker()})
+	}
+
+	if config.MulticastTracker {
+		timeout := scheduler.SecondsToDuration(config.MulticastTimeout, defaultMulticastTimeout.Seconds())
+		membershipTimeout := scheduler.SecondsToDuration(config.MulticastMembershipTimeout, defaultMulticastMembershipTimeout.Seconds())
+
+		analyzers = append(analyzers, namedAnalyzer{analyzerMulticast, newMulticastTracker(local, timeout, membershipTimeout)})
+	}
+
+	if config.DuplicateDetector {
+		interval := scheduler.SecondsToDuration(config.DuplicateInterval, defaultInterval.Seconds())
+		window := scheduler.SecondsToDuration(config.DuplicateWindow, defaultDuplicateWindow.Seconds())
+
+		threshold := defaultDuplicateThreshold
+		if config.DuplicateThreshold > 0 {
+			threshold = config.DuplicateThreshold
+		}
+
+		detector := newDuplicateDetector(interval, window, threshold)
+
+		analyzers = append(analyzers, namedAnalyzer{analyzerDuplicates, detector})
+	}
+
+	return analyzers
+}
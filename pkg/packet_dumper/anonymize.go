@@ -0,0 +1,517 @@
+package packet_dumper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// anonymized addresses are remembered (as Crypto-PAn is an AES operation per bit) up to this many, then forgotten
+const maxAnonymizedAddresses = 65536
+
+// AnonymizeConfig replaces the IPs (prefix preserving, Crypto-PAn style) and MACs (keyed hash, keeping the OUI if
+// "keep_oui") in the records and the dumped pcap files; the same key always gives the same mapping (a key of 64 hex
+// digits is used as is, so it matches other Crypto-PAn implementations, anything else is hashed), and anything in
+// "allow" (IPs, CIDRs or MACs, e.g. our own infrastructure) is left as is
+type AnonymizeConfig struct {
+	Key     string   `json:"key"`
+	KeyPath string   `json:"key_path"`
+	KeepOUI bool     `json:"keep_oui"`
+	Allow   []string `json:"allow"`
+}
+
+type anonymizer struct {
+	block       cipher.Block
+	pad         []byte
+	macKey      []byte
+	keepOUI     bool
+	allowedNets []*net.IPNet
+	allowedMACs map[string]bool
+	ips         map[string]net.IP
+}
+
+func newAnonymizer(config *AnonymizeConfig) (*anonymizer, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	key := config.Key
+
+	if config.KeyPath != "" {
+		data, err := ioutil.ReadFile(config.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		key = strings.TrimSpace(string(data))
+	}
+
+	// a random key would give a different mapping every run
+	if key == "" {
+		return nil, fmt.Errorf("anonymize needs a key or key_path")
+	}
+
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil || len(keyBytes) != 32 {
+		sum := sha256.Sum256([]byte(key))
+		keyBytes = sum[:]
+	}
+
+	block, err := aes.NewCipher(keyBytes[:16])
+	if err != nil {
+		return nil, err
+	}
+
+	pad := make([]byte, aes.BlockSize)
+	block.Encrypt(pad, keyBytes[16:])
+
+	a := &anonymizer{
+		block:       block,
+		pad:         pad,
+		macKey:      keyBytes,
+		keepOUI:     config.KeepOUI,
+		allowedNets: make([]*net.IPNet, 0),
+		allowedMACs: make(map[string]bool),
+		ips:         make(map[string]net.IP),
+	}
+
+	for _, entry := range config.Allow {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err == nil {
+			a.allowedNets = append(a.allowedNets, ipNet)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip != nil {
+			bits := net.IPv6len * 8
+			if ip.To4() != nil {
+				bits = net.IPv4len * 8
+			}
+
+			a.allowedNets = append(a.allowedNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		mac, err := net.ParseMAC(entry)
+		if err == nil {
+			a.allowedMACs[mac.String()] = true
+			continue
+		}
+
+		return nil, fmt.Errorf("invalid anonymize allow entry %#+v (not an IP, CIDR or MAC)", entry)
+	}
+
+	return a, nil
+}
+
+// cryptoPAn maps each bit of the address to itself xor the first bit of the encrypted prefix before it (padded out
+// with the key's pad), so addresses sharing an n bit prefix still share one afterwards
+func (a *anonymizer) cryptoPAn(address []byte) []byte {
+	input := make([]byte, aes.BlockSize)
+	output := make([]byte, aes.BlockSize)
+	result := make([]byte, len(address))
+
+	for position := 0; position < len(address)*8; position++ {
+		copy(input, a.pad)
+
+		whole := position / 8
+		copy(input[:whole], address[:whole])
+
+		partial := position % 8
+		if partial > 0 {
+			mask := byte(0xff << uint(8-partial))
+			input[whole] = address[whole]&mask | a.pad[whole]&^mask
+		}
+
+		a.block.Encrypt(output, input)
+
+		result[whole] |= (output[0] >> 7) << uint(7-partial)
+	}
+
+	for i := range result {
+		result[i] ^= address[i]
+	}
+
+	return result
+}
+
+func (a *anonymizer) allowedIP(ip net.IP) bool {
+	// these say something about the protocol rather than who's using it
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return true
+	}
+
+	for _, ipNet := range a.allowedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// anonymizeIP returns the anonymized IP in the same form (4 or 16 bytes) as the one given
+func (a *anonymizer) anonymizeIP(ip net.IP) net.IP {
+	if a.allowedIP(ip) {
+		return ip
+	}
+
+	anonymized, ok := a.ips[string(ip)]
+	if ok {
+		return anonymized
+	}
+
+	ipv4 := ip.To4()
+	if ipv4 != nil {
+		anonymized = net.IP(a.cryptoPAn(ipv4))
+		if len(ip) == net.IPv6len {
+			anonymized = anonymized.To16()
+		}
+	} else {
+		anonymized = net.IP(a.cryptoPAn(ip))
+	}
+
+	if len(a.ips) >= maxAnonymizedAddresses {
+		a.ips = make(map[string]net.IP)
+	}
+
+	a.ips[string(ip)] = anonymized
+
+	return anonymized
+}
+
+// anonymizeMAC hashes the MAC with the key, either keeping the OUI or making it a locally administered one; group
+// (broadcast / multicast) MACs are left as is
+func (a *anonymizer) anonymizeMAC(mac net.HardwareAddr) net.HardwareAddr {
+	if len(mac) != 6 || mac[0]&0x01 != 0 || a.allowedMACs[mac.String()] {
+		return mac
+	}
+
+	h := hmac.New(sha256.New, a.macKey)
+	_, _ = h.Write(mac)
+	sum := h.Sum(nil)
+
+	anonymized := make(net.HardwareAddr, 6)
+
+	if a.keepOUI {
+		copy(anonymized[:3], mac[:3])
+		copy(anonymized[3:], sum[:3])
+	} else {
+		copy(anonymized, sum[:6])
+		anonymized[0] = anonymized[0]&0xfc | 0x02
+	}
+
+	return anonymized
+}
+
+func (a *anonymizer) ip(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+
+	return a.anonymizeIP(ip).String()
+}
+
+func (a *anonymizer) mac(s string) string {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return s
+	}
+
+	return a.anonymizeMAC(mac).String()
+}
+
+// address is for fields that could hold either (e.g. an LLDP chassis ID), anything else being left as is
+func (a *anonymizer) address(s string) string {
+	return a.ip(a.mac(s))
+}
+
+// bridgeID anonymizes the MAC in an STP bridge ID, keeping the priority
+func (a *anonymizer) bridgeID(s string) string {
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 {
+		return s
+	}
+
+	return parts[0] + "." + a.mac(parts[1])
+}
+
+// reverseName anonymizes the address in a full in-addr.arpa / ip6.arpa name (e.g. a PTR query)
+func (a *anonymizer) reverseName(name string) string {
+	lower := strings.TrimSuffix(strings.ToLower(name), ".")
+
+	if strings.HasSuffix(lower, ".in-addr.arpa") {
+		labels := strings.Split(strings.TrimSuffix(lower, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return name
+		}
+
+		ip := net.ParseIP(strings.Join([]string{labels[3], labels[2], labels[1], labels[0]}, ".")).To4()
+		if ip == nil {
+			return name
+		}
+
+		ip = a.anonymizeIP(ip)
+
+		return fmt.Sprintf("%v.%v.%v.%v.in-addr.arpa", ip[3], ip[2], ip[1], ip[0])
+	}
+
+	if strings.HasSuffix(lower, ".ip6.arpa") {
+		nibbles := strings.Split(strings.TrimSuffix(lower, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return name
+		}
+
+		digits := make([]byte, 0, 32)
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return name
+			}
+
+			digits = append(digits, nibbles[i][0])
+		}
+
+		ip, err := hex.DecodeString(string(digits))
+		if err != nil {
+			return name
+		}
+
+		digits = []byte(hex.EncodeToString(a.anonymizeIP(ip)))
+
+		reversed := make([]string, 0, 32)
+		for i := len(digits) - 1; i >= 0; i-- {
+			reversed = append(reversed, string(digits[i]))
+		}
+
+		return strings.Join(reversed, ".") + ".ip6.arpa"
+	}
+
+	return name
+}
+
+func (a *anonymizer) headers(headers Headers) Headers {
+	headers.SourceIP = a.ip(headers.SourceIP)
+	headers.DestinationIP = a.ip(headers.DestinationIP)
+
+	return headers
+}
+
+// application only has addresses in it for an HTTP Host (or SNI) that was an IP
+func (a *anonymizer) application(application *Application) *Application {
+	if application == nil {
+		return nil
+	}
+
+	anonymized := *application
+	anonymized.Name = a.ip(anonymized.Name)
+	anonymized.ServerName = a.ip(anonymized.ServerName)
+
+	return &anonymized
+}
+
+func (a *anonymizer) packetData(packetData PacketData) PacketData {
+	packetData.SourceMAC = a.mac(packetData.SourceMAC)
+	packetData.DestinationMAC = a.mac(packetData.DestinationMAC)
+	packetData.SourceIP = a.ip(packetData.SourceIP)
+	packetData.DestinationIP = a.ip(packetData.DestinationIP)
+
+	if packetData.WiFi != nil {
+		wifi := *packetData.WiFi
+		wifi.BSSID = a.mac(wifi.BSSID)
+		wifi.TransmitterMAC = a.mac(wifi.TransmitterMAC)
+		wifi.ReceiverMAC = a.mac(wifi.ReceiverMAC)
+		packetData.WiFi = &wifi
+	}
+
+	if packetData.Outer != nil {
+		outer := a.headers(*packetData.Outer)
+		packetData.Outer = &outer
+	}
+
+	packetData.Application = a.application(packetData.Application)
+
+	return packetData
+}
+
+func (a *anonymizer) discoveryNeighbour(neighbour DiscoveryNeighbour) DiscoveryNeighbour {
+	neighbour.SourceMAC = a.mac(neighbour.SourceMAC)
+	neighbour.ChassisID = a.address(neighbour.ChassisID)
+	neighbour.PortID = a.address(neighbour.PortID)
+	neighbour.ManagementAddress = a.ip(neighbour.ManagementAddress)
+
+	return neighbour
+}
+
+func (a *anonymizer) dnsAnswer(answer string) string {
+	parts := strings.SplitN(answer, " ", 2)
+	if len(parts) != 2 {
+		return answer
+	}
+
+	return parts[0] + " " + a.ip(parts[1])
+}
+
+// callID anonymizes the host part of a SIP Call-ID (which is often the caller's IP)
+func (a *anonymizer) callID(callID string) string {
+	at := strings.LastIndex(callID, "@")
+	if at == -1 {
+		return callID
+	}
+
+	return callID[:at+1] + a.ip(callID[at+1:])
+}
+
+// output returns a copy of the record with its addresses anonymized (the originals may still be in use elsewhere)
+func (a *anonymizer) output(output Output) Output {
+	if output.PacketData != nil {
+		packetData := a.packetData(*output.PacketData)
+		output.PacketData = &packetData
+	}
+
+	if output.WiFi != nil {
+		wifi := *output.WiFi
+		wifi.BSSIDs = make(map[string]*BSSIDStats)
+		for bssid, stats := range output.WiFi.BSSIDs {
+			wifi.BSSIDs[a.mac(bssid)] = stats
+		}
+		output.WiFi = &wifi
+	}
+
+	if output.Roam != nil {
+		roam := *output.Roam
+		roam.Station = a.mac(roam.Station)
+		roam.OldBSSID = a.mac(roam.OldBSSID)
+		roam.NewBSSID = a.mac(roam.NewBSSID)
+		output.Roam = &roam
+	}
+
+	if output.Neighbour != nil {
+		neighbour := *output.Neighbour
+		neighbour.IP = a.ip(neighbour.IP)
+		neighbour.MAC = a.mac(neighbour.MAC)
+		neighbour.PreviousMAC = a.mac(neighbour.PreviousMAC)
+		output.Neighbour = &neighbour
+	}
+
+	if output.Discovery != nil {
+		discovery := *output.Discovery
+		discovery.DiscoveryNeighbour = a.discoveryNeighbour(discovery.DiscoveryNeighbour)
+		if discovery.Previous != nil {
+			previous := a.discoveryNeighbour(*discovery.Previous)
+			discovery.Previous = &previous
+		}
+		output.Discovery = &discovery
+	}
+
+	if output.DHCP != nil {
+		dhcp := *output.DHCP
+		dhcp.ClientMAC = a.mac(dhcp.ClientMAC)
+		dhcp.ServerID = a.ip(dhcp.ServerID)
+		dhcp.Address = a.ip(dhcp.Address)
+		dhcp.PreviousAddress = a.ip(dhcp.PreviousAddress)
+		output.DHCP = &dhcp
+	}
+
+	if output.DNS != nil {
+		dns := *output.DNS
+		dns.ClientIP = a.ip(dns.ClientIP)
+		dns.ServerIP = a.ip(dns.ServerIP)
+		dns.QueryName = a.reverseName(dns.QueryName)
+		dns.Answers = make([]string, 0, len(output.DNS.Answers))
+		for _, answer := range output.DNS.Answers {
+			dns.Answers = append(dns.Answers, a.dnsAnswer(answer))
+		}
+		output.DNS = &dns
+	}
+
+	if output.TCPConnection != nil {
+		tcpConnection := *output.TCPConnection
+		tcpConnection.ClientIP = a.ip(tcpConnection.ClientIP)
+		tcpConnection.ServerIP = a.ip(tcpConnection.ServerIP)
+		tcpConnection.Application = a.application(tcpConnection.Application)
+		output.TCPConnection = &tcpConnection
+	}
+
+	if output.RTP != nil {
+		rtp := *output.RTP
+		rtp.Streams = make([]RTPStream, 0, len(output.RTP.Streams))
+		for _, stream := range output.RTP.Streams {
+			stream.SourceIP = a.ip(stream.SourceIP)
+			stream.DestinationIP = a.ip(stream.DestinationIP)
+			stream.CallID = a.callID(stream.CallID)
+			rtp.Streams = append(rtp.Streams, stream)
+		}
+		output.RTP = &rtp
+	}
+
+	if output.BFD != nil {
+		bfd := *output.BFD
+		bfd.SourceIP = a.ip(bfd.SourceIP)
+		bfd.DestinationIP = a.ip(bfd.DestinationIP)
+		output.BFD = &bfd
+	}
+
+	if output.OSPF != nil {
+		ospf := *output.OSPF
+		ospf.RouterID = a.ip(ospf.RouterID)
+		ospf.SourceIP = a.ip(ospf.SourceIP)
+		ospf.NeighbourID = a.ip(ospf.NeighbourID)
+		ospf.DR = a.ip(ospf.DR)
+		ospf.BDR = a.ip(ospf.BDR)
+		ospf.PreviousDR = a.ip(ospf.PreviousDR)
+		ospf.PreviousBDR = a.ip(ospf.PreviousBDR)
+		ospf.LSAs = make([]OSPFLSA, 0, len(output.OSPF.LSAs))
+		for _, lsa := range output.OSPF.LSAs {
+			lsa.LinkStateID = a.ip(lsa.LinkStateID)
+			lsa.AdvertisingRouter = a.ip(lsa.AdvertisingRouter)
+			ospf.LSAs = append(ospf.LSAs, lsa)
+		}
+		output.OSPF = &ospf
+	}
+
+	if output.STP != nil {
+		stp := *output.STP
+		stp.SourceMAC = a.mac(stp.SourceMAC)
+		stp.BridgeID = a.bridgeID(stp.BridgeID)
+		stp.RootID = a.bridgeID(stp.RootID)
+		stp.PreviousRootID = a.bridgeID(stp.PreviousRootID)
+		output.STP = &stp
+	}
+
+	if output.Multicast != nil {
+		multicast := *output.Multicast
+		multicast.Group = a.ip(multicast.Group)
+		multicast.Host = a.ip(multicast.Host)
+		multicast.SourceIP = a.ip(multicast.SourceIP)
+		multicast.Sources = make([]string, 0, len(output.Multicast.Sources))
+		for _, source := range output.Multicast.Sources {
+			multicast.Sources = append(multicast.Sources, a.ip(source))
+		}
+		multicast.ExcludedSources = make([]string, 0, len(output.Multicast.ExcludedSources))
+		for _, source := range output.Multicast.ExcludedSources {
+			multicast.ExcludedSources = append(multicast.ExcludedSources, a.ip(source))
+		}
+		output.Multicast = &multicast
+	}
+
+	if output.Duplicates != nil {
+		duplicates := *output.Duplicates
+		duplicates.TopFlows = make([]DuplicateFlow, 0, len(output.Duplicates.TopFlows))
+		for _, flow := range output.Duplicates.TopFlows {
+			flow.SourceIP = a.ip(flow.SourceIP)
+			flow.DestinationIP = a.ip(flow.DestinationIP)
+			duplicates.TopFlows = append(duplicates.TopFlows, flow)
+		}
+		output.Duplicates = &duplicates
+	}
+
+	return output
+}
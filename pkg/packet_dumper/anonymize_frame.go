@@ -0,0 +1,202 @@
+package packet_dumper
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"hash/crc32"
+)
+
+// frameLayers are the layers a dumped frame keeps when anonymized, being the ones whose addresses we know how to
+// replace and that carry nothing else identifying; the frame is cut off at the first layer that isn't one of them (so
+// payloads, DHCP, DNS, NDP and the like never make it into the file)
+var frameLayers = map[gopacket.LayerType]bool{
+	layers.LayerTypeRadioTap:                    true,
+	layers.LayerTypeDot11:                       true,
+	layers.LayerTypeDot11Data:                   true,
+	layers.LayerTypeDot11DataCFAck:              true,
+	layers.LayerTypeDot11DataCFPoll:             true,
+	layers.LayerTypeDot11DataCFAckPoll:          true,
+	layers.LayerTypeDot11DataNull:               true,
+	layers.LayerTypeDot11DataCFAckNoData:        true,
+	layers.LayerTypeDot11DataCFPollNoData:       true,
+	layers.LayerTypeDot11DataCFAckPollNoData:    true,
+	layers.LayerTypeDot11DataQOSData:            true,
+	layers.LayerTypeDot11DataQOSDataCFAck:       true,
+	layers.LayerTypeDot11DataQOSDataCFPoll:      true,
+	layers.LayerTypeDot11DataQOSDataCFAckPoll:   true,
+	layers.LayerTypeDot11DataQOSNull:            true,
+	layers.LayerTypeDot11DataQOSCFPollNoData:    true,
+	layers.LayerTypeDot11DataQOSCFAckPollNoData: true,
+	layers.LayerTypeEthernet:                    true,
+	layers.LayerTypeLinuxSLL:                    true,
+	layers.LayerTypeLoopback:                    true,
+	layers.LayerTypeDot1Q:                       true,
+	layers.LayerTypeLLC:                         true,
+	layers.LayerTypeSNAP:                        true,
+	layers.LayerTypeMPLS:                        true,
+	layers.LayerTypeARP:                         true,
+	layers.LayerTypeIPv4:                        true,
+	layers.LayerTypeIPv6:                        true,
+	layers.LayerTypeIPv6HopByHop:                true,
+	layers.LayerTypeIPv6Destination:             true,
+	layers.LayerTypeGRE:                         true,
+	layers.LayerTypeICMPv4:                      true,
+	layers.LayerTypeICMPv6:                      true,
+	layers.LayerTypeICMPv6Echo:                  true,
+	layers.LayerTypeTCP:                         true,
+	layers.LayerTypeUDP:                         true,
+	layers.LayerTypeSCTP:                        true,
+	layers.LayerTypeVXLAN:                       true,
+	layers.LayerTypeGeneve:                      true,
+	layers.LayerTypeGTPv1U:                      true,
+}
+
+// adjustChecksum updates a ones' complement checksum for some of what it covers changing from previous to current
+// (RFC 1624), so it stays right for the whole packet even when only the headers were captured
+func adjustChecksum(checksum []byte, previous []byte, current []byte) {
+	sum := uint32(^binary.BigEndian.Uint16(checksum))
+
+	for i := 0; i+1 < len(previous); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(previous[i:]))
+		sum += uint32(binary.BigEndian.Uint16(current[i:]))
+	}
+
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+
+	binary.BigEndian.PutUint16(checksum, ^uint16(sum))
+}
+
+func (a *anonymizer) replaceMAC(data []byte) {
+	copy(data, a.anonymizeMAC(data))
+}
+
+func (a *anonymizer) replaceIP(data []byte) {
+	copy(data, a.anonymizeIP(data))
+}
+
+// anonymizeFrame returns a copy of the frame with its link and network addresses anonymized (and the checksums that
+// cover them fixed up), cut off at the first layer that can't be anonymized
+func (a *anonymizer) anonymizeFrame(linkType layers.LinkType, f frame) frame {
+	data := make([]byte, len(f.data))
+	copy(data, f.data)
+
+	packet := gopacket.NewPacket(f.data, linkType, gopacket.Default)
+
+	offset := 0
+	end := len(data)
+
+	// where the 802.11 frame covered by the FCS starts (if there is an FCS)
+	fcsStart := -1
+	radioTapFlags := layers.RadioTapFlags(0)
+
+	// the addresses in the last network header, before and after, for the transport checksum's pseudo header
+	var previous, current []byte
+
+	for _, layer := range packet.Layers() {
+		length := len(layer.LayerContents())
+
+		if !frameLayers[layer.LayerType()] || offset+length > len(data) {
+			end = offset
+			break
+		}
+
+		contents := data[offset : offset+length]
+
+		switch l := layer.(type) {
+		case *layers.RadioTap:
+			radioTapFlags = l.Flags
+
+		case *layers.Dot11:
+			a.replaceMAC(contents[4:10])
+			if len(l.Address2) > 0 {
+				a.replaceMAC(contents[10:16])
+			}
+			if len(l.Address3) > 0 {
+				a.replaceMAC(contents[16:22])
+			}
+			if len(l.Address4) > 0 {
+				a.replaceMAC(contents[24:30])
+			}
+
+			if radioTapFlags.FCS() {
+				fcsStart = offset
+			}
+
+		case *layers.Ethernet:
+			a.replaceMAC(contents[0:6])
+			a.replaceMAC(contents[6:12])
+
+		case *layers.LinuxSLL:
+			if l.AddrLen == 6 {
+				a.replaceMAC(contents[6:12])
+			}
+
+		case *layers.ARP:
+			hardware, protocol := int(l.HwAddressSize), int(l.ProtAddressSize)
+
+			if hardware == 6 && (protocol == 4 || protocol == 16) {
+				a.replaceMAC(contents[8 : 8+hardware])
+				a.replaceIP(contents[8+hardware : 8+hardware+protocol])
+				a.replaceMAC(contents[8+hardware+protocol : 8+2*hardware+protocol])
+				a.replaceIP(contents[8+2*hardware+protocol : 8+2*hardware+2*protocol])
+			}
+
+		case *layers.IPv4:
+			previous = append([]byte{}, contents[12:20]...)
+			a.replaceIP(contents[12:16])
+			a.replaceIP(contents[16:20])
+			current = contents[12:20]
+
+			adjustChecksum(contents[10:12], previous, current)
+
+		case *layers.IPv6:
+			previous = append([]byte{}, contents[8:40]...)
+			a.replaceIP(contents[8:24])
+			a.replaceIP(contents[24:40])
+			current = contents[8:40]
+
+		case *layers.TCP:
+			if previous != nil {
+				adjustChecksum(contents[16:18], previous, current)
+			}
+			previous = nil
+
+		case *layers.UDP:
+			// no checksum (IPv4 only) stays that way, and a computed zero is sent as all ones
+			if previous != nil && l.Checksum != 0 {
+				adjustChecksum(contents[6:8], previous, current)
+				if binary.BigEndian.Uint16(contents[6:8]) == 0 {
+					binary.BigEndian.PutUint16(contents[6:8], 0xffff)
+				}
+			}
+			previous = nil
+
+		case *layers.ICMPv6:
+			if previous != nil {
+				adjustChecksum(contents[2:4], previous, current)
+			}
+			previous = nil
+		}
+
+		offset += length
+
+		// the padding some drivers put after the 802.11 header (which gopacket takes out) throws the offsets off, so
+		// those frames stop there
+		if layer.LayerType() == layers.LayerTypeDot11 && radioTapFlags.Datapad() {
+			end = offset
+			break
+		}
+	}
+
+	if fcsStart != -1 && end == len(data) && len(data)-fcsStart >= 4 {
+		binary.LittleEndian.PutUint32(data[len(data)-4:], crc32.ChecksumIEEE(data[fcsStart:len(data)-4]))
+	}
+
+	captureInfo := f.captureInfo
+	captureInfo.CaptureLength = end
+
+	return frame{captureInfo, data[:end]}
+}
@@ -0,0 +1,187 @@
+package packet_dumper
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// the key and addresses from the sample trace that comes with the Crypto-PAn reference implementation
+const cryptoPAnReferenceKey = "1522178d33a4cf80130a5b1649907d10d8988f837979652762574c2d2a842202"
+
+func newTestAnonymizer(t *testing.T, config AnonymizeConfig) *anonymizer {
+	t.Helper()
+
+	a, err := newAnonymizer(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func commonPrefixLength(a, b net.IP) int {
+	for i := range a {
+		for bit := 0; bit < 8; bit++ {
+			mask := byte(0x80 >> uint(bit))
+			if a[i]&mask != b[i]&mask {
+				return i*8 + bit
+			}
+		}
+	}
+
+	return len(a) * 8
+}
+
+func TestAnonymizeIPReferenceVectors(t *testing.T) {
+	keyFile, err := ioutil.TempFile("", "anonymize_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = os.Remove(keyFile.Name())
+	}()
+
+	_, err = keyFile.WriteString(cryptoPAnReferenceKey + "\n")
+	_ = keyFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestAnonymizer(t, AnonymizeConfig{KeyPath: keyFile.Name()})
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"128.11.68.132", "135.242.180.132"},
+		{"129.118.74.4", "134.136.186.123"},
+		{"130.132.252.244", "133.68.164.234"},
+		{"141.223.7.43", "141.167.8.160"},
+		{"141.233.145.108", "141.129.237.235"},
+		{"156.29.3.236", "147.225.12.42"},
+		{"192.102.249.13", "252.138.62.131"},
+		{"192.215.32.125", "252.43.47.189"},
+		{"192.233.80.103", "252.25.108.8"},
+	}
+
+	for _, test := range tests {
+		got := a.ip(test.ip)
+		if got != test.want {
+			t.Errorf("got %v for %v, want %v", got, test.ip, test.want)
+		}
+	}
+}
+
+func TestAnonymizeIPSameKeySameMapping(t *testing.T) {
+	a := newTestAnonymizer(t, AnonymizeConfig{Key: "some passphrase"})
+	b := newTestAnonymizer(t, AnonymizeConfig{Key: "some passphrase"})
+	c := newTestAnonymizer(t, AnonymizeConfig{Key: "another passphrase"})
+
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		if a.ip(ip) != b.ip(ip) {
+			t.Errorf("got %v and %v for %v with the same key, want the same", a.ip(ip), b.ip(ip), ip)
+		}
+
+		if a.ip(ip) == c.ip(ip) {
+			t.Errorf("got %v for %v with different keys, want different", a.ip(ip), ip)
+		}
+
+		if a.ip(ip) == ip {
+			t.Errorf("got %v left as is, want it anonymized", ip)
+		}
+	}
+}
+
+func TestAnonymizeIPPrefixPreserving(t *testing.T) {
+	a := newTestAnonymizer(t, AnonymizeConfig{Key: cryptoPAnReferenceKey})
+
+	tests := []struct {
+		a, b string
+	}{
+		{"10.1.2.3", "10.1.2.200"},
+		{"10.1.2.3", "10.1.3.3"},
+		{"10.1.2.3", "10.129.2.3"},
+		{"10.1.2.3", "138.1.2.3"},
+		{"2001:db8:1::1", "2001:db8:1::2"},
+		{"2001:db8:1::1", "2001:db8:8000::1"},
+	}
+
+	for _, test := range tests {
+		ipA, ipB := net.ParseIP(test.a), net.ParseIP(test.b)
+		if ipA.To4() != nil {
+			ipA, ipB = ipA.To4(), ipB.To4()
+		}
+
+		want := commonPrefixLength(ipA, ipB)
+
+		anonymizedA, anonymizedB := a.anonymizeIP(ipA), a.anonymizeIP(ipB)
+
+		got := commonPrefixLength(anonymizedA, anonymizedB)
+		if got != want {
+			t.Errorf("got %v / %v sharing %v bits for %v / %v, want %v", anonymizedA, anonymizedB, got, test.a, test.b, want)
+		}
+	}
+}
+
+func TestAnonymizeMAC(t *testing.T) {
+	mac := "00:1b:63:84:45:e6"
+
+	a := newTestAnonymizer(t, AnonymizeConfig{Key: cryptoPAnReferenceKey})
+
+	got, _ := net.ParseMAC(a.mac(mac))
+	if got.String() == mac || got[0]&0x02 == 0 || got[0]&0x01 != 0 {
+		t.Errorf("got %v for %v, want a different locally administered unicast MAC", got, mac)
+	}
+
+	if a.mac(mac) != newTestAnonymizer(t, AnonymizeConfig{Key: cryptoPAnReferenceKey}).mac(mac) {
+		t.Errorf("got a different mapping for %v with the same key, want the same", mac)
+	}
+
+	keepOUI := newTestAnonymizer(t, AnonymizeConfig{Key: cryptoPAnReferenceKey, KeepOUI: true})
+
+	got, _ = net.ParseMAC(keepOUI.mac(mac))
+	if got.String()[:8] != mac[:8] || got.String() == mac {
+		t.Errorf("got %v for %v, want a different MAC with the same OUI", got, mac)
+	}
+
+	for _, group := range []string{"ff:ff:ff:ff:ff:ff", "01:00:5e:00:00:fb", "33:33:00:00:00:01"} {
+		if a.mac(group) != group {
+			t.Errorf("got %v for %v, want the group MAC left as is", a.mac(group), group)
+		}
+	}
+}
+
+func TestAnonymizeAllow(t *testing.T) {
+	a := newTestAnonymizer(t, AnonymizeConfig{
+		Key:   cryptoPAnReferenceKey,
+		Allow: []string{"192.0.2.1", "198.51.100.0/24", "2001:db8::/32", "00:1b:63:84:45:e6"},
+	})
+
+	for _, address := range []string{"192.0.2.1", "198.51.100.7", "2001:db8::1", "224.0.0.251", "127.0.0.1", "0.0.0.0", "255.255.255.255"} {
+		if a.ip(address) != address {
+			t.Errorf("got %v for %v, want it left as is", a.ip(address), address)
+		}
+	}
+
+	for _, address := range []string{"192.0.2.2", "198.51.101.7", "2001:db9::1"} {
+		if a.ip(address) == address {
+			t.Errorf("got %v left as is, want it anonymized", address)
+		}
+	}
+
+	if a.mac("00:1b:63:84:45:e6") != "00:1b:63:84:45:e6" {
+		t.Errorf("got %v for an allowed MAC, want it left as is", a.mac("00:1b:63:84:45:e6"))
+	}
+
+	if a.mac("00:1b:63:84:45:e7") == "00:1b:63:84:45:e7" {
+		t.Errorf("got 00:1b:63:84:45:e7 left as is, want it anonymized")
+	}
+
+	_, err := newAnonymizer(&AnonymizeConfig{Key: cryptoPAnReferenceKey, Allow: []string{"not an address"}})
+	if err == nil {
+		t.Errorf("got no error for an invalid allow entry, want one")
+	}
+}
@@ -0,0 +1,474 @@
+package packet_dumper
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	applicationProtocolTLS  = "tls"
+	applicationProtocolHTTP = "http"
+	applicationProtocolQUIC = "quic"
+
+	// flows not seen for this long are forgotten
+	applicationFlowTimeout = time.Minute * 2
+
+	// a flow that hasn't been identified after this many packets with a payload is given up on
+	maxIdentifyAttempts = 8
+
+	// ClientHellos longer than this (they're normally a few KB at most) are given up on
+	maxHelloLength = 65536
+
+	tlsRecordHandshake   = 0x16
+	tlsClientHello       = 0x01
+	tlsExtensionSNI      = 0
+	tlsExtensionALPN     = 16
+	tlsServerNameTypeDNS = 0
+)
+
+var httpMethods = []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS", "PATCH", "CONNECT", "TRACE"}
+
+// ApplicationMapping names the application for server names (TLS / QUIC SNI or HTTP Host) matching any of its
+// patterns (shell style, e.g. "*.zoom.us")
+type ApplicationMapping struct {
+	Name     string   `json:"name"`
+	Patterns []string `json:"patterns"`
+}
+
+// Application is what a flow was identified as; the name is from the first matching application mapping, otherwise
+// it's the server name
+type Application struct {
+	Name       string   `json:"name,omitempty"`
+	Protocol   string   `json:"protocol"`
+	ServerName string   `json:"server_name,omitempty"`
+	ALPN       []string `json:"alpn,omitempty"`
+	HTTPMethod string   `json:"http_method,omitempty"`
+}
+
+// fieldReader reads the length-prefixed fields of TLS / QUIC messages, going bad (and staying bad) on running short
+type fieldReader struct {
+	data []byte
+	bad  bool
+}
+
+func (r *fieldReader) read(n int) []byte {
+	if r.bad || n < 0 || n > len(r.data) {
+		r.bad = true
+		return nil
+	}
+
+	field := r.data[:n]
+	r.data = r.data[n:]
+
+	return field
+}
+
+func (r *fieldReader) uint(n int) int {
+	value := 0
+
+	for _, b := range r.read(n) {
+		value = value<<8 | int(b)
+	}
+
+	return value
+}
+
+func (r *fieldReader) vector(lengthBytes int) []byte {
+	return r.read(r.uint(lengthBytes))
+}
+
+// varint is a QUIC variable length integer (the top two bits of the first byte being its length)
+func (r *fieldReader) varint() uint64 {
+	first := r.read(1)
+	if r.bad {
+		return 0
+	}
+
+	length := 1 << (first[0] >> 6)
+	value := uint64(first[0] & 0x3f)
+
+	for _, b := range r.read(length - 1) {
+		value = value<<8 | uint64(b)
+	}
+
+	return value
+}
+
+// parseClientHello gets the server name and ALPN protocols from a ClientHello handshake message
+func parseClientHello(handshake []byte) (string, []string, bool) {
+	r := &fieldReader{data: handshake}
+
+	if r.uint(1) != tlsClientHello {
+		return "", nil, false
+	}
+
+	r = &fieldReader{data: r.vector(3)}
+
+	r.read(2 + 32) // version, random
+	r.vector(1)    // session ID
+	r.vector(2)    // cipher suites
+	r.vector(1)    // compression methods
+
+	// no extensions at all is allowed
+	if len(r.data) == 0 {
+		return "", nil, !r.bad
+	}
+
+	extensions := &fieldReader{data: r.vector(2)}
+	if r.bad {
+		return "", nil, false
+	}
+
+	serverName := ""
+	alpn := make([]string, 0)
+
+	for len(extensions.data) > 0 && !extensions.bad {
+		extensionType := extensions.uint(2)
+		extension := &fieldReader{data: extensions.vector(2)}
+
+		switch extensionType {
+		case tlsExtensionSNI:
+			names := &fieldReader{data: extension.vector(2)}
+			for len(names.data) > 0 && !names.bad {
+				nameType := names.uint(1)
+				name := names.vector(2)
+				if nameType == tlsServerNameTypeDNS && serverName == "" {
+					serverName = string(name)
+				}
+			}
+
+		case tlsExtensionALPN:
+			protocols := &fieldReader{data: extension.vector(2)}
+			for len(protocols.data) > 0 && !protocols.bad {
+				protocol := protocols.vector(1)
+				if !protocols.bad {
+					alpn = append(alpn, string(protocol))
+				}
+			}
+		}
+	}
+
+	return serverName, alpn, !extensions.bad
+}
+
+// handshakeMessage is the first handshake message in the stream, if all of it is there yet
+func handshakeMessage(stream []byte) ([]byte, bool) {
+	if len(stream) < 4 {
+		return nil, false
+	}
+
+	length := 4 + (int(stream[1])<<16 | int(stream[2])<<8 | int(stream[3]))
+	if len(stream) < length {
+		return nil, false
+	}
+
+	return stream[:length], true
+}
+
+// tlsHandshake takes the handshake bytes out of however much of the TLS records in the stream are there so far;
+// anything that isn't a handshake record is invalid
+func tlsHandshake(stream []byte) ([]byte, bool) {
+	handshake := make([]byte, 0, len(stream))
+
+	for len(stream) >= 5 {
+		if stream[0] != tlsRecordHandshake || stream[1] != 0x03 {
+			return nil, false
+		}
+
+		length := int(stream[3])<<8 | int(stream[4])
+
+		end := 5 + length
+		if end > len(stream) {
+			end = len(stream)
+		}
+
+		handshake = append(handshake, stream[5:end]...)
+		stream = stream[end:]
+	}
+
+	return handshake, true
+}
+
+// httpRequest gets the method and host (without any port) from the start of an HTTP/1.x request
+func httpRequest(payload []byte) (string, string, bool) {
+	method := ""
+
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(payload, []byte(m+" ")) {
+			method = m
+			break
+		}
+	}
+
+	if method == "" {
+		return "", "", false
+	}
+
+	lines := strings.Split(string(payload), "\r\n")
+	if !strings.Contains(lines[0], " HTTP/1.") {
+		return "", "", false
+	}
+
+	host := ""
+
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+
+		if len(line) > 5 && strings.EqualFold(line[:5], "host:") {
+			host = strings.TrimSpace(line[5:])
+			break
+		}
+	}
+
+	hostWithoutPort, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = hostWithoutPort
+	}
+
+	return method, host, true
+}
+
+type applicationFlow struct {
+	application *Application
+	lastSeen    time.Time
+	attempts    int
+	done        bool
+
+	// the ClientHello so far, from whichever side sent its start
+	client  string
+	stream  []byte
+	nextSeq uint32
+	crypto  map[uint64][]byte
+}
+
+// applicationIdentifier follows TCP and UDP flows until it can tell what they are from a TLS ClientHello, the start of
+// an HTTP/1.x request or a QUIC Initial packet, and labels every packet of the flow from then on
+type applicationIdentifier struct {
+	mappings  []ApplicationMapping
+	flows     map[string]*applicationFlow
+	lastSweep time.Time
+}
+
+func newApplicationIdentifier(mappings []ApplicationMapping) (*applicationIdentifier, error) {
+	for _, mapping := range mappings {
+		if mapping.Name == "" {
+			return nil, fmt.Errorf("application mapping with no name")
+		}
+
+		for _, pattern := range mapping.Patterns {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %#+v for application %#+v: %v", pattern, mapping.Name, err)
+			}
+		}
+	}
+
+	return &applicationIdentifier{
+		mappings: mappings,
+		flows:    make(map[string]*applicationFlow),
+	}, nil
+}
+
+func (i *applicationIdentifier) newApplication(protocol string, serverName string) *Application {
+	application := Application{
+		Name:       serverName,
+		Protocol:   protocol,
+		ServerName: serverName,
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+
+	for _, mapping := range i.mappings {
+		for _, pattern := range mapping.Patterns {
+			matched, _ := path.Match(strings.ToLower(pattern), name)
+			if matched {
+				application.Name = mapping.Name
+				return &application
+			}
+		}
+	}
+
+	return &application
+}
+
+func (i *applicationIdentifier) sweep(timestamp time.Time) {
+	if timestamp.Sub(i.lastSweep) < applicationFlowTimeout {
+		return
+	}
+
+	i.lastSweep = timestamp
+
+	for key, flow := range i.flows {
+		if timestamp.Sub(flow.lastSeen) >= applicationFlowTimeout {
+			delete(i.flows, key)
+		}
+	}
+}
+
+func (i *applicationIdentifier) identifyTCP(flow *applicationFlow, source string, tcp *layers.TCP) {
+	payload := tcp.Payload
+
+	if flow.stream != nil {
+		// only carrying on with the same side, in order (retransmissions and the like are just skipped)
+		if source != flow.client || tcp.Seq != flow.nextSeq {
+			return
+		}
+
+		flow.stream = append(flow.stream, payload...)
+	} else if len(payload) >= 3 && payload[0] == tlsRecordHandshake && payload[1] == 0x03 {
+		flow.client = source
+		flow.stream = append([]byte{}, payload...)
+	} else {
+		method, host, ok := httpRequest(payload)
+		if ok {
+			flow.application = i.newApplication(applicationProtocolHTTP, host)
+			flow.application.HTTPMethod = method
+		}
+
+		return
+	}
+
+	flow.nextSeq = tcp.Seq + uint32(len(payload))
+
+	handshake, valid := tlsHandshake(flow.stream)
+	if !valid || len(flow.stream) > maxHelloLength {
+		flow.done = true
+		flow.stream = nil
+		return
+	}
+
+	message, complete := handshakeMessage(handshake)
+	if !complete {
+		return
+	}
+
+	flow.stream = nil
+
+	serverName, alpn, ok := parseClientHello(message)
+	if !ok {
+		flow.done = true
+		return
+	}
+
+	flow.application = i.newApplication(applicationProtocolTLS, serverName)
+	flow.application.ALPN = alpn
+}
+
+func (i *applicationIdentifier) identifyQUIC(flow *applicationFlow, source string, udp *layers.UDP) {
+	frames, ok := decryptQUICInitial(udp.Payload)
+	if !ok {
+		return
+	}
+
+	if flow.crypto == nil {
+		flow.client = source
+		flow.crypto = make(map[uint64][]byte)
+	}
+
+	// the server's Initials don't decrypt with the client's keys anyway, but just in case
+	if source != flow.client {
+		return
+	}
+
+	for offset, data := range frames {
+		if offset+uint64(len(data)) > maxHelloLength {
+			flow.done = true
+			flow.crypto = nil
+			return
+		}
+
+		flow.crypto[offset] = data
+	}
+
+	stream := make([]byte, 0)
+	for {
+		data, ok := flow.crypto[uint64(len(stream))]
+		if !ok || len(data) == 0 {
+			break
+		}
+
+		stream = append(stream, data...)
+	}
+
+	message, complete := handshakeMessage(stream)
+	if !complete {
+		return
+	}
+
+	flow.crypto = nil
+
+	serverName, alpn, ok := parseClientHello(message)
+	if !ok {
+		flow.done = true
+		return
+	}
+
+	flow.application = i.newApplication(applicationProtocolQUIC, serverName)
+	flow.application.ALPN = alpn
+}
+
+// identify returns what the packet's flow has been identified as so far (if anything); tcp / udp are the packet's
+// innermost transport layer
+func (i *applicationIdentifier) identify(packetData PacketData, tcp *layers.TCP, udp *layers.UDP) *Application {
+	i.sweep(packetData.Timestamp)
+
+	protocol := ""
+	payloadLength := 0
+
+	switch {
+	case tcp != nil:
+		protocol, payloadLength = "tcp", len(tcp.Payload)
+	case udp != nil:
+		protocol, payloadLength = "udp", len(udp.Payload)
+	default:
+		return nil
+	}
+
+	source := fmt.Sprintf("%v/%v", packetData.SourceIP, packetData.SourcePort)
+	destination := fmt.Sprintf("%v/%v", packetData.DestinationIP, packetData.DestinationPort)
+
+	key := protocol + " " + source + "-" + destination
+	if destination < source {
+		key = protocol + " " + destination + "-" + source
+	}
+
+	flow, ok := i.flows[key]
+	if !ok {
+		// nothing to go on until there's a payload
+		if payloadLength == 0 {
+			return nil
+		}
+
+		flow = &applicationFlow{}
+		i.flows[key] = flow
+	}
+
+	flow.lastSeen = packetData.Timestamp
+
+	if flow.application != nil || flow.done || payloadLength == 0 {
+		return flow.application
+	}
+
+	if tcp != nil {
+		i.identifyTCP(flow, source, tcp)
+	} else {
+		i.identifyQUIC(flow, source, udp)
+	}
+
+	flow.attempts++
+
+	if flow.application == nil && flow.attempts >= maxIdentifyAttempts {
+		flow.done = true
+		flow.stream = nil
+		flow.crypto = nil
+	}
+
+	return flow.application
+}
@@ -0,0 +1,123 @@
+package packet_dumper
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"time"
+)
+
+const (
+	bfdEventNew          = "new"
+	bfdEventStateChanged = "state_changed"
+
+	// multihop BFD (RFC 5883), which gopacket doesn't decode by port
+	bfdMultihopPort = 4784
+)
+
+var bfdStates = map[layers.BFDState]string{
+	layers.BFDStateAdminDown: "admin_down",
+	layers.BFDStateDown:      "down",
+	layers.BFDStateInit:      "init",
+	layers.BFDStateUp:        "up",
+}
+
+type BFD struct {
+	Event             string    `json:"event"`
+	SourceIP          string    `json:"source_ip"`
+	DestinationIP     string    `json:"destination_ip"`
+	MyDiscriminator   uint32    `json:"my_discriminator"`
+	YourDiscriminator uint32    `json:"your_discriminator"`
+	State             string    `json:"state"`
+	PreviousState     string    `json:"previous_state,omitempty"`
+	Diagnostic        string    `json:"diagnostic"`
+	LastSeen          time.Time `json:"last_seen"`
+}
+
+// bfdTracker follows the state each BFD speaker advertises (per source / destination IP and discriminator) and calls
+// back when a session is first seen and whenever its state changes
+type bfdTracker struct {
+	states map[string]layers.BFDState
+}
+
+func newBFDTracker() *bfdTracker {
+	return &bfdTracker{
+		states: make(map[string]layers.BFDState),
+	}
+}
+
+func bfdStateName(state layers.BFDState) string {
+	name, ok := bfdStates[state]
+	if !ok {
+		return fmt.Sprintf("state%v", uint8(state))
+	}
+
+	return name
+}
+
+func getBFD(packet gopacket.Packet) *layers.BFD {
+	bfdLayer := packet.Layer(layers.LayerTypeBFD)
+	if bfdLayer != nil {
+		return bfdLayer.(*layers.BFD)
+	}
+
+	udpLayer := innermostLayer(packet, layers.LayerTypeUDP)
+	if udpLayer == nil {
+		return nil
+	}
+
+	udp := udpLayer.(*layers.UDP)
+	if udp.DstPort != bfdMultihopPort {
+		return nil
+	}
+
+	bfd := &layers.BFD{}
+
+	err := bfd.DecodeFromBytes(udp.Payload, gopacket.NilDecodeFeedback)
+	if err != nil {
+		return nil
+	}
+
+	return bfd
+}
+
+func (b *bfdTracker) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	bfd := getBFD(packet)
+	if bfd == nil {
+		return nil
+	}
+
+	key := fmt.Sprintf("%v/%v/%v", packetData.SourceIP, packetData.DestinationIP, bfd.MyDiscriminator)
+
+	record := BFD{
+		Event:             bfdEventNew,
+		SourceIP:          packetData.SourceIP,
+		DestinationIP:     packetData.DestinationIP,
+		MyDiscriminator:   uint32(bfd.MyDiscriminator),
+		YourDiscriminator: uint32(bfd.YourDiscriminator),
+		State:             bfdStateName(bfd.State),
+		Diagnostic:        bfd.Diagnostic.String(),
+		LastSeen:          packetData.Timestamp,
+	}
+
+	previousState, ok := b.states[key]
+	if ok {
+		if previousState == bfd.State {
+			return nil
+		}
+
+		record.Event = bfdEventStateChanged
+		record.PreviousState = bfdStateName(previousState)
+	}
+
+	b.states[key] = bfd.State
+
+	return callback(Output{
+		Timestamp: time.Now(),
+		BFD:       &record,
+	})
+}
+
+func (b *bfdTracker) flush(callback func(output Output) error) error {
+	return nil
+}
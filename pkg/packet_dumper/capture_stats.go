@@ -0,0 +1,104 @@
+package packet_dumper
+
+import (
+	"github.com/google/gopacket/pcap"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultCaptureStatsInterval = time.Second * 10
+
+// LinkStats are the interface's own counters (from /sys/class/net, so Linux only)
+type LinkStats struct {
+	RXBytes   uint64 `json:"rx_bytes"`
+	RXPackets uint64 `json:"rx_packets"`
+	RXErrors  uint64 `json:"rx_errors"`
+	RXDropped uint64 `json:"rx_dropped"`
+	TXBytes   uint64 `json:"tx_bytes"`
+	TXPackets uint64 `json:"tx_packets"`
+	TXErrors  uint64 `json:"tx_errors"`
+	TXDropped uint64 `json:"tx_dropped"`
+}
+
+// CaptureStats are counters since the capture started; received / dropped are libpcap's (dropped by kernel being the
+// capture not keeping up, dropped by interface the driver / NIC), queue drops are records dropped because the output
+// couldn't keep up and link is the interface's own counters for telling capture loss apart from link loss
+type CaptureStats struct {
+	Received           uint64     `json:"received"`
+	DroppedByKernel    uint64     `json:"dropped_by_kernel"`
+	DroppedByInterface uint64     `json:"dropped_by_interface"`
+	Decoded            uint64     `json:"decoded"`
+	DecodeErrors       uint64     `json:"decode_errors"`
+	CallbackErrors     uint64     `json:"callback_errors"`
+	QueueDrops         uint64     `json:"queue_drops"`
+	Link               *LinkStats `json:"link,omitempty"`
+}
+
+// captureCounters are our own counters for a capture, updated from both the capture and output goroutines
+type captureCounters struct {
+	decoded        uint64
+	decodeErrors   uint64
+	callbackErrors uint64
+	queueDrops     uint64
+}
+
+func readSysfsCounter(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func getLinkStats(interfaceName string) (*LinkStats, error) {
+	linkStats := LinkStats{}
+
+	counters := map[string]*uint64{
+		"rx_bytes":   &linkStats.RXBytes,
+		"rx_packets": &linkStats.RXPackets,
+		"rx_errors":  &linkStats.RXErrors,
+		"rx_dropped": &linkStats.RXDropped,
+		"tx_bytes":   &linkStats.TXBytes,
+		"tx_packets": &linkStats.TXPackets,
+		"tx_errors":  &linkStats.TXErrors,
+		"tx_dropped": &linkStats.TXDropped,
+	}
+
+	for name, counter := range counters {
+		value, err := readSysfsCounter(filepath.Join("/sys/class/net", interfaceName, "statistics", name))
+		if err != nil {
+			return nil, err
+		}
+
+		*counter = value
+	}
+
+	return &linkStats, nil
+}
+
+func getCaptureStats(interfaceName string, handle *pcap.Handle, counters *captureCounters) (*CaptureStats, error) {
+	pcapStats, err := handle.Stats()
+	if err != nil {
+		return nil, err
+	}
+
+	captureStats := CaptureStats{
+		Received:           uint64(pcapStats.PacketsReceived),
+		DroppedByKernel:    uint64(pcapStats.PacketsDropped),
+		DroppedByInterface: uint64(pcapStats.PacketsIfDropped),
+		Decoded:            atomic.LoadUint64(&counters.decoded),
+		DecodeErrors:       atomic.LoadUint64(&counters.decodeErrors),
+		CallbackErrors:     atomic.LoadUint64(&counters.callbackErrors),
+		QueueDrops:         atomic.LoadUint64(&counters.queueDrops),
+	}
+
+	// not there for every interface (or OS) so just left out
+	captureStats.Link, _ = getLinkStats(interfaceName)
+
+	return &captureStats, nil
+}
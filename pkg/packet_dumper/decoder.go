@@ -0,0 +1,671 @@
+package packet_dumper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// guessIPLayerType picks IPv4 or IPv6 from the version nibble for things that don't say what they carry (MPLS, GTP-U,
+// raw IP link types)
+func guessIPLayerType(data []byte) gopacket.LayerType {
+	if len(data) == 0 {
+		return gopacket.LayerTypeZero
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		return layers.LayerTypeIPv4
+	case 6:
+		return layers.LayerTypeIPv6
+	}
+
+	return gopacket.LayerTypePayload
+}
+
+// mplsLayer is layers.MPLS as a DecodingLayer (which gopacket doesn't provide)
+type mplsLayer struct {
+	layers.MPLS
+}
+
+func (m *mplsLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return errors.New("MPLS label stack entry too short")
+	}
+
+	entry := binary.BigEndian.Uint32(data[:4])
+
+	m.Label = entry >> 12
+	m.TrafficClass = uint8(entry>>9) & 0x7
+	m.StackBottom = entry&0x100 != 0
+	m.TTL = uint8(entry)
+	m.BaseLayer = layers.BaseLayer{Contents: data[:4], Payload: data[4:]}
+
+	return nil
+}
+
+func (m *mplsLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeMPLS
+}
+
+func (m *mplsLayer) NextLayerType() gopacket.LayerType {
+	if !m.StackBottom {
+		return layers.LayerTypeMPLS
+	}
+
+	return guessIPLayerType(m.Payload)
+}
+
+// vxlanLayer is layers.VXLAN as a DecodingLayer (which gopacket doesn't provide)
+type vxlanLayer struct {
+	layers.VXLAN
+}
+
+func (v *vxlanLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 8 {
+		df.SetTruncated()
+		return errors.New("VXLAN header too short")
+	}
+
+	v.ValidIDFlag = data[0]&0x08 != 0
+	v.GBPExtension = data[0]&0x80 != 0
+	v.GBPDontLearn = data[1]&0x40 != 0
+	v.GBPApplied = data[1]&0x08 != 0
+	v.GBPGroupPolicyID = binary.BigEndian.Uint16(data[2:4])
+	v.VNI = binary.BigEndian.Uint32(data[4:8]) >> 8
+	v.BaseLayer = layers.BaseLayer{Contents: data[:8], Payload: data[8:]}
+
+	return nil
+}
+
+func (v *vxlanLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeVXLAN
+}
+
+func (v *vxlanLayer) NextLayerType() gopacket.LayerType {
+	return layers.LayerTypeEthernet
+}
+
+// geneveLayer is layers.Geneve with the CanDecode it's missing
+type geneveLayer struct {
+	layers.Geneve
+}
+
+func (g *geneveLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeGeneve
+}
+
+// gtpLayer is layers.GTPv1U without the panic on an empty payload, and only looking for IP in T-PDUs
+type gtpLayer struct {
+	layers.GTPv1U
+}
+
+func (g *gtpLayer) NextLayerType() gopacket.LayerType {
+	if g.MessageType != 255 {
+		return gopacket.LayerTypeZero
+	}
+
+	return guessIPLayerType(g.Payload)
+}
+
+// igmpLayer picks between layers.IGMPv1or2 and layers.IGMP the same way gopacket's decodeIGMP does; other IGMP types
+// (e.g. multicast router discovery, DVMRP) are valid traffic we just don't decode, so they're left as payload
+type igmpLayer struct {
+	v1or2   layers.IGMPv1or2
+	v3      layers.IGMP
+	version uint8
+	igmp    gopacket.DecodingLayer
+	payload []byte
+}
+
+func (i *igmpLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 1 {
+		df.SetTruncated()
+		return errors.New("IGMP message too short")
+	}
+
+	i.version = 0
+	i.payload = nil
+
+	switch layers.IGMPType(data[0]) {
+	case layers.IGMPMembershipQuery:
+		switch {
+		case len(data) >= 12:
+			i.version = 3
+		case len(data) == 8 && data[1] == 0:
+			i.version = 1
+		case len(data) == 8:
+			i.version = 2
+		default:
+			return fmt.Errorf("IGMP membership query of unexpected length %v", len(data))
+		}
+	case layers.IGMPMembershipReportV3:
+		i.version = 3
+	case layers.IGMPMembershipReportV1:
+		i.version = 1
+	case layers.IGMPMembershipReportV2, layers.IGMPLeaveGroup:
+		i.version = 2
+	default:
+		i.payload = data
+
+		return nil
+	}
+
+	if i.version == 3 {
+		i.igmp = &i.v3
+	} else {
+		i.igmp = &i.v1or2
+	}
+
+	err := i.igmp.DecodeFromBytes(data, df)
+	if err != nil {
+		return err
+	}
+
+	i.v3.Version = 3
+	i.v1or2.Version = i.version
+
+	return nil
+}
+
+func (i *igmpLayer) messageType() layers.IGMPType {
+	if i.version == 3 {
+		return i.v3.Type
+	}
+
+	return i.v1or2.Type
+}
+
+func (i *igmpLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeIGMP
+}
+
+func (i *igmpLayer) NextLayerType() gopacket.LayerType {
+	if i.version == 0 {
+		return gopacket.LayerTypePayload
+	}
+
+	return gopacket.LayerTypeZero
+}
+
+func (i *igmpLayer) LayerPayload() []byte {
+	return i.payload
+}
+
+// ospfLayer picks between layers.OSPFv2 and layers.OSPFv3 by the version in the header, leaving any other version as
+// payload
+type ospfLayer struct {
+	v2      layers.OSPFv2
+	v3      layers.OSPFv3
+	version uint8
+	payload []byte
+}
+
+func (o *ospfLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 14 {
+		df.SetTruncated()
+		return errors.New("OSPF header too short")
+	}
+
+	o.version = data[0]
+	o.payload = nil
+
+	switch o.version {
+	case 2:
+		return o.v2.DecodeFromBytes(data, df)
+	case 3:
+		return o.v3.DecodeFromBytes(data, df)
+	}
+
+	o.payload = data
+
+	return nil
+}
+
+func (o *ospfLayer) known() bool {
+	return o.version == 2 || o.version == 3
+}
+
+func (o *ospfLayer) messageType() layers.OSPFType {
+	if o.version == 3 {
+		return o.v3.Type
+	}
+
+	return o.v2.Type
+}
+
+func (o *ospfLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeOSPF
+}
+
+func (o *ospfLayer) NextLayerType() gopacket.LayerType {
+	if !o.known() {
+		return gopacket.LayerTypePayload
+	}
+
+	return gopacket.LayerTypeZero
+}
+
+func (o *ospfLayer) LayerPayload() []byte {
+	return o.payload
+}
+
+// recordingLayer has the decoder pick what it needs out of a layer as soon as it's decoded, as the same layer gets
+// reused for each level of encapsulation (e.g. the IPv4 carrying GRE and then the IPv4 carried in it)
+type recordingLayer struct {
+	gopacket.DecodingLayer
+	decoder *decoder
+	name    string
+	record  func()
+}
+
+func (r *recordingLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	r.decoder.layer = r.name
+
+	err := r.DecodingLayer.DecodeFromBytes(data, df)
+	if err != nil {
+		return err
+	}
+
+	if r.record != nil {
+		r.record()
+	}
+
+	return nil
+}
+
+// decoder decodes packets with a gopacket.DecodingLayerParser (so without allocating layers per packet) into
+// PacketData; anything it doesn't know how to decode is just left undecoded, and any failure (including a panic
+// from a layer) is returned as an error naming the layer that failed
+type decoder struct {
+	linkType       layers.LinkType
+	decodingLayers []gopacket.DecodingLayer
+	parsers        map[gopacket.LayerType]*gopacket.DecodingLayerParser
+	decoded        []gopacket.LayerType
+
+	// per packet
+	packetData PacketData
+	protocol   string
+	levels     []Headers
+	layer      string
+	truncated  bool
+
+	ethernet      layers.Ethernet
+	linuxSLL      layers.LinuxSLL
+	loopback      layers.Loopback
+	radioTap      layers.RadioTap
+	dot11         layers.Dot11
+	dot11Data     layers.Dot11Data
+	dot11QOSData  layers.Dot11DataQOSData
+	llc           layers.LLC
+	snap          layers.SNAP
+	dot1Q         layers.Dot1Q
+	mpls          mplsLayer
+	arp           layers.ARP
+	ipv4          layers.IPv4
+	ipv6          layers.IPv6
+	ipv6Extension layers.IPv6ExtensionSkipper
+	gre           layers.GRE
+	etherIP       layers.EtherIP
+	tcp           layers.TCP
+	udp           layers.UDP
+	sctp          layers.SCTP
+	icmpv4        layers.ICMPv4
+	icmpv6        layers.ICMPv6
+	igmp          igmpLayer
+	ospf          ospfLayer
+	vrrp          layers.VRRPv2
+	gtp           gtpLayer
+	vxlan         vxlanLayer
+	geneve        geneveLayer
+}
+
+func newDecoder(linkType layers.LinkType) *decoder {
+	d := &decoder{
+		linkType: linkType,
+		parsers:  make(map[gopacket.LayerType]*gopacket.DecodingLayerParser),
+		decoded:  make([]gopacket.LayerType, 0),
+	}
+
+	d.decodingLayers = []gopacket.DecodingLayer{
+		d.wrap(&d.ethernet, d.recordEthernet),
+		d.wrap(&d.linuxSLL, d.recordLinuxSLL),
+		d.wrap(&d.loopback, d.recordProtocol("Loopback")),
+		d.wrap(&d.radioTap, nil),
+		d.wrap(&d.dot11, d.recordProtocol("Dot11")),
+		d.wrap(&d.dot11Data, nil),
+		d.wrap(&d.dot11QOSData, nil),
+		d.wrap(&d.llc, d.recordProtocol("LLC")),
+		d.wrap(&d.snap, nil),
+		d.wrap(&d.dot1Q, d.recordDot1Q),
+		d.wrap(&d.mpls, d.recordMPLS),
+		d.wrap(&d.arp, d.recordProtocol("ARP")),
+		d.wrap(&d.ipv4, d.recordIPv4),
+		d.wrap(&d.ipv6, d.recordIPv6),
+		d.wrap(&d.ipv6Extension, nil),
+		d.wrap(&d.gre, d.recordEncapsulation("GRE")),
+		d.wrap(&d.etherIP, d.recordEncapsulation("EtherIP")),
+		d.wrap(&d.tcp, d.recordTCP),
+		d.wrap(&d.udp, d.recordUDP),
+		d.wrap(&d.sctp, d.recordSCTP),
+		d.wrap(&d.icmpv4, d.recordICMPv4),
+		d.wrap(&d.icmpv6, d.recordICMPv6),
+		d.wrap(&d.igmp, d.recordIGMP),
+		d.wrap(&d.ospf, d.recordOSPF),
+		d.wrap(&d.vrrp, d.recordVRRP),
+		d.wrap(&d.gtp, d.recordGTP),
+		d.wrap(&d.vxlan, d.recordVXLAN),
+		d.wrap(&d.geneve, d.recordGeneve),
+	}
+
+	return d
+}
+
+func (d *decoder) wrap(decodingLayer gopacket.DecodingLayer, record func()) gopacket.DecodingLayer {
+	// IPv6ExtensionSkipper is the only one that decodes a class of layer types rather than a single one
+	name := "IPv6Extension"
+
+	layerType, ok := decodingLayer.CanDecode().(gopacket.LayerType)
+	if ok {
+		name = layerType.String()
+	}
+
+	return &recordingLayer{
+		DecodingLayer: decodingLayer,
+		decoder:       d,
+		name:          name,
+		record:        record,
+	}
+}
+
+// firstLayerType is the layer type the packet starts with; gopacket doesn't have layer types for all the link types
+// and the raw IP ones can be either version
+func (d *decoder) firstLayerType(data []byte) gopacket.LayerType {
+	switch d.linkType {
+	case layers.LinkTypeEthernet:
+		return layers.LayerTypeEthernet
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return layers.LayerTypeLoopback
+	case layers.LinkTypeIEEE802_11:
+		return layers.LayerTypeDot11
+	case layers.LinkTypeIEEE80211Radio:
+		return layers.LayerTypeRadioTap
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		return guessIPLayerType(data)
+	}
+
+	return d.linkType.LayerType()
+}
+
+func (d *decoder) parser(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+	parser, ok := d.parsers[first]
+	if ok {
+		return parser
+	}
+
+	parser = gopacket.NewDecodingLayerParser(first, d.decodingLayers...)
+	parser.IgnoreUnsupported = true
+
+	d.parsers[first] = parser
+
+	return parser
+}
+
+func (d *decoder) recordProtocol(protocol string) func() {
+	return func() {
+		if len(d.levels) == 0 {
+			d.protocol = protocol
+		}
+	}
+}
+
+func (d *decoder) recordEncapsulation(encapsulation string) func() {
+	return func() {
+		d.packetData.Encapsulation = append(d.packetData.Encapsulation, encapsulation)
+	}
+}
+
+func (d *decoder) recordEthernet() {
+	d.recordProtocol("Ethernet")()
+
+	// the outermost addresses are the ones actually seen on the wire
+	if d.packetData.SourceMAC == "" && d.packetData.DestinationMAC == "" {
+		d.packetData.SourceMAC = d.ethernet.SrcMAC.String()
+		d.packetData.DestinationMAC = d.ethernet.DstMAC.String()
+	}
+}
+
+func (d *decoder) recordLinuxSLL() {
+	d.recordProtocol("Linux SLL")()
+
+	if d.packetData.SourceMAC == "" {
+		d.packetData.SourceMAC = d.linuxSLL.Addr.String()
+	}
+}
+
+func (d *decoder) recordDot1Q() {
+	d.recordEncapsulation("Dot1Q")()
+
+	d.packetData.VLANIDs = append(d.packetData.VLANIDs, int(d.dot1Q.VLANIdentifier))
+}
+
+func (d *decoder) recordMPLS() {
+	d.recordEncapsulation("MPLS")()
+
+	d.packetData.MPLSLabels = append(d.packetData.MPLSLabels, int(d.mpls.Label))
+}
+
+func (d *decoder) recordGTP() {
+	d.recordEncapsulation("GTPv1U")()
+
+	d.packetData.TEIDs = append(d.packetData.TEIDs, d.gtp.TEID)
+}
+
+func (d *decoder) recordVXLAN() {
+	d.recordEncapsulation("VXLAN")()
+
+	d.packetData.VNIs = append(d.packetData.VNIs, d.vxlan.VNI)
+}
+
+func (d *decoder) recordGeneve() {
+	d.recordEncapsulation("Geneve")()
+
+	d.packetData.VNIs = append(d.packetData.VNIs, d.geneve.VNI)
+}
+
+func (d *decoder) recordNetwork(protocol string, sourceIP net.IP, destinationIP net.IP) {
+	d.levels = append(d.levels, Headers{
+		Protocol:      protocol,
+		SourceIP:      sourceIP.String(),
+		DestinationIP: destinationIP.String(),
+	})
+}
+
+func (d *decoder) recordIPv4() {
+	d.recordNetwork("IPv4", d.ipv4.SrcIP, d.ipv4.DstIP)
+}
+
+func (d *decoder) recordIPv6() {
+	d.recordNetwork("IPv6", d.ipv6.SrcIP, d.ipv6.DstIP)
+}
+
+// recordTransport sets the protocol (and ports, if it has them) carried by the innermost network layer so far
+func (d *decoder) recordTransport(protocol string, sourcePort int, destinationPort int) {
+	if len(d.levels) == 0 {
+		return
+	}
+
+	level := &d.levels[len(d.levels)-1]
+
+	level.Protocol = protocol
+	level.SourcePort = sourcePort
+	level.DestinationPort = destinationPort
+}
+
+func (d *decoder) recordTCP() {
+	d.recordTransport("TCP", int(d.tcp.SrcPort), int(d.tcp.DstPort))
+}
+
+func (d *decoder) recordUDP() {
+	d.recordTransport("UDP", int(d.udp.SrcPort), int(d.udp.DstPort))
+}
+
+func (d *decoder) recordSCTP() {
+	d.recordTransport("SCTP", int(d.sctp.SrcPort), int(d.sctp.DstPort))
+}
+
+func (d *decoder) recordICMP(protocol string, icmpType uint8, icmpCode uint8, messageType string) {
+	d.recordTransport(protocol, 0, 0)
+
+	icmpTypeInt, icmpCodeInt := int(icmpType), int(icmpCode)
+
+	d.packetData.ICMPType = &icmpTypeInt
+	d.packetData.ICMPCode = &icmpCodeInt
+	d.packetData.MessageType = messageType
+}
+
+func (d *decoder) recordICMPv4() {
+	typeCode := d.icmpv4.TypeCode
+
+	d.recordICMP("ICMPv4", typeCode.Type(), typeCode.Code(), typeCode.String())
+}
+
+func (d *decoder) recordICMPv6() {
+	typeCode := d.icmpv6.TypeCode
+
+	d.recordICMP("ICMPv6", typeCode.Type(), typeCode.Code(), typeCode.String())
+}
+
+func (d *decoder) recordIGMP() {
+	if d.igmp.version == 0 {
+		d.recordTransport("IGMP", 0, 0)
+
+		return
+	}
+
+	d.recordTransport(fmt.Sprintf("IGMPv%v", d.igmp.version), 0, 0)
+
+	d.packetData.MessageType = d.igmp.messageType().String()
+}
+
+func (d *decoder) recordOSPF() {
+	if !d.ospf.known() {
+		d.recordTransport("OSPF", 0, 0)
+
+		return
+	}
+
+	d.recordTransport(fmt.Sprintf("OSPFv%v", d.ospf.version), 0, 0)
+
+	d.packetData.MessageType = d.ospf.messageType().String()
+}
+
+func (d *decoder) recordVRRP() {
+	d.recordTransport("VRRPv2", 0, 0)
+
+	d.packetData.MessageType = d.vrrp.Type.String()
+}
+
+func (d *decoder) hasDecoded(layerType gopacket.LayerType) bool {
+	for _, decoded := range d.decoded {
+		if decoded == layerType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// innermostTCP is the last packet's TCP layer, if that's its innermost transport
+func (d *decoder) innermostTCP() *layers.TCP {
+	if len(d.levels) == 0 || d.levels[len(d.levels)-1].Protocol != "TCP" {
+		return nil
+	}
+
+	return &d.tcp
+}
+
+// innermostUDP is the last packet's UDP layer, if that's its innermost transport
+func (d *decoder) innermostUDP() *layers.UDP {
+	if len(d.levels) == 0 || d.levels[len(d.levels)-1].Protocol != "UDP" {
+		return nil
+	}
+
+	return &d.udp
+}
+
+// decodedNames are the names of the layers successfully decoded from the last packet, outermost first
+func (d *decoder) decodedNames() []string {
+	names := make([]string, 0)
+
+	for _, decoded := range d.decoded {
+		names = append(names, decoded.String())
+	}
+
+	return names
+}
+
+// decode decodes as much of a packet as it can; on error the PacketData has whatever was decoded before the failure
+// and d.layer is the layer that failed
+func (d *decoder) decode(data []byte, captureInfo gopacket.CaptureInfo) (PacketData, error) {
+	d.packetData = PacketData{
+		Timestamp: captureInfo.Timestamp,
+		Length:    captureInfo.Length,
+	}
+
+	d.protocol = ""
+	d.levels = d.levels[:0]
+	d.layer = ""
+
+	parser := d.parser(d.firstLayerType(data))
+
+	err := parser.DecodeLayers(data, &d.decoded)
+
+	d.truncated = parser.Truncated || captureInfo.CaptureLength < captureInfo.Length
+
+	packetData := d.packetData
+
+	packetData.Protocol = d.protocol
+	packetData.Truncated = d.truncated
+
+	var radioTap *layers.RadioTap
+	if d.hasDecoded(layers.LayerTypeRadioTap) {
+		radioTap = &d.radioTap
+	}
+
+	var dot11 *layers.Dot11
+	if d.hasDecoded(layers.LayerTypeDot11) {
+		dot11 = &d.dot11
+	}
+
+	// 802.11 frames (e.g. from a monitor mode interface) don't have an Ethernet header
+	packetData.WiFi = getWiFiData(radioTap, dot11, captureInfo.Length)
+	if packetData.WiFi != nil && packetData.SourceMAC == "" && packetData.DestinationMAC == "" {
+		packetData.SourceMAC = packetData.WiFi.TransmitterMAC
+		packetData.DestinationMAC = packetData.WiFi.ReceiverMAC
+	}
+
+	// the innermost network / transport layers are the ones that matter when tunnelled
+	if len(d.levels) > 0 {
+		inner := d.levels[len(d.levels)-1]
+
+		packetData.Protocol = inner.Protocol
+		packetData.SourceIP = inner.SourceIP
+		packetData.DestinationIP = inner.DestinationIP
+		packetData.SourcePort = inner.SourcePort
+		packetData.DestinationPort = inner.DestinationPort
+	}
+
+	if len(d.levels) > 1 {
+		outer := d.levels[0]
+		packetData.Outer = &outer
+	}
+
+	return packetData, err
+}
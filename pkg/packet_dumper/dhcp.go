@@ -0,0 +1,527 @@
+package packet_dumper
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dhcpEventMessage        = "message"
+	dhcpEventAddressChanged = "address_changed"
+	dhcpEventRenewalDue     = "renewal_due"
+	dhcpEventRebindingDue   = "rebinding_due"
+	dhcpEventLeaseExpired   = "lease_expired"
+)
+
+const (
+	// transactions that never complete are forgotten after this long
+	dhcpTransactionTimeout = time.Minute
+
+	// how often (in packet time) leases and transactions are checked for having come due / timed out
+	dhcpCheckInterval = time.Second
+)
+
+type DHCP struct {
+	Version          int      `json:"version"`
+	Event            string   `json:"event"`
+	MessageType      string   `json:"message_type,omitempty"`
+	TransactionID    string   `json:"transaction_id,omitempty"`
+	ClientMAC        string   `json:"client_mac"`
+	ServerID         string   `json:"server_id,omitempty"`
+	Address          string   `json:"address,omitempty"`
+	PreviousAddress  string   `json:"previous_address,omitempty"`
+	LeaseTime        int      `json:"lease_time_seconds,omitempty"`
+	RenewalTime      int      `json:"renewal_time_seconds,omitempty"`
+	RebindingTime    int      `json:"rebinding_time_seconds,omitempty"`
+	ExchangeDuration *float64 `json:"exchange_duration_ms,omitempty"`
+	Local            bool     `json:"local"`
+}
+
+type dhcpLease struct {
+	version      int
+	clientMAC    string
+	address      string
+	acquired     time.Time
+	leaseTime    time.Duration
+	renewalTime  time.Duration
+	rebindTime   time.Duration
+	renewalDue   bool
+	rebindingDue bool
+}
+
+// dhcpTracker follows DHCPv4 and DHCPv6 exchanges, timing each one from the client's first message and keeping the
+// leases handed out so it can call back when they're due for renewal / rebinding or expire (all driven by packet
+// timestamps); addresses leased to the capture interface are added to (and removed from) the local addresses, so
+// the other analyzers follow "our" address as it changes
+type dhcpTracker struct {
+	local        localAddresses
+	transactions map[string]time.Time
+	leases       map[string]*dhcpLease
+	lastCheck    time.Time
+}
+
+func newDHCPTracker(local localAddresses) *dhcpTracker {
+	return &dhcpTracker{
+		local:        local,
+		transactions: make(map[string]time.Time),
+		leases:       make(map[string]*dhcpLease),
+	}
+}
+
+func leaseSeconds(seconds uint32) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+var dhcpv6MessageTypes = map[layers.DHCPv6MsgType]string{
+	layers.DHCPv6MsgTypeSolicit:            "solicit",
+	layers.DHCPv6MsgTypeAdverstise:         "advertise",
+	layers.DHCPv6MsgTypeRequest:            "request",
+	layers.DHCPv6MsgTypeConfirm:            "confirm",
+	layers.DHCPv6MsgTypeRenew:              "renew",
+	layers.DHCPv6MsgTypeRebind:             "rebind",
+	layers.DHCPv6MsgTypeReply:              "reply",
+	layers.DHCPv6MsgTypeRelease:            "release",
+	layers.DHCPv6MsgTypeDecline:            "decline",
+	layers.DHCPv6MsgTypeReconfigure:        "reconfigure",
+	layers.DHCPv6MsgTypeInformationRequest: "information_request",
+}
+
+// exchange times a message relative to the first message seen for the transaction
+func (d *dhcpTracker) exchange(dhcp *DHCP, fromClient bool, done bool, timestamp time.Time) {
+	key := fmt.Sprintf("%v/%v", dhcp.Version, dhcp.TransactionID)
+
+	start, ok := d.transactions[key]
+	switch {
+	case ok:
+		dhcp.ExchangeDuration = durationPointer(start, timestamp)
+	case fromClient:
+		d.transactions[key] = timestamp
+	}
+
+	if done {
+		delete(d.transactions, key)
+	}
+}
+
+func (d *dhcpTracker) emit(dhcp DHCP, callback func(output Output) error) error {
+	return callback(Output{
+		Timestamp: time.Now(),
+		DHCP:      &dhcp,
+	})
+}
+
+// grant records a lease handed to a client and calls back if it's a different address to the one it had before
+func (d *dhcpTracker) grant(dhcp DHCP, lease dhcpLease, timestamp time.Time, callback func(output Output) error) error {
+	key := fmt.Sprintf("%v/%v", dhcp.Version, dhcp.ClientMAC)
+
+	lease.version = dhcp.Version
+	lease.clientMAC = dhcp.ClientMAC
+	lease.acquired = timestamp
+
+	previous, ok := d.leases[key]
+	d.leases[key] = &lease
+
+	if ok && previous.address == lease.address {
+		return nil
+	}
+
+	dhcp.Event = dhcpEventAddressChanged
+	dhcp.MessageType = ""
+	dhcp.ExchangeDuration = nil
+
+	if ok {
+		dhcp.PreviousAddress = previous.address
+
+		if dhcp.Local {
+			d.local.removeIP(previous.address)
+		}
+	}
+
+	if dhcp.Local {
+		d.local.addIP(lease.address)
+	}
+
+	return d.emit(dhcp, callback)
+}
+
+// release forgets a client's lease (e.g. on a NAK, release or expiry)
+func (d *dhcpTracker) release(version int, clientMAC string) {
+	key := fmt.Sprintf("%v/%v", version, clientMAC)
+
+	lease, ok := d.leases[key]
+	if !ok {
+		return
+	}
+
+	delete(d.leases, key)
+
+	if d.local.isLocal(clientMAC, "") {
+		d.local.removeIP(lease.address)
+	}
+}
+
+func (d *dhcpTracker) handleDHCPv4(dhcpv4 *layers.DHCPv4, timestamp time.Time, callback func(output Output) error) error {
+	dhcp := DHCP{
+		Version:       4,
+		Event:         dhcpEventMessage,
+		TransactionID: fmt.Sprintf("%08x", dhcpv4.Xid),
+		ClientMAC:     dhcpv4.ClientHWAddr.String(),
+	}
+
+	dhcp.Local = d.local.isLocal(dhcp.ClientMAC, "")
+
+	messageType := layers.DHCPMsgTypeUnspecified
+	lease := dhcpLease{}
+
+	for _, option := range dhcpv4.Options {
+		switch {
+		case option.Type == layers.DHCPOptMessageType && len(option.Data) == 1:
+			messageType = layers.DHCPMsgType(option.Data[0])
+		case option.Type == layers.DHCPOptServerID && len(option.Data) == 4:
+			dhcp.ServerID = net.IP(option.Data).String()
+		case option.Type == layers.DHCPOptRequestIP && len(option.Data) == 4:
+			dhcp.Address = net.IP(option.Data).String()
+		case option.Type == layers.DHCPOptLeaseTime && len(option.Data) == 4:
+			dhcp.LeaseTime = int(binary.BigEndian.Uint32(option.Data))
+			lease.leaseTime = leaseSeconds(binary.BigEndian.Uint32(option.Data))
+		case option.Type == layers.DHCPOptT1 && len(option.Data) == 4:
+			dhcp.RenewalTime = int(binary.BigEndian.Uint32(option.Data))
+			lease.renewalTime = leaseSeconds(binary.BigEndian.Uint32(option.Data))
+		case option.Type == layers.DHCPOptT2 && len(option.Data) == 4:
+			dhcp.RebindingTime = int(binary.BigEndian.Uint32(option.Data))
+			lease.rebindTime = leaseSeconds(binary.BigEndian.Uint32(option.Data))
+		}
+	}
+
+	if messageType == layers.DHCPMsgTypeUnspecified {
+		return nil
+	}
+
+	dhcp.MessageType = strings.ToLower(messageType.String())
+
+	if dhcpv4.YourClientIP != nil && !dhcpv4.YourClientIP.IsUnspecified() {
+		dhcp.Address = dhcpv4.YourClientIP.String()
+	} else if dhcp.Address == "" && dhcpv4.ClientIP != nil && !dhcpv4.ClientIP.IsUnspecified() {
+		dhcp.Address = dhcpv4.ClientIP.String()
+	}
+
+	done := messageType == layers.DHCPMsgTypeAck || messageType == layers.DHCPMsgTypeNak ||
+		messageType == layers.DHCPMsgTypeRelease || messageType == layers.DHCPMsgTypeDecline
+
+	d.exchange(&dhcp, dhcpv4.Operation == layers.DHCPOpRequest, done, timestamp)
+
+	err := d.emit(dhcp, callback)
+	if err != nil {
+		return err
+	}
+
+	switch messageType {
+	case layers.DHCPMsgTypeAck:
+		// an ACK to an INFORM doesn't hand out an address
+		if dhcpv4.YourClientIP == nil || dhcpv4.YourClientIP.IsUnspecified() {
+			return nil
+		}
+
+		// per RFC 2131 T1 / T2 default to half / seven eighths of the lease
+		if lease.renewalTime == 0 {
+			lease.renewalTime = lease.leaseTime / 2
+		}
+
+		if lease.rebindTime == 0 {
+			lease.rebindTime = lease.leaseTime * 7 / 8
+		}
+
+		lease.address = dhcp.Address
+
+		return d.grant(dhcp, lease, timestamp, callback)
+	case layers.DHCPMsgTypeNak, layers.DHCPMsgTypeRelease, layers.DHCPMsgTypeDecline:
+		d.release(dhcp.Version, dhcp.ClientMAC)
+	}
+
+	return nil
+}
+
+// getIANA pulls the (first) address and its timers out of a DHCPv6 identity association for non-temporary addresses
+func getIANA(options layers.DHCPv6Options) *dhcpLease {
+	for _, option := range options {
+		if option.Code != layers.DHCPv6OptIANA || len(option.Data) < 12 {
+			continue
+		}
+
+		lease := dhcpLease{
+			renewalTime: leaseSeconds(binary.BigEndian.Uint32(option.Data[4:8])),
+			rebindTime:  leaseSeconds(binary.BigEndian.Uint32(option.Data[8:12])),
+		}
+
+		data := option.Data[12:]
+		for len(data) >= 4 {
+			code := layers.DHCPv6Opt(binary.BigEndian.Uint16(data[0:2]))
+			length := int(binary.BigEndian.Uint16(data[2:4]))
+
+			if len(data) < 4+length {
+				break
+			}
+
+			if code == layers.DHCPv6OptIAAddr && length >= 24 {
+				lease.address = net.IP(data[4:20]).String()
+				lease.leaseTime = leaseSeconds(binary.BigEndian.Uint32(data[24:28]))
+
+				return &lease
+			}
+
+			data = data[4+length:]
+		}
+	}
+
+	return nil
+}
+
+func isDHCPv6Relay(msgType layers.DHCPv6MsgType) bool {
+	return msgType == layers.DHCPv6MsgTypeRelayForward || msgType == layers.DHCPv6MsgTypeRelayReply
+}
+
+// unwrapDHCPv6Relay gets the client's (or server's) message out of (possibly nested) relay-forward / relay-reply
+// messages, along with the client link-layer address (RFC 6939) if a relay added one; it's nil if there's no message
+func unwrapDHCPv6Relay(dhcpv6 *layers.DHCPv6) (*layers.DHCPv6, net.HardwareAddr) {
+	var clientLinkLayerAddress net.HardwareAddr
+
+	for isDHCPv6Relay(dhcpv6.MsgType) {
+		var relayed []byte
+
+		for _, option := range dhcpv6.Options {
+			switch {
+			case option.Code == layers.DHCPv6OptClientLinkLayerAddress && len(option.Data) > 2:
+				clientLinkLayerAddress = net.HardwareAddr(option.Data[2:])
+			case option.Code == layers.DHCPv6OptRelayMessage:
+				relayed = option.Data
+			}
+		}
+
+		// gopacket doesn't check there's enough for the header
+		if len(relayed) < 4 || (isDHCPv6Relay(layers.DHCPv6MsgType(relayed[0])) && len(relayed) < 34) {
+			return nil, nil
+		}
+
+		dhcpv6 = &layers.DHCPv6{}
+
+		err := dhcpv6.DecodeFromBytes(relayed, gopacket.NilDecodeFeedback)
+		if err != nil {
+			return nil, nil
+		}
+	}
+
+	return dhcpv6, clientLinkLayerAddress
+}
+
+// duidLinkLayerAddress is the Ethernet address in a client's DUID-LLT / DUID-LL (if that's the kind it has)
+func duidLinkLayerAddress(options layers.DHCPv6Options) net.HardwareAddr {
+	for _, option := range options {
+		if option.Code != layers.DHCPv6OptClientID || len(option.Data) < 4 {
+			continue
+		}
+
+		// only Ethernet (hardware type 1) addresses are MACs
+		if binary.BigEndian.Uint16(option.Data[2:4]) != 1 {
+			return nil
+		}
+
+		switch layers.DHCPv6DUIDType(binary.BigEndian.Uint16(option.Data[0:2])) {
+		case layers.DHCPv6DUIDTypeLLT:
+			if len(option.Data) == 14 {
+				return net.HardwareAddr(option.Data[8:14])
+			}
+		case layers.DHCPv6DUIDTypeLL:
+			if len(option.Data) == 10 {
+				return net.HardwareAddr(option.Data[4:10])
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *dhcpTracker) handleDHCPv6(dhcpv6 *layers.DHCPv6, packetData PacketData, callback func(output Output) error) error {
+	relayed := isDHCPv6Relay(dhcpv6.MsgType)
+
+	dhcpv6, clientLinkLayerAddress := unwrapDHCPv6Relay(dhcpv6)
+	if dhcpv6 == nil {
+		return nil
+	}
+
+	messageType, ok := dhcpv6MessageTypes[dhcpv6.MsgType]
+	if !ok {
+		return nil
+	}
+
+	fromClient := dhcpv6.MsgType != layers.DHCPv6MsgTypeAdverstise && dhcpv6.MsgType != layers.DHCPv6MsgTypeReply &&
+		dhcpv6.MsgType != layers.DHCPv6MsgTypeReconfigure
+
+	// there's no client hardware address in DHCPv6 so go by which way the frame is headed, unless it's between a relay
+	// and the server, in which case it's the client's DUID (as the relay-reply has that too) or failing that what the
+	// relay says the client's address is
+	clientMAC := packetData.SourceMAC
+	if !fromClient {
+		clientMAC = packetData.DestinationMAC
+	}
+
+	if relayed {
+		clientMAC = ""
+
+		duidAddress := duidLinkLayerAddress(dhcpv6.Options)
+
+		switch {
+		case duidAddress != nil:
+			clientMAC = duidAddress.String()
+		case clientLinkLayerAddress != nil:
+			clientMAC = clientLinkLayerAddress.String()
+		}
+	}
+
+	dhcp := DHCP{
+		Version:       6,
+		Event:         dhcpEventMessage,
+		MessageType:   messageType,
+		TransactionID: hex.EncodeToString(dhcpv6.TransactionID),
+		ClientMAC:     clientMAC,
+	}
+
+	dhcp.Local = d.local.isLocal(dhcp.ClientMAC, "")
+
+	for _, option := range dhcpv6.Options {
+		if option.Code == layers.DHCPv6OptServerID {
+			dhcp.ServerID = hex.EncodeToString(option.Data)
+		}
+	}
+
+	lease := getIANA(dhcpv6.Options)
+	if lease != nil {
+		dhcp.Address = lease.address
+		dhcp.LeaseTime = int(lease.leaseTime / time.Second)
+		dhcp.RenewalTime = int(lease.renewalTime / time.Second)
+		dhcp.RebindingTime = int(lease.rebindTime / time.Second)
+	}
+
+	done := dhcpv6.MsgType == layers.DHCPv6MsgTypeReply
+
+	d.exchange(&dhcp, fromClient, done, packetData.Timestamp)
+
+	err := d.emit(dhcp, callback)
+	if err != nil {
+		return err
+	}
+
+	// no telling whose lease it is
+	if dhcp.ClientMAC == "" {
+		return nil
+	}
+
+	switch dhcpv6.MsgType {
+	case layers.DHCPv6MsgTypeReply:
+		if lease == nil {
+			return nil
+		}
+
+		// a valid lifetime of zero takes the address away
+		if lease.leaseTime == 0 {
+			d.release(dhcp.Version, dhcp.ClientMAC)
+
+			return nil
+		}
+
+		// per RFC 8415 T1 / T2 of zero leave it up to the client; assume the usual half / four fifths
+		if lease.renewalTime == 0 {
+			lease.renewalTime = lease.leaseTime / 2
+		}
+
+		if lease.rebindTime == 0 {
+			lease.rebindTime = lease.leaseTime * 4 / 5
+		}
+
+		return d.grant(dhcp, *lease, packetData.Timestamp, callback)
+	case layers.DHCPv6MsgTypeRelease, layers.DHCPv6MsgTypeDecline:
+		d.release(dhcp.Version, dhcp.ClientMAC)
+	}
+
+	return nil
+}
+
+// checkLeases calls back as leases pass their renewal / rebinding times and expire, checking at most once per check
+// interval
+func (d *dhcpTracker) checkLeases(timestamp time.Time, callback func(output Output) error) error {
+	if timestamp.Sub(d.lastCheck) < dhcpCheckInterval {
+		return nil
+	}
+
+	d.lastCheck = timestamp
+
+	for _, lease := range d.leases {
+		dhcp := DHCP{
+			Version:   lease.version,
+			ClientMAC: lease.clientMAC,
+			Address:   lease.address,
+			Local:     d.local.isLocal(lease.clientMAC, ""),
+		}
+
+		age := timestamp.Sub(lease.acquired)
+
+		switch {
+		case lease.leaseTime > 0 && age >= lease.leaseTime:
+			dhcp.Event = dhcpEventLeaseExpired
+
+			d.release(dhcp.Version, dhcp.ClientMAC)
+		case lease.rebindTime > 0 && age >= lease.rebindTime && !lease.rebindingDue:
+			dhcp.Event = dhcpEventRebindingDue
+
+			lease.rebindingDue = true
+			lease.renewalDue = true
+		case lease.renewalTime > 0 && age >= lease.renewalTime && !lease.renewalDue:
+			dhcp.Event = dhcpEventRenewalDue
+
+			lease.renewalDue = true
+		default:
+			continue
+		}
+
+		err := d.emit(dhcp, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	for key, start := range d.transactions {
+		if timestamp.Sub(start) >= dhcpTransactionTimeout {
+			delete(d.transactions, key)
+		}
+	}
+
+	return nil
+}
+
+func (d *dhcpTracker) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	err := d.checkLeases(packetData.Timestamp, callback)
+	if err != nil {
+		return err
+	}
+
+	dhcpv4Layer := packet.Layer(layers.LayerTypeDHCPv4)
+	if dhcpv4Layer != nil {
+		return d.handleDHCPv4(dhcpv4Layer.(*layers.DHCPv4), packetData.Timestamp, callback)
+	}
+
+	dhcpv6Layer := packet.Layer(layers.LayerTypeDHCPv6)
+	if dhcpv6Layer != nil {
+		return d.handleDHCPv6(dhcpv6Layer.(*layers.DHCPv6), packetData, callback)
+	}
+
+	return nil
+}
+
+func (d *dhcpTracker) flush(callback func(output Output) error) error {
+	return nil
+}
@@ -0,0 +1,249 @@
+package packet_dumper
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"time"
+)
+
+const (
+	discoveryEventNeighbour        = "neighbour"
+	discoveryEventNeighbourChanged = "neighbour_changed"
+)
+
+type DiscoveryNeighbour struct {
+	Protocol          string   `json:"protocol"`
+	SourceMAC         string   `json:"source_mac"`
+	ChassisID         string   `json:"chassis_id"`
+	PortID            string   `json:"port_id"`
+	PortDescription   string   `json:"port_description,omitempty"`
+	SystemName        string   `json:"system_name,omitempty"`
+	SystemDescription string   `json:"system_description,omitempty"`
+	ManagementAddress string   `json:"management_address,omitempty"`
+	Capabilities      []string `json:"capabilities"`
+	NativeVLAN        int      `json:"native_vlan,omitempty"`
+	TTL               int      `json:"ttl_seconds"`
+}
+
+type Discovery struct {
+	Event string `json:"event"`
+	DiscoveryNeighbour
+	Previous *DiscoveryNeighbour `json:"previous,omitempty"`
+}
+
+// discoveryTracker decodes LLDP and CDP frames from whatever we're attached to and calls back with a record per
+// frame, flagging it as neighbour_changed if the chassis / port differs from the last one seen (per protocol)
+type discoveryTracker struct {
+	local    localAddresses
+	attached map[string]*DiscoveryNeighbour
+}
+
+func newDiscoveryTracker(local localAddresses) *discoveryTracker {
+	return &discoveryTracker{
+		local:    local,
+		attached: make(map[string]*DiscoveryNeighbour),
+	}
+}
+
+func formatAddress(family layers.IANAAddressFamily, address []byte) string {
+	switch {
+	case family == layers.IANAAddressFamilyIPV4 && len(address) == net.IPv4len:
+		return net.IP(address).String()
+	case family == layers.IANAAddressFamilyIPV6 && len(address) == net.IPv6len:
+		return net.IP(address).String()
+	case family == layers.IANAAddressFamily802 && len(address) == 6:
+		return net.HardwareAddr(address).String()
+	}
+
+	return string(address)
+}
+
+func formatChassisID(chassisID layers.LLDPChassisID) string {
+	switch chassisID.Subtype {
+	case layers.LLDPChassisIDSubTypeMACAddr:
+		return net.HardwareAddr(chassisID.ID).String()
+	case layers.LLDPChassisIDSubTypeNetworkAddr:
+		if len(chassisID.ID) > 1 {
+			return formatAddress(layers.IANAAddressFamily(chassisID.ID[0]), chassisID.ID[1:])
+		}
+	}
+
+	return string(chassisID.ID)
+}
+
+func formatPortID(portID layers.LLDPPortID) string {
+	switch portID.Subtype {
+	case layers.LLDPPortIDSubtypeMACAddr:
+		return net.HardwareAddr(portID.ID).String()
+	case layers.LLDPPortIDSubtypeNetworkAddr:
+		if len(portID.ID) > 1 {
+			return formatAddress(layers.IANAAddressFamily(portID.ID[0]), portID.ID[1:])
+		}
+	}
+
+	return string(portID.ID)
+}
+
+func lldpCapabilities(capabilities layers.LLDPCapabilities) []string {
+	names := make([]string, 0)
+
+	for _, capability := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"other", capabilities.Other},
+		{"repeater", capabilities.Repeater},
+		{"bridge", capabilities.Bridge},
+		{"wlan_ap", capabilities.WLANAP},
+		{"router", capabilities.Router},
+		{"phone", capabilities.Phone},
+		{"docsis", capabilities.DocSis},
+		{"station", capabilities.StationOnly},
+		{"c_vlan", capabilities.CVLAN},
+		{"s_vlan", capabilities.SVLAN},
+		{"tpmr", capabilities.TMPR},
+	} {
+		if capability.enabled {
+			names = append(names, capability.name)
+		}
+	}
+
+	return names
+}
+
+func cdpCapabilities(capabilities layers.CDPCapabilities) []string {
+	names := make([]string, 0)
+
+	for _, capability := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"router", capabilities.L3Router},
+		{"transparent_bridge", capabilities.TBBridge},
+		{"source_route_bridge", capabilities.SPBridge},
+		{"switch", capabilities.L2Switch},
+		{"host", capabilities.IsHost},
+		{"igmp_filter", capabilities.IGMPFilter},
+		{"repeater", capabilities.L1Repeater},
+		{"phone", capabilities.IsPhone},
+		{"remotely_managed", capabilities.RemotelyManaged},
+	} {
+		if capability.enabled {
+			names = append(names, capability.name)
+		}
+	}
+
+	return names
+}
+
+func getLLDPNeighbour(packet gopacket.Packet) *DiscoveryNeighbour {
+	lldpLayer := packet.Layer(layers.LayerTypeLinkLayerDiscovery)
+	if lldpLayer == nil {
+		return nil
+	}
+
+	lldp := lldpLayer.(*layers.LinkLayerDiscovery)
+
+	neighbour := DiscoveryNeighbour{
+		Protocol:     "lldp",
+		ChassisID:    formatChassisID(lldp.ChassisID),
+		PortID:       formatPortID(lldp.PortID),
+		Capabilities: make([]string, 0),
+		TTL:          int(lldp.TTL),
+	}
+
+	infoLayer := packet.Layer(layers.LayerTypeLinkLayerDiscoveryInfo)
+	if infoLayer != nil {
+		info := infoLayer.(*layers.LinkLayerDiscoveryInfo)
+
+		neighbour.PortDescription = info.PortDescription
+		neighbour.SystemName = info.SysName
+		neighbour.SystemDescription = info.SysDescription
+		neighbour.Capabilities = lldpCapabilities(info.SysCapabilities.EnabledCap)
+
+		if len(info.MgmtAddress.Address) > 0 {
+			neighbour.ManagementAddress = formatAddress(info.MgmtAddress.Subtype, info.MgmtAddress.Address)
+		}
+	}
+
+	return &neighbour
+}
+
+func getCDPNeighbour(packet gopacket.Packet) *DiscoveryNeighbour {
+	cdpLayer := packet.Layer(layers.LayerTypeCiscoDiscovery)
+	if cdpLayer == nil {
+		return nil
+	}
+
+	neighbour := DiscoveryNeighbour{
+		Protocol:     "cdp",
+		TTL:          int(cdpLayer.(*layers.CiscoDiscovery).TTL),
+		Capabilities: make([]string, 0),
+	}
+
+	infoLayer := packet.Layer(layers.LayerTypeCiscoDiscoveryInfo)
+	if infoLayer != nil {
+		info := infoLayer.(*layers.CiscoDiscoveryInfo)
+
+		neighbour.ChassisID = info.DeviceID
+		neighbour.PortID = info.PortID
+		neighbour.SystemName = info.SysName
+		neighbour.SystemDescription = info.Platform
+		neighbour.Capabilities = cdpCapabilities(info.Capabilities)
+		neighbour.NativeVLAN = int(info.NativeVLAN)
+
+		switch {
+		case len(info.MgmtAddresses) > 0:
+			neighbour.ManagementAddress = info.MgmtAddresses[0].String()
+		case len(info.Addresses) > 0:
+			neighbour.ManagementAddress = info.Addresses[0].String()
+		}
+
+		if neighbour.SystemName == "" {
+			neighbour.SystemName = info.DeviceID
+		}
+	}
+
+	return &neighbour
+}
+
+func (d *discoveryTracker) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	// we may well be sending LLDP / CDP ourselves
+	if d.local.isLocal(packetData.SourceMAC, "") {
+		return nil
+	}
+
+	neighbour := getLLDPNeighbour(packet)
+	if neighbour == nil {
+		neighbour = getCDPNeighbour(packet)
+	}
+
+	if neighbour == nil {
+		return nil
+	}
+
+	neighbour.SourceMAC = packetData.SourceMAC
+
+	discovery := Discovery{
+		Event:              discoveryEventNeighbour,
+		DiscoveryNeighbour: *neighbour,
+	}
+
+	previous, ok := d.attached[neighbour.Protocol]
+	if ok && (previous.ChassisID != neighbour.ChassisID || previous.PortID != neighbour.PortID) {
+		discovery.Event = discoveryEventNeighbourChanged
+		discovery.Previous = previous
+	}
+
+	d.attached[neighbour.Protocol] = neighbour
+
+	return callback(Output{
+		Timestamp: time.Now(),
+		Discovery: &discovery,
+	})
+}
+
+func (d *discoveryTracker) flush(callback func(output Output) error) error {
+	return nil
+}
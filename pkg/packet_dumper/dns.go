@@ -0,0 +1,294 @@
+package packet_dumper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"time"
+)
+
+const (
+	defaultDNSTimeout = time.Second * 5
+
+	// how often (in packet time) queries are checked for having gone unanswered
+	dnsExpireInterval = time.Second
+
+	mDNSPort = 5353
+)
+
+var dnsResponseCodes = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+}
+
+type DNS struct {
+	Transport       string     `json:"transport"`
+	ClientIP        string     `json:"client_ip"`
+	ClientPort      int        `json:"client_port"`
+	ServerIP        string     `json:"server_ip"`
+	ServerPort      int        `json:"server_port"`
+	ID              uint16     `json:"id"`
+	QueryName       string     `json:"query_name"`
+	QueryType       string     `json:"query_type"`
+	QueryTime       *time.Time `json:"query_time,omitempty"`
+	Retransmissions int        `json:"retransmissions"`
+	Answered        bool       `json:"answered"`
+	ResponseCode    string     `json:"response_code,omitempty"`
+	Answers         []string   `json:"answers"`
+	Latency         *float64   `json:"latency_ms,omitempty"`
+}
+
+type dnsQuery struct {
+	dns      DNS
+	lastSeen time.Time
+}
+
+// dnsTracker pairs DNS queries with their responses (by transport, addresses, ports and ID) and calls back with a
+// record per pair, or for queries that go unanswered for the timeout (driven by packet timestamps); DNS over TCP is
+// only decoded where a message fits in a single segment, and mDNS (or anything else sent to a multicast group) is left
+// out as its queries aren't answered by any one server
+type dnsTracker struct {
+	timeout    time.Duration
+	queries    map[string]*dnsQuery
+	lastExpire time.Time
+}
+
+func newDNSTracker(timeout time.Duration) *dnsTracker {
+	return &dnsTracker{
+		timeout: timeout,
+		queries: make(map[string]*dnsQuery),
+	}
+}
+
+func dnsTypeName(dnsType layers.DNSType) string {
+	name := dnsType.String()
+	if name == "Unknown" {
+		return fmt.Sprintf("TYPE%v", uint16(dnsType))
+	}
+
+	return name
+}
+
+func dnsResponseCodeName(responseCode layers.DNSResponseCode) string {
+	name, ok := dnsResponseCodes[responseCode]
+	if !ok {
+		return fmt.Sprintf("RCODE%v", uint8(responseCode))
+	}
+
+	return name
+}
+
+// formatAnswer renders an answer along the lines of a zone file entry (without the name, class or TTL)
+func formatAnswer(answer layers.DNSResourceRecord) string {
+	value := ""
+
+	switch answer.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		value = answer.IP.String()
+	case layers.DNSTypeCNAME:
+		value = string(answer.CNAME)
+	case layers.DNSTypeNS:
+		value = string(answer.NS)
+	case layers.DNSTypePTR:
+		value = string(answer.PTR)
+	case layers.DNSTypeMX:
+		value = fmt.Sprintf("%v %s", answer.MX.Preference, answer.MX.Name)
+	case layers.DNSTypeSRV:
+		value = fmt.Sprintf("%v %v %v %s", answer.SRV.Priority, answer.SRV.Weight, answer.SRV.Port, answer.SRV.Name)
+	case layers.DNSTypeTXT:
+		for i, txt := range answer.TXTs {
+			if i > 0 {
+				value += " "
+			}
+
+			value += fmt.Sprintf("%q", txt)
+		}
+	default:
+		value = fmt.Sprintf("%x", answer.Data)
+	}
+
+	return fmt.Sprintf("%v %v", dnsTypeName(answer.Type), value)
+}
+
+// getDNS gets a DNS message from either the decoded UDP layer or (where the length prefixed message fits) a TCP
+// segment; gopacket decodes TCP port 53 as DNS too, but without skipping the length prefix, so a decoded layer only
+// counts if it came from UDP
+func getDNS(packet gopacket.Packet) (*layers.DNS, string) {
+	packetLayers := packet.Layers()
+
+	for i := len(packetLayers) - 1; i > 0; i-- {
+		if packetLayers[i].LayerType() != layers.LayerTypeDNS {
+			continue
+		}
+
+		if packetLayers[i-1].LayerType() == layers.LayerTypeUDP {
+			return packetLayers[i].(*layers.DNS), "udp"
+		}
+
+		break
+	}
+
+	tcpLayer := innermostLayer(packet, layers.LayerTypeTCP)
+	if tcpLayer == nil {
+		return nil, ""
+	}
+
+	tcp := tcpLayer.(*layers.TCP)
+	if tcp.SrcPort != 53 && tcp.DstPort != 53 {
+		return nil, ""
+	}
+
+	payload := tcp.Payload
+	if len(payload) < 2 {
+		return nil, ""
+	}
+
+	length := int(binary.BigEndian.Uint16(payload[0:2]))
+	if len(payload) < 2+length {
+		return nil, ""
+	}
+
+	dns := &layers.DNS{}
+
+	err := dns.DecodeFromBytes(payload[2:2+length], gopacket.NilDecodeFeedback)
+	if err != nil {
+		return nil, ""
+	}
+
+	return dns, "tcp"
+}
+
+func (d *dnsTracker) emit(dns DNS, callback func(output Output) error) error {
+	return callback(Output{
+		Timestamp: time.Now(),
+		DNS:       &dns,
+	})
+}
+
+// expire calls back for queries that have gone unanswered, at most once per expire interval
+func (d *dnsTracker) expire(timestamp time.Time, callback func(output Output) error) error {
+	if timestamp.Sub(d.lastExpire) < dnsExpireInterval {
+		return nil
+	}
+
+	d.lastExpire = timestamp
+
+	for key, query := range d.queries {
+		if timestamp.Sub(query.lastSeen) < d.timeout {
+			continue
+		}
+
+		delete(d.queries, key)
+
+		err := d.emit(query.dns, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *dnsTracker) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	err := d.expire(packetData.Timestamp, callback)
+	if err != nil {
+		return err
+	}
+
+	message, transport := getDNS(packet)
+	if message == nil {
+		return nil
+	}
+
+	if packetData.SourcePort == mDNSPort || packetData.DestinationPort == mDNSPort {
+		return nil
+	}
+
+	destinationIP := net.ParseIP(packetData.DestinationIP)
+	if destinationIP != nil && destinationIP.IsMulticast() {
+		return nil
+	}
+
+	dns := DNS{
+		Transport: transport,
+		ID:        message.ID,
+		Answers:   make([]string, 0),
+	}
+
+	if len(message.Questions) > 0 {
+		dns.QueryName = string(message.Questions[0].Name)
+		dns.QueryType = dnsTypeName(message.Questions[0].Type)
+	}
+
+	if !message.QR {
+		dns.ClientIP, dns.ClientPort = packetData.SourceIP, packetData.SourcePort
+		dns.ServerIP, dns.ServerPort = packetData.DestinationIP, packetData.DestinationPort
+	} else {
+		dns.ClientIP, dns.ClientPort = packetData.DestinationIP, packetData.DestinationPort
+		dns.ServerIP, dns.ServerPort = packetData.SourceIP, packetData.SourcePort
+	}
+
+	key := fmt.Sprintf(
+		"%v/%v/%v/%v/%v/%v",
+		dns.Transport, dns.ClientIP, dns.ClientPort, dns.ServerIP, dns.ServerPort, dns.ID,
+	)
+
+	if !message.QR {
+		query, ok := d.queries[key]
+		if ok {
+			query.dns.Retransmissions++
+			query.lastSeen = packetData.Timestamp
+
+			return nil
+		}
+
+		queryTime := packetData.Timestamp
+		dns.QueryTime = &queryTime
+
+		d.queries[key] = &dnsQuery{
+			dns:      dns,
+			lastSeen: packetData.Timestamp,
+		}
+
+		return nil
+	}
+
+	// a response we didn't see the query for (e.g. from before the capture started) is still worth having
+	query, ok := d.queries[key]
+	if ok {
+		delete(d.queries, key)
+
+		dns.QueryTime = query.dns.QueryTime
+		dns.Retransmissions = query.dns.Retransmissions
+		dns.Latency = durationPointer(*query.dns.QueryTime, packetData.Timestamp)
+	}
+
+	dns.Answered = true
+	dns.ResponseCode = dnsResponseCodeName(message.ResponseCode)
+
+	for _, answer := range message.Answers {
+		dns.Answers = append(dns.Answers, formatAnswer(answer))
+	}
+
+	return d.emit(dns, callback)
+}
+
+// flush reports whatever queries are still outstanding as unanswered
+func (d *dnsTracker) flush(callback func(output Output) error) error {
+	for key, query := range d.queries {
+		delete(d.queries, key)
+
+		err := d.emit(query.dns, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
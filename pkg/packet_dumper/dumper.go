@@ -1,106 +1,623 @@
 package packet_dumper
 
 import (
+	"fmt"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-	"strconv"
+	"github.com/initialed85/drive_test/internal/scheduler"
+	"io"
+	"log"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	defaultSnaplen = 1600
+
+	// live captures wake up this often even with nothing to read, so triggers aren't stuck waiting on a packet
+	readTimeout = time.Millisecond * 250
+
+	// how long to wait before reopening an interface whose capture failed (e.g. a modem resetting), doubling each time
+	// it fails again soon after
+	minReopenBackoff = time.Second
+	maxReopenBackoff = time.Second * 30
+
+	// live captures rarely run out, so they write their stats this often as well as when they stop
+	defaultStatsInterval = time.Minute
+)
+
+// InterfaceConfig is the capture settings for one of the interfaces to capture on; the filter defaults to the one in
+// Config, the snaplen to 1600, promiscuous mode to on and the buffer size to libpcap's default
+type InterfaceConfig struct {
+	Name        string `json:"name"`
+	Filter      string `json:"filter"`
+	Snaplen     int    `json:"snaplen"`
+	Promiscuous *bool  `json:"promiscuous"`
+	BufferSize  int    `json:"buffer_size"`
+}
+
+type Config struct {
+	Interfaces                 []InterfaceConfig    `json:"interfaces"`
+	Filter                     string               `json:"filter"`
+	Rules                      []Rule               `json:"rules"`
+	Aggregate                  bool                 `json:"aggregate"`
+	AggregateInterval          float64              `json:"aggregate_interval"`
+	WiFiAggregate              bool                 `json:"wifi_aggregate"`
+	WiFiAggregateInterval      float64              `json:"wifi_aggregate_interval"`
+	RoamAnalyzer               bool                 `json:"roam_analyzer"`
+	RoamTimeout                float64              `json:"roam_timeout"`
+	NeighbourTracker           bool                 `json:"neighbour_tracker"`
+	GatewayIP                  string               `json:"gateway_ip"`
+	DiscoveryTracker           bool                 `json:"discovery_tracker"`
+	DHCPTracker                bool                 `json:"dhcp_tracker"`
+	DNSTracker                 bool                 `json:"dns_tracker"`
+	DNSTimeout                 float64              `json:"dns_timeout"`
+	TCPAnalyzer                bool                 `json:"tcp_analyzer"`
+	TCPInterval                float64              `json:"tcp_interval"`
+	TCPTimeout                 float64              `json:"tcp_timeout"`
+	RTPAnalyzer                bool                 `json:"rtp_analyzer"`
+	RTPInterval                float64              `json:"rtp_interval"`
+	RTPPorts                   []PortRange          `json:"rtp_ports"`
+	BFDTracker                 bool                 `json:"bfd_tracker"`
+	OSPFTracker                bool                 `json:"ospf_tracker"`
+	STPTracker                 bool                 `json:"stp_tracker"`
+	MulticastTracker           bool                 `json:"multicast_tracker"`
+	MulticastTimeout           float64              `json:"multicast_timeout"`
+	MulticastMembershipTimeout float64              `json:"multicast_membership_timeout"`
+	DuplicateDetector          bool                 `json:"duplicate_detector"`
+	DuplicateInterval          float64              `json:"duplicate_interval"`
+	DuplicateWindow            float64              `json:"duplicate_window"`
+	DuplicateThreshold         float64              `json:"duplicate_threshold"`
+	RingBuffer                 *RingBufferConfig    `json:"ring_buffer"`
+	CaptureStats               bool                 `json:"capture_stats"`
+	CaptureStatsInterval       float64              `json:"capture_stats_interval"`
+	StatsInterval              float64              `json:"stats_interval"`
+	Anonymize                  *AnonymizeConfig     `json:"anonymize"`
+	IdentifyApplications       bool                 `json:"identify_applications"`
+	Applications               []ApplicationMapping `json:"applications"`
+}
+
 type PacketData struct {
-	Timestamp       time.Time `json:"timestamp"`
-	Protocol        string    `json:"protocol"`
-	SourceMAC       string    `json:"source_mac"`
-	DestinationMAC  string    `json:"destination_mac"`
-	SourceIP        string    `json:"source_ip"`
-	DestinationIP   string    `json:"destination_ip"`
-	SourcePort      int       `json:"source_port"`
-	DestinationPort int       `json:"destination_port"`
-	Length          int       `json:"length"`
+	Timestamp       time.Time    `json:"timestamp"`
+	Protocol        string       `json:"protocol"`
+	SourceMAC       string       `json:"source_mac"`
+	DestinationMAC  string       `json:"destination_mac"`
+	SourceIP        string       `json:"source_ip"`
+	DestinationIP   string       `json:"destination_ip"`
+	SourcePort      int          `json:"source_port"`
+	DestinationPort int          `json:"destination_port"`
+	Length          int          `json:"length"`
+	WiFi            *WiFiData    `json:"wifi,omitempty"`
+	Encapsulation   []string     `json:"encapsulation,omitempty"`
+	VLANIDs         []int        `json:"vlan_ids,omitempty"`
+	MPLSLabels      []int        `json:"mpls_labels,omitempty"`
+	TEIDs           []uint32     `json:"gtp_teids,omitempty"`
+	VNIs            []uint32     `json:"vnis,omitempty"`
+	Outer           *Headers     `json:"outer,omitempty"`
+	ICMPType        *int         `json:"icmp_type,omitempty"`
+	ICMPCode        *int         `json:"icmp_code,omitempty"`
+	MessageType     string       `json:"message_type,omitempty"`
+	Truncated       bool         `json:"truncated,omitempty"`
+	Rules           []string     `json:"rules,omitempty"`
+	Application     *Application `json:"application,omitempty"`
 }
 
 type Output struct {
-	Timestamp  time.Time  `json:"timestamp"`
-	PacketData PacketData `json:"packet_data"`
+	Timestamp        time.Time          `json:"timestamp"`
+	Interface        string             `json:"interface,omitempty"`
+	PacketData       *PacketData        `json:"packet_data,omitempty"`
+	Throughput       *Throughput        `json:"throughput,omitempty"`
+	WiFi             *WiFiInterval      `json:"wifi,omitempty"`
+	Roam             *Roam              `json:"roam,omitempty"`
+	Neighbour        *Neighbour         `json:"neighbour,omitempty"`
+	Discovery        *Discovery         `json:"discovery,omitempty"`
+	DHCP             *DHCP              `json:"dhcp,omitempty"`
+	DNS              *DNS               `json:"dns,omitempty"`
+	TCP              *TCPInterval       `json:"tcp,omitempty"`
+	TCPConnection    *TCPConnection     `json:"tcp_connection,omitempty"`
+	RTP              *RTPInterval       `json:"rtp,omitempty"`
+	DecodeError      *DecodeError       `json:"decode_error,omitempty"`
+	Stats            *Stats             `json:"stats,omitempty"`
+	CaptureStats     *CaptureStats      `json:"capture_stats,omitempty"`
+	BFD              *BFD               `json:"bfd,omitempty"`
+	OSPF             *OSPF              `json:"ospf,omitempty"`
+	STP              *STP               `json:"stp,omitempty"`
+	Multicast        *Multicast         `json:"multicast,omitempty"`
+	Duplicates       *DuplicateInterval `json:"duplicates,omitempty"`
+	DuplicateAlert   *DuplicateAlert    `json:"duplicate_alert,omitempty"`
+	TriggeredCapture *TriggeredCapture  `json:"triggered_capture,omitempty"`
 }
 
-func handlePacket(packet gopacket.Packet, callback func(output Output) error) error {
-	metadata := packet.Metadata()
-
+func handlePacket(packetData PacketData, callback func(output Output) error) error {
 	output := Output{
-		Timestamp: time.Now(),
-		PacketData: PacketData{
-			Timestamp: metadata.Timestamp,
-			Length:    metadata.Length,
-		},
+		Timestamp:  time.Now(),
+		PacketData: &packetData,
 	}
 
-	linkLayer := packet.LinkLayer()
-	if linkLayer != nil {
-		sourceMAC, destinationMAC := linkLayer.LinkFlow().Endpoints()
+	err := callback(output)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
 
-		output.PacketData.SourceMAC = sourceMAC.String()
-		output.PacketData.DestinationMAC = destinationMAC.String()
+// packetReader is what's needed from a pcap.Handle (live or offline)
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
 
-		output.PacketData.Protocol = linkLayer.LayerType().String()
+// capture is a single capture, from an interface (name being the interface) or a file
+type capture struct {
+	name     string
+	reader   packetReader
+	local    localAddresses
+	counters captureCounters
+	triggers chan trigger
+	stop     chan struct{}
+
+	// how often to write the run's stats so far (by the wall clock); zero is only once the run's over
+	statsInterval time.Duration
+}
+
+func newCapture(name string, reader packetReader, local localAddresses) *capture {
+	return &capture{
+		name:   name,
+		reader: reader,
+		local:  local,
 	}
+}
 
-	networkLayer := packet.NetworkLayer()
-	if networkLayer != nil {
-		sourceIP, destinationIP := networkLayer.NetworkFlow().Endpoints()
+// handlePackets decodes each packet (calling back with a decode_error record in place of the usual one for anything
+// that fails to decode) and feeds it to the analyzers, until the reader runs out, fails or it's stopped; the run's
+// stats are the last record however it ends (and every statsInterval before that)
+func (c *capture) handlePackets(config Config, callback func(output Output) error) (err error) {
+	analyzers := getAnalyzers(c.local, config)
 
-		output.PacketData.SourceIP = sourceIP.String()
-		output.PacketData.DestinationIP = destinationIP.String()
+	linkType := c.reader.LinkType()
+	packetDecoder := newDecoder(linkType)
+	stats := newStats()
 
-		output.PacketData.Protocol = networkLayer.LayerType().String()
+	rules, err := newRuleSet(config.Rules, linkType)
+	if err != nil {
+		return err
+	}
+
+	anon, err := newAnonymizer(config.Anonymize)
+	if err != nil {
+		return err
 	}
 
-	transportLayer := packet.TransportLayer()
-	if transportLayer != nil {
-		sourcePort, destinationPort := transportLayer.TransportFlow().Endpoints()
+	var applications *applicationIdentifier
 
-		sourcePortInt, err := strconv.Atoi(sourcePort.String())
+	if config.IdentifyApplications {
+		applications, err = newApplicationIdentifier(config.Applications)
 		if err != nil {
 			return err
 		}
-		output.PacketData.SourcePort = sourcePortInt
+	}
+
+	var ring *ringBuffer
+
+	if config.RingBuffer != nil {
+		ring = newRingBuffer(c.name, linkType, *config.RingBuffer, anon)
+
+		// the analyzers' records can fire triggers too
+		outputCallback := callback
+		callback = func(output Output) error {
+			err := outputCallback(output)
+			if err != nil {
+				return err
+			}
+
+			return ring.handleOutput(output, outputCallback)
+		}
+	}
+
+	// outermost, so nothing (including the triggers' reasons) sees the real addresses
+	if anon != nil {
+		anonymizedCallback := callback
+		callback = func(output Output) error {
+			return anonymizedCallback(anon.output(output))
+		}
+	}
+
+	writeStats := func() error {
+		return callback(Output{
+			Timestamp: time.Now(),
+			Stats:     stats,
+		})
+	}
+
+	defer func() {
+		statsErr := writeStats()
+		if err == nil {
+			err = statsErr
+		}
+	}()
+
+	lastStats := time.Now()
+
+	for {
+		select {
+		case <-c.stop:
+			return nil
+		default:
+		}
+
+		if c.statsInterval > 0 && time.Since(lastStats) >= c.statsInterval {
+			err = writeStats()
+			if err != nil {
+				return err
+			}
+
+			lastStats = time.Now()
+		}
+
+		data, captureInfo, err := c.reader.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			if ring != nil {
+				err = ring.poll(c.triggers, time.Now(), callback)
+				if err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		if err == io.EOF {
+			break
+		}
 
-		destinationPortInt, err := strconv.Atoi(destinationPort.String())
 		if err != nil {
 			return err
 		}
-		output.PacketData.DestinationPort = destinationPortInt
 
-		output.PacketData.Protocol = transportLayer.LayerType().String()
+		if ring != nil {
+			err = ring.add(captureInfo, data, callback)
+			if err != nil {
+				return err
+			}
+
+			err = ring.poll(c.triggers, captureInfo.Timestamp, callback)
+			if err != nil {
+				return err
+			}
+		}
+
+		packetData, decodeErr := packetDecoder.decode(data, captureInfo)
+
+		if applications != nil && decodeErr == nil {
+			packetData.Application = applications.identify(packetData, packetDecoder.innermostTCP(), packetDecoder.innermostUDP())
+		}
+
+		matched, ruleAnalyzers := rules.match(captureInfo, data)
+		packetData.Rules = matched
+
+		stats.update(packetData, decodeErr)
+
+		if decodeErr != nil {
+			atomic.AddUint64(&c.counters.decodeErrors, 1)
+		} else {
+			atomic.AddUint64(&c.counters.decoded, 1)
+		}
+
+		if decodeErr != nil {
+			err = callback(Output{
+				Timestamp:  time.Now(),
+				PacketData: &packetData,
+				DecodeError: &DecodeError{
+					Layer:   packetDecoder.layer,
+					Decoded: packetDecoder.decodedNames(),
+					Error:   decodeErr.Error(),
+					Length:  captureInfo.CaptureLength,
+				},
+			})
+			if err != nil {
+				return err
+			}
+		} else if !config.Aggregate {
+			err = handlePacket(packetData, callback)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(analyzers) == 0 {
+			continue
+		}
+
+		// the analyzers want all the layers (e.g. DNS, DHCP) so they get a lazily decoded packet of their own
+		packet := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		packet.Metadata().CaptureInfo = captureInfo
+		packet.Metadata().Truncated = packetData.Truncated
+
+		for _, a := range analyzers {
+			if !ruleAnalyzers[a.name] {
+				continue
+			}
+
+			err = a.handlePacket(packet, packetData, callback)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	err := callback(output)
-	if err != nil {
-		return err
+	for _, a := range analyzers {
+		err := a.flush(callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	// whatever's pending gets what there is of its window
+	if ring != nil {
+		err = ring.dump(callback)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func Watch(interfaceName, filter string, callback func(output Output) error) error {
-	handle, err := pcap.OpenLive(interfaceName, 1600, true, pcap.BlockForever)
+func openLive(iface InterfaceConfig) (*pcap.Handle, error) {
+	inactiveHandle, err := pcap.NewInactiveHandle(iface.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer inactiveHandle.CleanUp()
+
+	snaplen := defaultSnaplen
+	if iface.Snaplen > 0 {
+		snaplen = iface.Snaplen
+	}
+
+	err = inactiveHandle.SetSnapLen(snaplen)
+	if err != nil {
+		return nil, err
+	}
+
+	promiscuous := true
+	if iface.Promiscuous != nil {
+		promiscuous = *iface.Promiscuous
+	}
+
+	err = inactiveHandle.SetPromisc(promiscuous)
+	if err != nil {
+		return nil, err
+	}
+
+	err = inactiveHandle.SetTimeout(readTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if iface.BufferSize > 0 {
+		err = inactiveHandle.SetBufferSize(iface.BufferSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return inactiveHandle.Activate()
+}
+
+func watchInterface(iface InterfaceConfig, config Config, c *capture, callback func(output Output) error) error {
+	handle, err := openLive(iface)
 	if err != nil {
 		return err
 	}
 
+	defer handle.Close()
+
+	filter := iface.Filter
+	if filter == "" {
+		filter = config.Filter
+	}
+
 	err = handle.SetBPFFilter(filter)
 	if err != nil {
 		return err
 	}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	local, err := getLocalAddresses(iface.Name)
+	if err != nil {
+		return err
+	}
+
+	if config.CaptureStats {
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+
+		// the handle mustn't be closed (by the defer above, so after this one) while it's being asked for its stats
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+
+		interval := scheduler.SecondsToDuration(config.CaptureStatsInterval, defaultCaptureStatsInterval.Seconds())
+
+		go func() {
+			defer close(stopped)
+
+			scheduler.Every(interval, stop, func() {
+				captureStats, err := getCaptureStats(iface.Name, handle, &c.counters)
+				if err != nil {
+					log.Printf("warning: failed to get capture stats for %v: %v", iface.Name, err)
+					return
+				}
+
+				_ = callback(Output{
+					Timestamp:    time.Now(),
+					CaptureStats: captureStats,
+				})
+			})
+		}()
+	}
+
+	c.reader = handle
+	c.local = local
+	c.statsInterval = scheduler.SecondsToDuration(config.StatsInterval, defaultStatsInterval.Seconds())
+
+	return c.handlePackets(config, callback)
+}
+
+// outputQueueSize is how many records can be waiting on the callback before the captures start dropping them (rather
+// than falling behind and having libpcap drop packets instead)
+const outputQueueSize = 4096
+
+type interfaceOutput struct {
+	output   Output
+	counters *captureCounters
+	done     bool
+}
+
+// watchInterfaceUntilStopped watches the interface until stop is closed, logging it and reopening it (after a backoff)
+// whenever it fails rather than giving up on it
+func watchInterfaceUntilStopped(iface InterfaceConfig, config Config, c *capture, callback func(output Output) error) {
+	backoff := minReopenBackoff
+
+	for {
+		started := time.Now()
+
+		err := watchInterface(iface, config, c, callback)
+		if err == nil {
+			return
+		}
+
+		// one that ran for a while before failing starts the backoff again
+		if time.Since(started) > maxReopenBackoff {
+			backoff = minReopenBackoff
+		}
+
+		log.Printf("warning: capture on %v failed (reopening in %v): %v", iface.Name, backoff, err)
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxReopenBackoff {
+			backoff = maxReopenBackoff
+		}
+	}
+}
+
+// WatchInterfaces captures on each of the interfaces concurrently (each with its own analyzers) and calls back with
+// every record tagged with the interface it came from; the callback is only ever called from the calling goroutine,
+// and its errors are counted (in the capture stats) and logged rather than stopping the captures, as are an
+// interface's capture failing (which is reopened, without affecting the others)
+func WatchInterfaces(interfaces []InterfaceConfig, config Config, callback func(output Output) error) error {
+	if len(interfaces) == 0 {
+		return fmt.Errorf("no interfaces configured")
+	}
+
+	names := make(map[string]bool)
+
+	for _, iface := range interfaces {
+		if names[iface.Name] {
+			return fmt.Errorf("duplicate interface %#+v", iface.Name)
+		}
+
+		names[iface.Name] = true
+	}
+
+	hub := &triggerHub{}
+
+	if config.RingBuffer != nil {
+		var err error
+
+		hub, err = startTriggers(*config.RingBuffer)
+		if err != nil {
+			return err
+		}
+	}
+
+	outputs := make(chan interfaceOutput, outputQueueSize)
+
+	// the captures all stop when we return (so none of them are left blocked on a full queue)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for _, iface := range interfaces {
+		go func(iface InterfaceConfig) {
+			c := &capture{
+				name:     iface.Name,
+				triggers: hub.subscribe(),
+				stop:     stop,
+			}
+
+			counters := &c.counters
+
+			watchInterfaceUntilStopped(iface, config, c, func(output Output) error {
+				output.Interface = iface.Name
+
+				select {
+				case outputs <- interfaceOutput{output: output, counters: counters}:
+				default:
+					atomic.AddUint64(&counters.queueDrops, 1)
+				}
+
+				return nil
+			})
+
+			select {
+			case outputs <- interfaceOutput{done: true}:
+			case <-stop:
+			}
+		}(iface)
+	}
+
+	remaining := len(interfaces)
+
+	for o := range outputs {
+		if o.done {
+			remaining--
+			if remaining == 0 {
+				break
+			}
 
-	for packet := range packetSource.Packets() {
-		err = handlePacket(packet, callback)
+			continue
+		}
+
+		err := callback(o.output)
 		if err != nil {
-			panic(err)
+			atomic.AddUint64(&o.counters.callbackErrors, 1)
+
+			log.Printf("warning: callback failed for %v: %v", o.output.Interface, err)
 		}
 	}
 
 	return nil
 }
+
+// Watch captures on a single interface with the default capture settings
+func Watch(interfaceName string, config Config, callback func(output Output) error) error {
+	return WatchInterfaces([]InterfaceConfig{{Name: interfaceName}}, config, callback)
+}
+
+// ReadFile is like Watch but for a previously captured pcap file (e.g. for testing against recorded captures); as
+// there's no interface, nothing is considered local
+func ReadFile(path string, config Config, callback func(output Output) error) error {
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return err
+	}
+
+	defer handle.Close()
+
+	err = handle.SetBPFFilter(config.Filter)
+	if err != nil {
+		return err
+	}
+
+	return newCapture("", handle, newLocalAddresses()).handlePackets(config, callback)
+}
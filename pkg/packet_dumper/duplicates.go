@@ -0,0 +1,261 @@
+package packet_dumper
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/initialed85/drive_test/internal/fingerprint"
+	"github.com/initialed85/drive_test/internal/probe_stats"
+	"sort"
+	"time"
+)
+
+const (
+	duplicateEventExceeded = "exceeded"
+	duplicateEventCleared  = "cleared"
+
+	defaultDuplicateWindow    = 100 * time.Millisecond
+	defaultDuplicateThreshold = 1.0
+
+	// how much of the IP payload goes into a fingerprint
+	duplicateHashBytes = 64
+
+	// too few packets in an interval to say anything about its duplicate rate
+	duplicateMinimumPackets = 20
+
+	duplicateTopFlows = 5
+)
+
+type DuplicateFlow struct {
+	Protocol      string `json:"protocol"`
+	SourceIP      string `json:"source_ip"`
+	DestinationIP string `json:"destination_ip"`
+	Duplicates    int    `json:"duplicates"`
+}
+
+type DuplicateInterval struct {
+	IntervalStart    time.Time           `json:"interval_start"`
+	IntervalEnd      time.Time           `json:"interval_end"`
+	Packets          int                 `json:"packets"`
+	Duplicates       int                 `json:"duplicates"`
+	DuplicatePercent float64             `json:"duplicate_percent"`
+	Looped           int                 `json:"looped"`
+	MaxTTLDecrement  int                 `json:"max_ttl_decrement"`
+	Delay            probe_stats.Summary `json:"delay"`
+	TopFlows         []DuplicateFlow     `json:"top_flows"`
+}
+
+type DuplicateAlert struct {
+	Event            string    `json:"event"`
+	IntervalStart    time.Time `json:"interval_start"`
+	IntervalEnd      time.Time `json:"interval_end"`
+	DuplicatePercent float64   `json:"duplicate_percent"`
+	Threshold        float64   `json:"threshold_percent"`
+	Looped           int       `json:"looped"`
+}
+
+type duplicateOriginal struct {
+	timestamp time.Time
+	ttl       int
+}
+
+type duplicateSeen struct {
+	fingerprint uint64
+	timestamp   time.Time
+}
+
+// duplicateDetector fingerprints IP packets (that can be told apart from one sent again on purpose, so not e.g. IPv6
+// pure ACKs or neighbour discovery) and counts the ones seen again within the window as duplicates (with
+// their delay from the original and how much lower their TTL / hop limit is, a decrement meaning the packet went
+// around a loop), calling back with the duplicate rate per interval and when it goes above or back below the threshold
+type duplicateDetector struct {
+	clock     intervalClock
+	window    time.Duration
+	threshold float64
+	seen      map[uint64]duplicateOriginal
+	queue     []duplicateSeen
+	exceeded  bool
+	packets   int
+	looped    int
+	maxTTL    int
+	delays    []float64
+	flows     map[string]*DuplicateFlow
+}
+
+func newDuplicateDetector(interval time.Duration, window time.Duration, threshold float64) *duplicateDetector {
+	return &duplicateDetector{
+		clock:     newIntervalClock(interval),
+		window:    window,
+		threshold: threshold,
+		seen:      make(map[uint64]duplicateOriginal),
+		queue:     make([]duplicateSeen, 0),
+		delays:    make([]float64, 0),
+		flows:     make(map[string]*DuplicateFlow),
+	}
+}
+
+func (d *duplicateDetector) emit(start time.Time, callback func(output Output) error) error {
+	record := DuplicateInterval{
+		IntervalStart:   start,
+		IntervalEnd:     start.Add(d.clock.interval),
+		Packets:         d.packets,
+		Duplicates:      len(d.delays),
+		Looped:          d.looped,
+		MaxTTLDecrement: d.maxTTL,
+		Delay:           probe_stats.Summarise(d.delays),
+		TopFlows:        make([]DuplicateFlow, 0),
+	}
+
+	if record.Packets > 0 {
+		record.DuplicatePercent = float64(record.Duplicates) / float64(record.Packets) * 100
+	}
+
+	for _, flow := range d.flows {
+		record.TopFlows = append(record.TopFlows, *flow)
+	}
+
+	sort.Slice(record.TopFlows, func(i, j int) bool {
+		if record.TopFlows[i].Duplicates != record.TopFlows[j].Duplicates {
+			return record.TopFlows[i].Duplicates > record.TopFlows[j].Duplicates
+		}
+
+		return record.TopFlows[i].SourceIP+record.TopFlows[i].DestinationIP < record.TopFlows[j].SourceIP+record.TopFlows[j].DestinationIP
+	})
+
+	if len(record.TopFlows) > duplicateTopFlows {
+		record.TopFlows = record.TopFlows[:duplicateTopFlows]
+	}
+
+	d.packets = 0
+	d.looped = 0
+	d.maxTTL = 0
+	d.delays = make([]float64, 0)
+	d.flows = make(map[string]*DuplicateFlow)
+
+	err := callback(Output{
+		Timestamp:  time.Now(),
+		Duplicates: &record,
+	})
+	if err != nil {
+		return err
+	}
+
+	if record.Packets < duplicateMinimumPackets {
+		return nil
+	}
+
+	exceeded := record.DuplicatePercent >= d.threshold
+	if exceeded == d.exceeded {
+		return nil
+	}
+
+	d.exceeded = exceeded
+
+	alert := DuplicateAlert{
+		Event:            duplicateEventCleared,
+		IntervalStart:    record.IntervalStart,
+		IntervalEnd:      record.IntervalEnd,
+		DuplicatePercent: record.DuplicatePercent,
+		Threshold:        d.threshold,
+		Looped:           record.Looped,
+	}
+
+	if exceeded {
+		alert.Event = duplicateEventExceeded
+	}
+
+	return callback(Output{
+		Timestamp:      time.Now(),
+		DuplicateAlert: &alert,
+	})
+}
+
+func (d *duplicateDetector) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	for _, start := range d.clock.advance(packetData.Timestamp) {
+		err := d.emit(start, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	// an 802.11 retry is the same frame again on purpose
+	dot11Layer := packet.Layer(layers.LayerTypeDot11)
+	if dot11Layer != nil && dot11Layer.(*layers.Dot11).Flags.Retry() {
+		return nil
+	}
+
+	// what's captured of a packet is the same for its duplicates, so it doesn't matter if that's not all of it
+	f, ok := fingerprint.Get(packet, duplicateHashBytes)
+	if !ok {
+		return nil
+	}
+
+	// nothing to tell a duplicate from the same packet sent again on purpose (e.g. an IPv6 duplicate ACK)
+	if !f.Distinct {
+		return nil
+	}
+
+	timestamp := packetData.Timestamp
+
+	expired := 0
+	for _, seen := range d.queue {
+		if timestamp.Sub(seen.timestamp) <= d.window {
+			break
+		}
+
+		delete(d.seen, seen.fingerprint)
+
+		expired++
+	}
+
+	d.queue = d.queue[expired:]
+
+	d.packets++
+
+	original, ok := d.seen[f.Key]
+	if !ok {
+		d.seen[f.Key] = duplicateOriginal{
+			timestamp: timestamp,
+			ttl:       f.TTL,
+		}
+		d.queue = append(d.queue, duplicateSeen{f.Key, timestamp})
+
+		return nil
+	}
+
+	d.delays = append(d.delays, probe_stats.Milliseconds(timestamp.Sub(original.timestamp)))
+
+	decrement := original.ttl - f.TTL
+	if decrement > 0 {
+		d.looped++
+	}
+
+	if decrement > d.maxTTL {
+		d.maxTTL = decrement
+	}
+
+	key := fmt.Sprintf("%v/%v/%v", packetData.Protocol, packetData.SourceIP, packetData.DestinationIP)
+
+	flow, ok := d.flows[key]
+	if !ok {
+		flow = &DuplicateFlow{
+			Protocol:      packetData.Protocol,
+			SourceIP:      packetData.SourceIP,
+			DestinationIP: packetData.DestinationIP,
+		}
+		d.flows[key] = flow
+	}
+
+	flow.Duplicates++
+
+	return nil
+}
+
+// flush emits the partially complete interval (if any packets have been seen)
+func (d *duplicateDetector) flush(callback func(output Output) error) error {
+	if !d.clock.started() {
+		return nil
+	}
+
+	return d.emit(d.clock.start, callback)
+}
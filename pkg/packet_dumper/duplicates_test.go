@@ -0,0 +1,244 @@
+package packet_dumper
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	duplicateTestStart = time.Unix(1600000000, 0)
+
+	duplicateTestSourceIPv6      = net.ParseIP("2001:db8::1")
+	duplicateTestDestinationIPv6 = net.ParseIP("2001:db8::2")
+)
+
+func serializePacket(t *testing.T, networkLayer gopacket.NetworkLayer, serializableLayers ...gopacket.SerializableLayer) gopacket.Packet {
+	t.Helper()
+
+	ethernetType := layers.EthernetTypeIPv4
+	if networkLayer.LayerType() == layers.LayerTypeIPv6 {
+		ethernetType = layers.EthernetTypeIPv6
+	}
+
+	ethernet := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: ethernetType,
+	}
+
+	for _, l := range serializableLayers {
+		switch transport := l.(type) {
+		case *layers.TCP:
+			_ = transport.SetNetworkLayerForChecksum(networkLayer)
+		case *layers.UDP:
+			_ = transport.SetNetworkLayerForChecksum(networkLayer)
+		case *layers.ICMPv6:
+			_ = transport.SetNetworkLayerForChecksum(networkLayer)
+		}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+
+	err := gopacket.SerializeLayers(
+		buf,
+		gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		append([]gopacket.SerializableLayer{ethernet, networkLayer.(gopacket.SerializableLayer)}, serializableLayers...)...,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+}
+
+func udpv4Packet(t *testing.T, id uint16, ttl uint8) gopacket.Packet {
+	t.Helper()
+
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		Id:       id,
+		TTL:      ttl,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(192, 0, 2, 1),
+		DstIP:    net.IPv4(192, 0, 2, 2),
+	}
+
+	return serializePacket(t, ip, &layers.UDP{SrcPort: 5004, DstPort: 5004}, gopacket.Payload("the same payload"))
+}
+
+func ipv6Header(protocol layers.IPProtocol) *layers.IPv6 {
+	return &layers.IPv6{
+		Version:    6,
+		FlowLabel:  0x12345,
+		NextHeader: protocol,
+		HopLimit:   64,
+		SrcIP:      duplicateTestSourceIPv6,
+		DstIP:      duplicateTestDestinationIPv6,
+	}
+}
+
+type duplicateTestPacket struct {
+	offset time.Duration
+	packet gopacket.Packet
+}
+
+func runDuplicateDetector(t *testing.T, packets []duplicateTestPacket) ([]*DuplicateInterval, []*DuplicateAlert) {
+	t.Helper()
+
+	intervals := make([]*DuplicateInterval, 0)
+	alerts := make([]*DuplicateAlert, 0)
+
+	callback := func(output Output) error {
+		if output.Duplicates != nil {
+			intervals = append(intervals, output.Duplicates)
+		}
+
+		if output.DuplicateAlert != nil {
+			alerts = append(alerts, output.DuplicateAlert)
+		}
+
+		return nil
+	}
+
+	d := newDuplicateDetector(time.Second, defaultDuplicateWindow, defaultDuplicateThreshold)
+
+	for _, p := range packets {
+		packetData := PacketData{
+			Timestamp: duplicateTestStart.Add(p.offset),
+			Protocol:  "UDP",
+		}
+
+		networkLayer := p.packet.NetworkLayer()
+		if networkLayer != nil {
+			packetData.SourceIP = networkLayer.NetworkFlow().Src().String()
+			packetData.DestinationIP = networkLayer.NetworkFlow().Dst().String()
+		}
+
+		err := d.handlePacket(p.packet, packetData, callback)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := d.flush(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return intervals, alerts
+}
+
+// TestDuplicateDetector has 30 packets in the first second with one of them seen again 5ms later with a lower TTL (a
+// loop), another seen again 2ms later and another seen again outside the window, then 30 packets without duplicates
+// in the next second and too few packets to alert on (all duplicated) in the third
+func TestDuplicateDetector(t *testing.T) {
+	packets := make([]duplicateTestPacket, 0)
+
+	for i := 0; i < 30; i++ {
+		offset := time.Duration(i) * time.Millisecond * 10
+		packets = append(packets, duplicateTestPacket{offset, udpv4Packet(t, uint16(i), 64)})
+
+		switch i {
+		case 3:
+			packets = append(packets, duplicateTestPacket{offset + time.Millisecond*5, udpv4Packet(t, uint16(i), 63)})
+		case 4:
+			packets = append(packets, duplicateTestPacket{offset + time.Millisecond*2, udpv4Packet(t, uint16(i), 64)})
+		}
+	}
+
+	packets = append(packets, duplicateTestPacket{time.Millisecond * 500, udpv4Packet(t, 5, 64)})
+
+	for i := 0; i < 30; i++ {
+		packets = append(packets, duplicateTestPacket{time.Second + time.Duration(i)*time.Millisecond*10, udpv4Packet(t, uint16(100+i), 64)})
+	}
+
+	for i := 0; i < 5; i++ {
+		offset := time.Second*2 + time.Duration(i)*time.Millisecond*10
+		packets = append(packets, duplicateTestPacket{offset, udpv4Packet(t, uint16(200+i), 64)})
+		packets = append(packets, duplicateTestPacket{offset + time.Millisecond, udpv4Packet(t, uint16(200+i), 64)})
+	}
+
+	intervals, alerts := runDuplicateDetector(t, packets)
+
+	if len(intervals) != 3 {
+		t.Fatalf("got %v intervals, want 3", len(intervals))
+	}
+
+	first := intervals[0]
+
+	if first.Packets != 33 || first.Duplicates != 2 || first.Looped != 1 || first.MaxTTLDecrement != 1 {
+		t.Errorf("got %+v, want 33 packets, 2 duplicates, 1 looped with a TTL decrement of 1", *first)
+	}
+
+	if first.Delay.Min != 2 || first.Delay.Max != 5 {
+		t.Errorf("got delay %+v, want 2ms to 5ms", first.Delay)
+	}
+
+	if len(first.TopFlows) != 1 || first.TopFlows[0].Duplicates != 2 || first.TopFlows[0].SourceIP != "192.0.2.1" {
+		t.Errorf("got top flows %+v, want 192.0.2.1 to 192.0.2.2 with 2 duplicates", first.TopFlows)
+	}
+
+	if intervals[1].Packets != 30 || intervals[1].Duplicates != 0 || intervals[1].DuplicatePercent != 0 {
+		t.Errorf("got %+v, want 30 packets without duplicates", *intervals[1])
+	}
+
+	if intervals[2].Packets != 10 || intervals[2].Duplicates != 5 {
+		t.Errorf("got %+v, want 10 packets, 5 duplicates", *intervals[2])
+	}
+
+	if len(alerts) != 2 {
+		t.Fatalf("got %v alerts, want 2", len(alerts))
+	}
+
+	if alerts[0].Event != duplicateEventExceeded || !alerts[0].IntervalStart.Equal(duplicateTestStart) || alerts[0].Looped != 1 {
+		t.Errorf("got %+v, want exceeded for the first interval with 1 looped", *alerts[0])
+	}
+
+	if alerts[1].Event != duplicateEventCleared || !alerts[1].IntervalStart.Equal(duplicateTestStart.Add(time.Second)) {
+		t.Errorf("got %+v, want cleared for the second interval", *alerts[1])
+	}
+}
+
+// TestDuplicateDetectorIPv6 has IPv6 packets sent twice on purpose (a duplicate ACK and a neighbour solicitation) that
+// must not count as duplicates, and a UDP packet with a payload that must
+func TestDuplicateDetectorIPv6(t *testing.T) {
+	ack := func() gopacket.Packet {
+		return serializePacket(t, ipv6Header(layers.IPProtocolTCP), &layers.TCP{
+			SrcPort: 40000, DstPort: 443, Seq: 1000, Ack: 2000, ACK: true, Window: 512,
+		})
+	}
+
+	solicitation := func() gopacket.Packet {
+		return serializePacket(
+			t,
+			ipv6Header(layers.IPProtocolICMPv6),
+			&layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0)},
+			&layers.ICMPv6NeighborSolicitation{TargetAddress: duplicateTestDestinationIPv6},
+		)
+	}
+
+	datagram := func() gopacket.Packet {
+		return serializePacket(t, ipv6Header(layers.IPProtocolUDP), &layers.UDP{SrcPort: 5004, DstPort: 5004}, gopacket.Payload("the same payload"))
+	}
+
+	intervals, _ := runDuplicateDetector(t, []duplicateTestPacket{
+		{0, ack()},
+		{time.Millisecond, ack()},
+		{time.Millisecond * 2, solicitation()},
+		{time.Millisecond * 3, solicitation()},
+		{time.Millisecond * 4, datagram()},
+		{time.Millisecond * 5, datagram()},
+	})
+
+	if len(intervals) != 1 {
+		t.Fatalf("got %v intervals, want 1", len(intervals))
+	}
+
+	if intervals[0].Packets != 2 || intervals[0].Duplicates != 1 {
+		t.Errorf("got %+v, want only the 2 UDP packets checked and 1 duplicate", *intervals[0])
+	}
+}
@@ -0,0 +1,44 @@
+package packet_dumper
+
+import (
+	"time"
+)
+
+const defaultInterval = time.Second
+
+// intervalClock is driven by packet timestamps (rather than the wall clock) so that aggregated
+// records line up with when packets were actually captured
+type intervalClock struct {
+	interval time.Duration
+	start    time.Time
+}
+
+func newIntervalClock(interval time.Duration) intervalClock {
+	return intervalClock{
+		interval: interval,
+	}
+}
+
+// advance moves the clock up to timestamp and returns the start of every interval that has been
+// completed along the way (including empty ones, so time series have no gaps)
+func (c *intervalClock) advance(timestamp time.Time) []time.Time {
+	if c.start.IsZero() {
+		c.start = timestamp.Truncate(c.interval)
+
+		return nil
+	}
+
+	completed := make([]time.Time, 0)
+
+	for !timestamp.Before(c.start.Add(c.interval)) {
+		completed = append(completed, c.start)
+
+		c.start = c.start.Add(c.interval)
+	}
+
+	return completed
+}
+
+func (c *intervalClock) started() bool {
+	return !c.start.IsZero()
+}
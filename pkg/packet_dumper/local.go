@@ -0,0 +1,100 @@
+package packet_dumper
+
+import (
+	"net"
+	"strings"
+)
+
+const (
+	directionRX    = "rx"
+	directionTX    = "tx"
+	directionOther = "other"
+)
+
+// localAddresses are the MAC and IP addresses belonging to the capture interface
+type localAddresses struct {
+	macs map[string]bool
+	ips  map[string]bool
+}
+
+func newLocalAddresses() localAddresses {
+	return localAddresses{
+		macs: make(map[string]bool),
+		ips:  make(map[string]bool),
+	}
+}
+
+func getLocalAddresses(interfaceName string) (localAddresses, error) {
+	local := newLocalAddresses()
+
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return local, err
+	}
+
+	if len(iface.HardwareAddr) > 0 {
+		local.macs[iface.HardwareAddr.String()] = true
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return local, err
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		local.ips[ipNet.IP.String()] = true
+	}
+
+	return local, nil
+}
+
+func (l *localAddresses) isLocal(mac, ip string) bool {
+	return l.macs[strings.ToLower(mac)] || l.ips[ip]
+}
+
+// addIP / removeIP let analyzers that learn the interface's addresses as they change (e.g. from DHCP) keep the
+// shared set up to date
+func (l *localAddresses) addIP(ip string) {
+	l.ips[ip] = true
+}
+
+func (l *localAddresses) removeIP(ip string) {
+	delete(l.ips, ip)
+}
+
+func isGroupAddress(mac, ip string) bool {
+	hardwareAddr, err := net.ParseMAC(mac)
+	if err == nil && len(hardwareAddr) > 0 && hardwareAddr[0]&0x01 == 0x01 {
+		return true
+	}
+
+	parsedIP := net.ParseIP(ip)
+	if parsedIP != nil && (parsedIP.IsMulticast() || parsedIP.Equal(net.IPv4bcast)) {
+		return true
+	}
+
+	return false
+}
+
+// direction classifies a packet relative to the capture interface; anything neither sent by nor
+// addressed to the interface (e.g. seen in promiscuous mode) is "other"
+func (l *localAddresses) direction(packetData PacketData) string {
+	if l.isLocal(packetData.SourceMAC, packetData.SourceIP) {
+		return directionTX
+	}
+
+	if l.isLocal(packetData.DestinationMAC, packetData.DestinationIP) {
+		return directionRX
+	}
+
+	if isGroupAddress(packetData.DestinationMAC, packetData.DestinationIP) {
+		return directionRX
+	}
+
+	return directionOther
+}
@@ -0,0 +1,484 @@
+package packet_dumper
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	multicastEventJoined      = "joined"
+	multicastEventLeft        = "left"
+	multicastEventExpired     = "expired"
+	multicastEventFirstPacket = "first_packet"
+	multicastEventStalled     = "stalled"
+	multicastEventResumed     = "resumed"
+
+	defaultMulticastTimeout = 10 * time.Second
+
+	// the default group membership interval (robustness 2 x query interval 125s + query response interval 10s)
+	defaultMulticastMembershipTimeout = 260 * time.Second
+
+	// how often (in packet time) memberships and groups are checked for having timed out
+	multicastExpireInterval = time.Second
+)
+
+type Multicast struct {
+	Event             string     `json:"event"`
+	Protocol          string     `json:"protocol,omitempty"`
+	Group             string     `json:"group"`
+	Host              string     `json:"host,omitempty"`
+	Sources           []string   `json:"sources,omitempty"`
+	ExcludedSources   []string   `json:"excluded_sources,omitempty"`
+	Members           int        `json:"members"`
+	JoinTime          *time.Time `json:"join_time,omitempty"`
+	SourceIP          string     `json:"source_ip,omitempty"`
+	JoinToFirstPacket *float64   `json:"join_to_first_packet_ms,omitempty"`
+	LastPacket        *time.Time `json:"last_packet,omitempty"`
+	Gap               *float64   `json:"gap_ms,omitempty"`
+	Time              time.Time  `json:"time"`
+}
+
+const (
+	// the host's filter mode is now include (only the sources wanted, none being a leave) or exclude (every source but
+	// those, none being every source), as with IGMPv1 / v2 and MLDv1 (which are exclude for a join, include for a leave)
+	multicastChangeInclude = iota
+	multicastChangeExclude
+
+	// the sources are wanted (or not) from now on, whatever the filter mode
+	multicastChangeAllow
+	multicastChangeBlock
+)
+
+// multicastReport is a change to a host's membership of a group from a report it sent, from any version of IGMP or MLD
+type multicastReport struct {
+	protocol string
+	group    string
+	change   int
+	sources  []string
+}
+
+type multicastMembership struct {
+	protocol    string
+	joined      time.Time
+	lastReport  time.Time
+	include     bool
+	sources     map[string]bool
+	firstPacket bool
+}
+
+type multicastGroup struct {
+	members    map[string]*multicastMembership
+	since      time.Time
+	lastPacket time.Time
+	stalled    bool
+}
+
+// multicastTracker follows group membership per host from IGMP and MLD reports and calls back when a host joins or
+// leaves a group (or its membership isn't refreshed in time), when a host's first packet for a group turns up after it
+// joined (with how long that took) and when a group with members stops getting traffic for the timeout (and when it
+// starts again); link-local groups (224.0.0.0/24, ff02::/16) are left out, as hosts join them regardless of traffic
+type multicastTracker struct {
+	local             localAddresses
+	timeout           time.Duration
+	membershipTimeout time.Duration
+	groups            map[string]*multicastGroup
+	lastExpire        time.Time
+}
+
+func newMulticastTracker(local localAddresses, timeout time.Duration, membershipTimeout time.Duration) *multicastTracker {
+	return &multicastTracker{
+		local:             local,
+		timeout:           timeout,
+		membershipTimeout: membershipTimeout,
+		groups:            make(map[string]*multicastGroup),
+	}
+}
+
+func trackedGroup(ip net.IP) bool {
+	return ip != nil && ip.IsMulticast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+func ipStrings(ips []net.IP) []string {
+	values := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		values = append(values, ip.String())
+	}
+
+	return values
+}
+
+// groupRecord turns an IGMPv3 / MLDv2 group record (which share their types) into a report
+func groupRecord(protocol string, recordType int, group net.IP, sources []net.IP) multicastReport {
+	report := multicastReport{
+		protocol: protocol,
+		group:    group.String(),
+		sources:  ipStrings(sources),
+	}
+
+	switch layers.IGMPv3GroupRecordType(recordType) {
+	case layers.IGMPIsIn, layers.IGMPToIn:
+		report.change = multicastChangeInclude
+	case layers.IGMPIsEx, layers.IGMPToEx:
+		report.change = multicastChangeExclude
+	case layers.IGMPAllow:
+		report.change = multicastChangeAllow
+	case layers.IGMPBlock:
+		report.change = multicastChangeBlock
+	}
+
+	return report
+}
+
+func getMulticastReports(packet gopacket.Packet) []multicastReport {
+	reports := make([]multicastReport, 0)
+
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.IGMPv1or2:
+			switch l.Type {
+			case layers.IGMPMembershipReportV1:
+				reports = append(reports, multicastReport{protocol: "igmpv1", group: l.GroupAddress.String(), change: multicastChangeExclude})
+			case layers.IGMPMembershipReportV2:
+				reports = append(reports, multicastReport{protocol: "igmpv2", group: l.GroupAddress.String(), change: multicastChangeExclude})
+			case layers.IGMPLeaveGroup:
+				reports = append(reports, multicastReport{protocol: "igmpv2", group: l.GroupAddress.String(), change: multicastChangeInclude})
+			}
+		case *layers.IGMP:
+			if l.Type != layers.IGMPMembershipReportV3 {
+				continue
+			}
+
+			for _, record := range l.GroupRecords {
+				reports = append(reports, groupRecord("igmpv3", int(record.Type), record.MulticastAddress, record.SourceAddresses))
+			}
+		case *layers.MLDv1MulticastListenerReportMessage:
+			reports = append(reports, multicastReport{protocol: "mldv1", group: l.MulticastAddress.String(), change: multicastChangeExclude})
+		case *layers.MLDv1MulticastListenerDoneMessage:
+			reports = append(reports, multicastReport{protocol: "mldv1", group: l.MulticastAddress.String(), change: multicastChangeInclude})
+		case *layers.MLDv2MulticastListenerReportMessage:
+			for _, record := range l.MulticastAddressRecords {
+				reports = append(reports, groupRecord("mldv2", int(record.RecordType), record.MulticastAddress, record.SourceAddresses))
+			}
+		}
+	}
+
+	tracked := make([]multicastReport, 0, len(reports))
+	for _, report := range reports {
+		if trackedGroup(net.ParseIP(report.group)) {
+			tracked = append(tracked, report)
+		}
+	}
+
+	return tracked
+}
+
+func membershipPacket(packet gopacket.Packet) bool {
+	for _, layerType := range []gopacket.LayerType{
+		layers.LayerTypeIGMP,
+		layers.LayerTypeMLDv1MulticastListenerQuery,
+		layers.LayerTypeMLDv1MulticastListenerReport,
+		layers.LayerTypeMLDv1MulticastListenerDone,
+		layers.LayerTypeMLDv2MulticastListenerQuery,
+		layers.LayerTypeMLDv2MulticastListenerReport,
+	} {
+		if packet.Layer(layerType) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *multicastTracker) record(event string, group string, host string, timestamp time.Time) Multicast {
+	multicast := Multicast{
+		Event: event,
+		Group: group,
+		Host:  host,
+		Time:  timestamp,
+	}
+
+	g, ok := m.groups[group]
+	if ok {
+		multicast.Members = len(g.members)
+	}
+
+	return multicast
+}
+
+func (m *multicastTracker) emit(multicast Multicast, callback func(output Output) error) error {
+	return callback(Output{
+		Timestamp: time.Now(),
+		Multicast: &multicast,
+	})
+}
+
+// setSources fills in the sources a membership wants (or doesn't want, in exclude mode)
+func setSources(multicast *Multicast, membership *multicastMembership) {
+	sources := make([]string, 0, len(membership.sources))
+	for source := range membership.sources {
+		sources = append(sources, source)
+	}
+
+	sort.Strings(sources)
+
+	if membership.include {
+		multicast.Sources = sources
+	} else {
+		multicast.ExcludedSources = sources
+	}
+}
+
+// wants is whether the membership is for traffic from the source
+func (membership *multicastMembership) wants(source string) bool {
+	return membership.sources[source] == membership.include
+}
+
+func (m *multicastTracker) leave(group string, host string, event string, timestamp time.Time, callback func(output Output) error) error {
+	g := m.groups[group]
+	membership := g.members[host]
+
+	delete(g.members, host)
+	if len(g.members) == 0 {
+		delete(m.groups, group)
+	}
+
+	multicast := m.record(event, group, host, timestamp)
+	multicast.Protocol = membership.protocol
+	multicast.JoinTime = &membership.joined
+
+	return m.emit(multicast, callback)
+}
+
+// expire drops memberships that haven't been reported for the membership timeout and flags groups gone quiet, at most
+// once per expire interval (as it's every packet on the link that comes through here)
+func (m *multicastTracker) expire(timestamp time.Time, callback func(output Output) error) error {
+	if timestamp.Sub(m.lastExpire) < multicastExpireInterval {
+		return nil
+	}
+
+	m.lastExpire = timestamp
+
+	groups := make([]string, 0, len(m.groups))
+	for group := range m.groups {
+		groups = append(groups, group)
+	}
+
+	sort.Strings(groups)
+
+	for _, group := range groups {
+		g := m.groups[group]
+
+		hosts := make([]string, 0, len(g.members))
+		for host, membership := range g.members {
+			if timestamp.Sub(membership.lastReport) > m.membershipTimeout {
+				hosts = append(hosts, host)
+			}
+		}
+
+		sort.Strings(hosts)
+
+		for _, host := range hosts {
+			err := m.leave(group, host, multicastEventExpired, timestamp, callback)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(g.members) == 0 || g.stalled {
+			continue
+		}
+
+		quietSince := g.since
+		if g.lastPacket.After(quietSince) {
+			quietSince = g.lastPacket
+		}
+
+		if timestamp.Sub(quietSince) <= m.timeout {
+			continue
+		}
+
+		g.stalled = true
+
+		multicast := m.record(multicastEventStalled, group, "", timestamp)
+		if !g.lastPacket.IsZero() {
+			lastPacket := g.lastPacket
+			multicast.LastPacket = &lastPacket
+		}
+		multicast.Gap = durationPointer(quietSince, timestamp)
+
+		err := m.emit(multicast, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleReport applies a report to the host's filter mode and sources as in RFC 3376 section 6.4 (but per host, so a
+// current state or filter mode change record is the whole of its state rather than being merged with other hosts')
+func (m *multicastTracker) handleReport(report multicastReport, host string, timestamp time.Time, callback func(output Output) error) error {
+	g, ok := m.groups[report.group]
+
+	var membership *multicastMembership
+	if ok {
+		membership = g.members[host]
+	}
+
+	// not being a member is the same as including no sources
+	include := true
+	sources := make(map[string]bool)
+
+	if membership != nil {
+		include = membership.include
+		for source := range membership.sources {
+			sources[source] = true
+		}
+	}
+
+	switch report.change {
+	case multicastChangeInclude, multicastChangeExclude:
+		include = report.change == multicastChangeInclude
+		sources = make(map[string]bool)
+		for _, source := range report.sources {
+			sources[source] = true
+		}
+	case multicastChangeAllow, multicastChangeBlock:
+		// allowing sources adds them to an include or takes them out of an exclude, and blocking is the opposite
+		for _, source := range report.sources {
+			if (report.change == multicastChangeAllow) == include {
+				sources[source] = true
+			} else {
+				delete(sources, source)
+			}
+		}
+	}
+
+	if include && len(sources) == 0 {
+		if membership == nil {
+			return nil
+		}
+
+		return m.leave(report.group, host, multicastEventLeft, timestamp, callback)
+	}
+
+	if membership != nil {
+		membership.lastReport = timestamp
+		membership.protocol = report.protocol
+		membership.include = include
+		membership.sources = sources
+
+		return nil
+	}
+
+	if !ok {
+		g = &multicastGroup{
+			members: make(map[string]*multicastMembership),
+			since:   timestamp,
+		}
+		m.groups[report.group] = g
+	}
+
+	membership = &multicastMembership{
+		protocol:   report.protocol,
+		joined:     timestamp,
+		lastReport: timestamp,
+		include:    include,
+		sources:    sources,
+	}
+
+	g.members[host] = membership
+
+	multicast := m.record(multicastEventJoined, report.group, host, timestamp)
+	multicast.Protocol = report.protocol
+	setSources(&multicast, membership)
+
+	return m.emit(multicast, callback)
+}
+
+func (m *multicastTracker) handleTraffic(packetData PacketData, callback func(output Output) error) error {
+	g, ok := m.groups[packetData.DestinationIP]
+	if !ok || m.local.isLocal(packetData.SourceMAC, packetData.SourceIP) {
+		return nil
+	}
+
+	timestamp := packetData.Timestamp
+
+	if g.stalled {
+		g.stalled = false
+
+		quietSince := g.since
+		if g.lastPacket.After(quietSince) {
+			quietSince = g.lastPacket
+		}
+
+		multicast := m.record(multicastEventResumed, packetData.DestinationIP, "", timestamp)
+		multicast.SourceIP = packetData.SourceIP
+		multicast.Gap = durationPointer(quietSince, timestamp)
+
+		err := m.emit(multicast, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	g.lastPacket = timestamp
+
+	hosts := make([]string, 0, len(g.members))
+	for host, membership := range g.members {
+		if membership.firstPacket || !membership.wants(packetData.SourceIP) {
+			continue
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		membership := g.members[host]
+		membership.firstPacket = true
+
+		multicast := m.record(multicastEventFirstPacket, packetData.DestinationIP, host, timestamp)
+		multicast.Protocol = membership.protocol
+		setSources(&multicast, membership)
+		multicast.JoinTime = &membership.joined
+		multicast.SourceIP = packetData.SourceIP
+		multicast.JoinToFirstPacket = durationPointer(membership.joined, timestamp)
+
+		err := m.emit(multicast, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *multicastTracker) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	err := m.expire(packetData.Timestamp, callback)
+	if err != nil {
+		return err
+	}
+
+	// reports and queries are often sent to the group itself, so they aren't traffic for it
+	if !membershipPacket(packet) {
+		return m.handleTraffic(packetData, callback)
+	}
+
+	for _, report := range getMulticastReports(packet) {
+		err = m.handleReport(report, packetData.SourceIP, packetData.Timestamp, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *multicastTracker) flush(callback func(output Output) error) error {
+	return nil
+}
@@ -0,0 +1,307 @@
+package packet_dumper
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const (
+	multicastTestGroup = "239.1.1.1"
+	multicastTestHost  = "10.0.0.1"
+	multicastTestS1    = "10.0.1.1"
+	multicastTestS2    = "10.0.1.2"
+)
+
+var multicastTestStart = time.Unix(1600000000, 0)
+
+func collectMulticast(records *[]Multicast) func(output Output) error {
+	return func(output Output) error {
+		if output.Multicast != nil {
+			*records = append(*records, *output.Multicast)
+		}
+
+		return nil
+	}
+}
+
+func multicastEvents(records []Multicast) []string {
+	events := make([]string, 0, len(records))
+	for _, record := range records {
+		events = append(events, record.Event)
+	}
+
+	return events
+}
+
+func TestGetMulticastReports(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []multicastReport
+	}{
+		{
+			"igmpv2 leave",
+			[]byte{0x17, 0, 0, 0, 239, 1, 1, 1},
+			[]multicastReport{{protocol: "igmpv2", group: multicastTestGroup, change: multicastChangeInclude, sources: nil}},
+		},
+		{
+			"igmpv2 report",
+			[]byte{0x16, 0, 0, 0, 239, 1, 1, 1},
+			[]multicastReport{{protocol: "igmpv2", group: multicastTestGroup, change: multicastChangeExclude, sources: nil}},
+		},
+		{
+			"igmpv3 to_in with no sources",
+			[]byte{0x22, 0, 0, 0, 0, 0, 0, 1, 3, 0, 0, 0, 239, 1, 1, 1},
+			[]multicastReport{{protocol: "igmpv3", group: multicastTestGroup, change: multicastChangeInclude, sources: []string{}}},
+		},
+		{
+			"igmpv3 allow and block",
+			[]byte{
+				0x22, 0, 0, 0, 0, 0, 0, 2,
+				5, 0, 0, 1, 239, 1, 1, 1, 10, 0, 1, 1,
+				6, 0, 0, 1, 239, 1, 1, 1, 10, 0, 1, 2,
+			},
+			[]multicastReport{
+				{protocol: "igmpv3", group: multicastTestGroup, change: multicastChangeAllow, sources: []string{multicastTestS1}},
+				{protocol: "igmpv3", group: multicastTestGroup, change: multicastChangeBlock, sources: []string{multicastTestS2}},
+			},
+		},
+		{
+			"igmpv2 report for a link-local group",
+			[]byte{0x16, 0, 0, 0, 224, 0, 0, 251},
+			[]multicastReport{},
+		},
+	}
+
+	for _, test := range tests {
+		packet := gopacket.NewPacket(test.data, layers.LayerTypeIGMP, gopacket.Default)
+		if packet.ErrorLayer() != nil {
+			t.Fatalf("%v: %v", test.name, packet.ErrorLayer().Error())
+		}
+
+		got := getMulticastReports(packet)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMulticastHandleReport(t *testing.T) {
+	report := func(change int, sources ...string) multicastReport {
+		return multicastReport{protocol: "igmpv3", group: multicastTestGroup, change: change, sources: sources}
+	}
+
+	tests := []struct {
+		name    string
+		reports []multicastReport
+		events  []string
+		member  bool
+		include bool
+		sources []string
+	}{
+		{
+			"igmpv2 join then leave",
+			[]multicastReport{
+				{protocol: "igmpv2", group: multicastTestGroup, change: multicastChangeExclude},
+				{protocol: "igmpv2", group: multicastTestGroup, change: multicastChangeInclude},
+			},
+			[]string{multicastEventJoined, multicastEventLeft},
+			false, false, nil,
+		},
+		{
+			"igmpv2 leave when not a member",
+			[]multicastReport{{protocol: "igmpv2", group: multicastTestGroup, change: multicastChangeInclude}},
+			[]string{},
+			false, false, nil,
+		},
+		{
+			"to_in with no sources leaves",
+			[]multicastReport{report(multicastChangeExclude), report(multicastChangeInclude)},
+			[]string{multicastEventJoined, multicastEventLeft},
+			false, false, nil,
+		},
+		{
+			"to_ex replaces include",
+			[]multicastReport{report(multicastChangeInclude, multicastTestS1), report(multicastChangeExclude, multicastTestS2)},
+			[]string{multicastEventJoined},
+			true, false, []string{multicastTestS2},
+		},
+		{
+			"allow in include mode adds sources",
+			[]multicastReport{report(multicastChangeInclude, multicastTestS1), report(multicastChangeAllow, multicastTestS2)},
+			[]string{multicastEventJoined},
+			true, true, []string{multicastTestS1, multicastTestS2},
+		},
+		{
+			"block in include mode removes sources",
+			[]multicastReport{report(multicastChangeInclude, multicastTestS1, multicastTestS2), report(multicastChangeBlock, multicastTestS1)},
+			[]string{multicastEventJoined},
+			true, true, []string{multicastTestS2},
+		},
+		{
+			"block of the last source in include mode leaves",
+			[]multicastReport{report(multicastChangeInclude, multicastTestS1), report(multicastChangeBlock, multicastTestS1)},
+			[]string{multicastEventJoined, multicastEventLeft},
+			false, false, nil,
+		},
+		{
+			"allow in exclude mode removes exclusions",
+			[]multicastReport{report(multicastChangeExclude, multicastTestS1, multicastTestS2), report(multicastChangeAllow, multicastTestS1)},
+			[]string{multicastEventJoined},
+			true, false, []string{multicastTestS2},
+		},
+		{
+			"block in exclude mode adds exclusions",
+			[]multicastReport{report(multicastChangeExclude, multicastTestS1), report(multicastChangeBlock, multicastTestS2)},
+			[]string{multicastEventJoined},
+			true, false, []string{multicastTestS1, multicastTestS2},
+		},
+		{
+			"allow when not a member joins",
+			[]multicastReport{report(multicastChangeAllow, multicastTestS1)},
+			[]string{multicastEventJoined},
+			true, true, []string{multicastTestS1},
+		},
+		{
+			"block when not a member does nothing",
+			[]multicastReport{report(multicastChangeBlock, multicastTestS1)},
+			[]string{},
+			false, false, nil,
+		},
+	}
+
+	for _, test := range tests {
+		m := newMulticastTracker(newLocalAddresses(), defaultMulticastTimeout, defaultMulticastMembershipTimeout)
+
+		records := make([]Multicast, 0)
+
+		for i, r := range test.reports {
+			err := m.handleReport(r, multicastTestHost, multicastTestStart.Add(time.Duration(i)*time.Second), collectMulticast(&records))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		events := multicastEvents(records)
+		if !reflect.DeepEqual(events, test.events) {
+			t.Errorf("%v: got events %v, want %v", test.name, events, test.events)
+		}
+
+		var membership *multicastMembership
+		if g, ok := m.groups[multicastTestGroup]; ok {
+			membership = g.members[multicastTestHost]
+		}
+
+		if (membership != nil) != test.member {
+			t.Errorf("%v: got member %v, want %v", test.name, membership != nil, test.member)
+
+			continue
+		}
+
+		if membership == nil {
+			continue
+		}
+
+		sources := make([]string, 0, len(membership.sources))
+		for source := range membership.sources {
+			sources = append(sources, source)
+		}
+
+		sort.Strings(sources)
+
+		if membership.include != test.include || !reflect.DeepEqual(sources, test.sources) {
+			t.Errorf("%v: got include %v of %v, want include %v of %v", test.name, membership.include, sources, test.include, test.sources)
+		}
+	}
+}
+
+// TestMulticastTraffic has a host join a group for one source, get traffic from another (not wanted) then from that one
+// (its first packet), the group go quiet for longer than the timeout (stalled), get traffic again (resumed) and then
+// the host's membership go without a report for longer than the membership timeout (expired)
+func TestMulticastTraffic(t *testing.T) {
+	m := newMulticastTracker(newLocalAddresses(), defaultMulticastTimeout, defaultMulticastMembershipTimeout)
+
+	records := make([]Multicast, 0)
+	callback := collectMulticast(&records)
+
+	at := func(seconds float64) time.Time {
+		return multicastTestStart.Add(time.Duration(seconds * float64(time.Second)))
+	}
+
+	traffic := func(source string, seconds float64) {
+		err := m.expire(at(seconds), callback)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = m.handleTraffic(PacketData{Timestamp: at(seconds), SourceIP: source, DestinationIP: multicastTestGroup}, callback)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expire := func(seconds float64) {
+		err := m.expire(at(seconds), callback)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := m.handleReport(
+		multicastReport{protocol: "igmpv3", group: multicastTestGroup, change: multicastChangeInclude, sources: []string{multicastTestS1}},
+		multicastTestHost,
+		at(0),
+		callback,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traffic(multicastTestS2, 1)
+	traffic(multicastTestS1, 2)
+	expire(11.5)
+	expire(12.5)
+	expire(13.6)
+	traffic(multicastTestS1, 15)
+	expire(261)
+
+	want := []string{
+		multicastEventJoined,
+		multicastEventFirstPacket,
+		multicastEventStalled,
+		multicastEventResumed,
+		multicastEventExpired,
+	}
+
+	events := multicastEvents(records)
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got events %v, want %v", events, want)
+	}
+
+	firstPacket := records[1]
+	if firstPacket.SourceIP != multicastTestS1 || firstPacket.JoinToFirstPacket == nil || *firstPacket.JoinToFirstPacket != 2000 {
+		t.Errorf("got %+v, want the first packet from %v 2000ms after the join", firstPacket, multicastTestS1)
+	}
+
+	stalled := records[2]
+	if !stalled.Time.Equal(at(12.5)) || stalled.LastPacket == nil || !stalled.LastPacket.Equal(at(2)) || stalled.Gap == nil || *stalled.Gap != 10500 {
+		t.Errorf("got %+v, want stalled at 12.5s with the last packet at 2s (a 10500ms gap)", stalled)
+	}
+
+	if stalled.Members != 1 {
+		t.Errorf("got %v members, want 1", stalled.Members)
+	}
+
+	resumed := records[3]
+	if resumed.SourceIP != multicastTestS1 || resumed.Gap == nil || *resumed.Gap != 13000 {
+		t.Errorf("got %+v, want resumed by %v after a 13000ms gap", resumed, multicastTestS1)
+	}
+
+	if _, ok := m.groups[multicastTestGroup]; ok {
+		t.Errorf("got group %v still tracked after its only membership expired", multicastTestGroup)
+	}
+}
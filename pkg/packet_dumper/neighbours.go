@@ -0,0 +1,167 @@
+package packet_dumper
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"time"
+)
+
+const (
+	neighbourEventNew      = "new"
+	neighbourEventChanged  = "changed"
+	neighbourEventConflict = "conflict"
+)
+
+// if the previous MAC claims an IP again within this long of losing it, both are taken to be answering for it
+const neighbourConflictWindow = time.Second * 10
+
+type Neighbour struct {
+	Event       string    `json:"event"`
+	Source      string    `json:"source"`
+	IP          string    `json:"ip"`
+	MAC         string    `json:"mac"`
+	PreviousMAC string    `json:"previous_mac,omitempty"`
+	Gateway     bool      `json:"gateway"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+type neighbourBinding struct {
+	mac         string
+	lastSeen    time.Time
+	previousMAC string
+	changed     time.Time
+}
+
+// neighbourTracker keeps an IP to MAC table from ARP and NDP (neighbour / router solicitations and advertisements)
+// and calls back whenever a binding is learned, changes or is claimed by more than one MAC
+type neighbourTracker struct {
+	gateway  net.IP
+	bindings map[string]*neighbourBinding
+}
+
+func newNeighbourTracker(gateway string) *neighbourTracker {
+	return &neighbourTracker{
+		gateway:  net.ParseIP(gateway),
+		bindings: make(map[string]*neighbourBinding),
+	}
+}
+
+// linkLayerAddress gets the source / target link-layer address option out of an NDP message
+func linkLayerAddress(options layers.ICMPv6Options, optionType layers.ICMPv6Opt) net.HardwareAddr {
+	for _, option := range options {
+		if option.Type == optionType && len(option.Data) >= 6 {
+			return net.HardwareAddr(option.Data[:6])
+		}
+	}
+
+	return nil
+}
+
+func linkLayerSource(packet gopacket.Packet) net.HardwareAddr {
+	ethernetLayer := packet.Layer(layers.LayerTypeEthernet)
+	if ethernetLayer == nil {
+		return nil
+	}
+
+	return ethernetLayer.(*layers.Ethernet).SrcMAC
+}
+
+func (n *neighbourTracker) learn(source string, ip net.IP, mac net.HardwareAddr, timestamp time.Time, callback func(output Output) error) error {
+	if ip == nil || ip.IsUnspecified() || ip.IsMulticast() || len(mac) == 0 || mac[0]&0x01 == 0x01 {
+		return nil
+	}
+
+	key := ip.String()
+	macString := mac.String()
+
+	neighbour := Neighbour{
+		Source:   source,
+		IP:       key,
+		MAC:      macString,
+		Gateway:  n.gateway != nil && n.gateway.Equal(ip),
+		LastSeen: timestamp,
+	}
+
+	binding, ok := n.bindings[key]
+	switch {
+	case !ok:
+		n.bindings[key] = &neighbourBinding{
+			mac:      macString,
+			lastSeen: timestamp,
+		}
+
+		neighbour.Event = neighbourEventNew
+	case binding.mac == macString:
+		binding.lastSeen = timestamp
+
+		return nil
+	default:
+		neighbour.PreviousMAC = binding.mac
+		neighbour.Event = neighbourEventChanged
+
+		if binding.previousMAC == macString && timestamp.Sub(binding.changed) < neighbourConflictWindow {
+			neighbour.Event = neighbourEventConflict
+		}
+
+		binding.previousMAC = binding.mac
+		binding.mac = macString
+		binding.lastSeen = timestamp
+		binding.changed = timestamp
+	}
+
+	return callback(Output{
+		Timestamp: time.Now(),
+		Neighbour: &neighbour,
+	})
+}
+
+func (n *neighbourTracker) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	timestamp := packetData.Timestamp
+
+	arpLayer := packet.Layer(layers.LayerTypeARP)
+	if arpLayer != nil {
+		arp := arpLayer.(*layers.ARP)
+		if arp.Protocol != layers.EthernetTypeIPv4 || arp.ProtAddressSize != 4 {
+			return nil
+		}
+
+		return n.learn("arp", net.IP(arp.SourceProtAddress), net.HardwareAddr(arp.SourceHwAddress), timestamp, callback)
+	}
+
+	ipv6Layer := packet.Layer(layers.LayerTypeIPv6)
+	if ipv6Layer == nil {
+		return nil
+	}
+
+	ipv6 := ipv6Layer.(*layers.IPv6)
+
+	for _, layer := range packet.Layers() {
+		switch ndp := layer.(type) {
+		case *layers.ICMPv6NeighborAdvertisement:
+			mac := linkLayerAddress(ndp.Options, layers.ICMPv6OptTargetAddress)
+			if mac == nil {
+				mac = linkLayerSource(packet)
+			}
+
+			return n.learn("ndp", ndp.TargetAddress, mac, timestamp, callback)
+		case *layers.ICMPv6NeighborSolicitation:
+			return n.learn("ndp", ipv6.SrcIP, linkLayerAddress(ndp.Options, layers.ICMPv6OptSourceAddress), timestamp, callback)
+		case *layers.ICMPv6RouterAdvertisement:
+			mac := linkLayerAddress(ndp.Options, layers.ICMPv6OptSourceAddress)
+			if mac == nil {
+				mac = linkLayerSource(packet)
+			}
+
+			return n.learn("ndp", ipv6.SrcIP, mac, timestamp, callback)
+		case *layers.ICMPv6RouterSolicitation:
+			return n.learn("ndp", ipv6.SrcIP, linkLayerAddress(ndp.Options, layers.ICMPv6OptSourceAddress), timestamp, callback)
+		}
+	}
+
+	return nil
+}
+
+func (n *neighbourTracker) flush(callback func(output Output) error) error {
+	return nil
+}
@@ -0,0 +1,454 @@
+package packet_dumper
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	ospfEventNeighbourUp   = "neighbour_up"
+	ospfEventNeighbourDown = "neighbour_down"
+	ospfEventTwoWayUp      = "two_way_up"
+	ospfEventTwoWayDown    = "two_way_down"
+	ospfEventDRChanged     = "dr_changed"
+	ospfEventLSAFlood      = "lsa_flood"
+
+	ospfTypeHello    = 1
+	ospfTypeLSUpdate = 4
+
+	ospfLSAHeaderLength = 20
+
+	// an LSA flooded at MaxAge is being withdrawn
+	ospfMaxAge = 3600
+)
+
+var ospfv2LSATypes = map[int]string{
+	1:  "router",
+	2:  "network",
+	3:  "summary_network",
+	4:  "summary_asbr",
+	5:  "as_external",
+	7:  "nssa",
+	9:  "opaque_link",
+	10: "opaque_area",
+	11: "opaque_as",
+}
+
+// OSPFv3 LSA types by function code (the flooding scope being in the top bits)
+var ospfv3LSATypes = map[int]string{
+	1: "router",
+	2: "network",
+	3: "inter_area_prefix",
+	4: "inter_area_router",
+	5: "as_external",
+	7: "nssa",
+	8: "link",
+	9: "intra_area_prefix",
+}
+
+type OSPFLSA struct {
+	Type              string `json:"type"`
+	LinkStateID       string `json:"link_state_id"`
+	AdvertisingRouter string `json:"advertising_router"`
+	Sequence          uint32 `json:"sequence"`
+	PreviousSequence  uint32 `json:"previous_sequence,omitempty"`
+	Age               int    `json:"age_seconds"`
+	Withdrawn         bool   `json:"withdrawn,omitempty"`
+}
+
+type OSPF struct {
+	Event       string    `json:"event"`
+	Version     int       `json:"version"`
+	AreaID      string    `json:"area_id"`
+	RouterID    string    `json:"router_id"`
+	SourceIP    string    `json:"source_ip"`
+	NeighbourID string    `json:"neighbour_id,omitempty"`
+	DR          string    `json:"dr,omitempty"`
+	BDR         string    `json:"bdr,omitempty"`
+	PreviousDR  string    `json:"previous_dr,omitempty"`
+	PreviousBDR string    `json:"previous_bdr,omitempty"`
+	LSAs        []OSPFLSA `json:"lsas,omitempty"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// ospfHeader is the part of the OSPFv2 / OSPFv3 header that's needed, along with the packet body
+type ospfHeader struct {
+	version    int
+	packetType int
+	routerID   string
+	areaID     string
+	instanceID int
+	body       []byte
+}
+
+type ospfHello struct {
+	networkMask  net.IPMask
+	deadInterval time.Duration
+	dr           string
+	bdr          string
+	neighbours   []string
+}
+
+type ospfRouter struct {
+	record       OSPF
+	deadInterval time.Duration
+	neighbours   map[string]bool
+}
+
+type ospfSegment struct {
+	dr  string
+	bdr string
+}
+
+// ospfTracker follows the OSPF routers heard on the link from their hellos (calling back when one appears or goes
+// quiet for its dead interval, when it starts or stops listing another router, which is two-way rather than a full
+// adjacency, and when the DR / BDR changes) and the LSA instances flooded in link state updates (calling back with the
+// new ones in each update)
+type ospfTracker struct {
+	routers  map[string]*ospfRouter
+	segments map[string]*ospfSegment
+	lsas     map[string]OSPFLSA
+}
+
+func newOSPFTracker() *ospfTracker {
+	return &ospfTracker{
+		routers:  make(map[string]*ospfRouter),
+		segments: make(map[string]*ospfSegment),
+		lsas:     make(map[string]OSPFLSA),
+	}
+}
+
+func ospfID(id []byte) string {
+	return net.IP(id).String()
+}
+
+// getOSPF gets the OSPF packet from the innermost IP layer itself, as gopacket fails on LSA types it doesn't know
+func getOSPF(packet gopacket.Packet) *ospfHeader {
+	var payload []byte
+
+	ipLayer := innermostLayer(packet, layers.LayerTypeIPv4)
+	if ipLayer == nil {
+		ipLayer = innermostLayer(packet, layers.LayerTypeIPv6)
+	}
+
+	switch ip := ipLayer.(type) {
+	case *layers.IPv4:
+		if ip.Protocol != layers.IPProtocolOSPF {
+			return nil
+		}
+		payload = ip.Payload
+	case *layers.IPv6:
+		if ip.NextHeader != layers.IPProtocolOSPF {
+			return nil
+		}
+		payload = ip.Payload
+	default:
+		return nil
+	}
+
+	r := &fieldReader{data: payload}
+
+	header := ospfHeader{
+		version:    r.uint(1),
+		packetType: r.uint(1),
+	}
+
+	length := r.uint(2)
+	header.routerID = ospfID(r.read(4))
+	header.areaID = ospfID(r.read(4))
+	r.read(2) // checksum
+
+	switch header.version {
+	case 2:
+		r.read(2 + 8) // authentication type, authentication
+	case 3:
+		header.instanceID = r.uint(1)
+		r.read(1)
+	default:
+		return nil
+	}
+
+	headerLength := len(payload) - len(r.data)
+	if r.bad || length < headerLength || length > len(payload) {
+		return nil
+	}
+
+	header.body = payload[headerLength:length]
+
+	return &header
+}
+
+func parseOSPFHello(header *ospfHeader) (*ospfHello, bool) {
+	r := &fieldReader{data: header.body}
+
+	hello := ospfHello{}
+
+	if header.version == 2 {
+		hello.networkMask = net.IPMask(r.read(4))
+		r.read(2 + 1 + 1) // hello interval, options, priority
+		hello.deadInterval = time.Duration(r.uint(4)) * time.Second
+	} else {
+		r.read(4 + 1 + 3 + 2) // interface ID, priority, options, hello interval
+		hello.deadInterval = time.Duration(r.uint(2)) * time.Second
+	}
+
+	hello.dr = ospfID(r.read(4))
+	hello.bdr = ospfID(r.read(4))
+
+	for len(r.data) >= 4 {
+		hello.neighbours = append(hello.neighbours, ospfID(r.read(4)))
+	}
+
+	return &hello, !r.bad
+}
+
+func parseOSPFLSAHeaders(header *ospfHeader) ([]OSPFLSA, bool) {
+	r := &fieldReader{data: header.body}
+
+	count := r.uint(4)
+
+	lsas := make([]OSPFLSA, 0)
+
+	for i := 0; i < count && !r.bad; i++ {
+		lsa := OSPFLSA{
+			Age: r.uint(2) & 0x7fff, // the top bit is DoNotAge
+		}
+
+		var lsaType int
+		var ok bool
+
+		if header.version == 2 {
+			r.read(1) // options
+			lsaType = r.uint(1)
+			lsa.Type, ok = ospfv2LSATypes[lsaType]
+		} else {
+			lsaType = r.uint(2)
+			lsa.Type, ok = ospfv3LSATypes[lsaType&0x1fff]
+		}
+
+		if !ok {
+			lsa.Type = fmt.Sprintf("type%v", lsaType)
+		}
+
+		lsa.LinkStateID = ospfID(r.read(4))
+		lsa.AdvertisingRouter = ospfID(r.read(4))
+		lsa.Sequence = uint32(r.uint(4))
+		r.read(2) // checksum
+
+		length := r.uint(2)
+		r.read(length - ospfLSAHeaderLength)
+
+		lsa.Withdrawn = lsa.Age >= ospfMaxAge
+
+		lsas = append(lsas, lsa)
+	}
+
+	return lsas, !r.bad
+}
+
+func (o *ospfTracker) emit(record OSPF, callback func(output Output) error) error {
+	return callback(Output{
+		Timestamp: time.Now(),
+		OSPF:      &record,
+	})
+}
+
+// expire calls back for the routers whose hellos have stopped for longer than their dead interval
+func (o *ospfTracker) expire(timestamp time.Time, callback func(output Output) error) error {
+	keys := make([]string, 0)
+
+	for key, router := range o.routers {
+		if timestamp.Sub(router.record.LastSeen) > router.deadInterval {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		record := o.routers[key].record
+		record.Event = ospfEventNeighbourDown
+
+		delete(o.routers, key)
+
+		err := o.emit(record, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *ospfTracker) handleHello(header *ospfHeader, record OSPF, callback func(output Output) error) error {
+	hello, ok := parseOSPFHello(header)
+	if !ok {
+		return nil
+	}
+
+	key := fmt.Sprintf("%v/%v/%v/%v", header.version, header.areaID, header.routerID, record.SourceIP)
+
+	router, ok := o.routers[key]
+	if !ok {
+		router = &ospfRouter{
+			neighbours: make(map[string]bool),
+		}
+		o.routers[key] = router
+
+		neighbourUp := record
+		neighbourUp.Event = ospfEventNeighbourUp
+
+		err := o.emit(neighbourUp, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	router.record = record
+	router.deadInterval = hello.deadInterval
+
+	neighbours := make(map[string]bool)
+	for _, neighbour := range hello.neighbours {
+		neighbours[neighbour] = true
+
+		if router.neighbours[neighbour] {
+			continue
+		}
+
+		twoWayUp := record
+		twoWayUp.Event = ospfEventTwoWayUp
+		twoWayUp.NeighbourID = neighbour
+
+		err := o.emit(twoWayUp, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	removed := make([]string, 0)
+	for neighbour := range router.neighbours {
+		if !neighbours[neighbour] {
+			removed = append(removed, neighbour)
+		}
+	}
+
+	sort.Strings(removed)
+
+	for _, neighbour := range removed {
+		twoWayDown := record
+		twoWayDown.Event = ospfEventTwoWayDown
+		twoWayDown.NeighbourID = neighbour
+
+		err := o.emit(twoWayDown, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	router.neighbours = neighbours
+
+	// a router that's still waiting to find out who the DR is says there isn't one
+	if hello.dr == net.IPv4zero.String() {
+		return nil
+	}
+
+	segmentKey := fmt.Sprintf("%v/%v/%v", header.version, header.areaID, header.instanceID)
+	if header.version == 2 {
+		segmentKey = fmt.Sprintf("%v/%v", segmentKey, net.ParseIP(record.SourceIP).Mask(hello.networkMask))
+	}
+
+	segment, ok := o.segments[segmentKey]
+	if ok && segment.dr == hello.dr && segment.bdr == hello.bdr {
+		return nil
+	}
+
+	drChanged := record
+	drChanged.Event = ospfEventDRChanged
+	drChanged.DR = hello.dr
+	drChanged.BDR = hello.bdr
+
+	if ok {
+		drChanged.PreviousDR = segment.dr
+		drChanged.PreviousBDR = segment.bdr
+	}
+
+	o.segments[segmentKey] = &ospfSegment{
+		dr:  hello.dr,
+		bdr: hello.bdr,
+	}
+
+	return o.emit(drChanged, callback)
+}
+
+func (o *ospfTracker) handleLSUpdate(header *ospfHeader, record OSPF, callback func(output Output) error) error {
+	lsas, ok := parseOSPFLSAHeaders(header)
+	if !ok {
+		return nil
+	}
+
+	// only the LSA instances we haven't seen yet (as each one is flooded out of every interface, and retransmitted)
+	flooded := make([]OSPFLSA, 0)
+
+	for _, lsa := range lsas {
+		key := fmt.Sprintf("%v/%v/%v/%v/%v", header.version, header.areaID, lsa.Type, lsa.LinkStateID, lsa.AdvertisingRouter)
+
+		previous, ok := o.lsas[key]
+		if ok && previous.Sequence == lsa.Sequence && previous.Withdrawn == lsa.Withdrawn {
+			continue
+		}
+
+		o.lsas[key] = lsa
+
+		if ok {
+			lsa.PreviousSequence = previous.Sequence
+		}
+
+		flooded = append(flooded, lsa)
+	}
+
+	if len(flooded) == 0 {
+		return nil
+	}
+
+	record.Event = ospfEventLSAFlood
+	record.LSAs = flooded
+
+	return o.emit(record, callback)
+}
+
+func (o *ospfTracker) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	err := o.expire(packetData.Timestamp, callback)
+	if err != nil {
+		return err
+	}
+
+	header := getOSPF(packet)
+	if header == nil {
+		return nil
+	}
+
+	record := OSPF{
+		Version:  header.version,
+		AreaID:   header.areaID,
+		RouterID: header.routerID,
+		SourceIP: packetData.SourceIP,
+		LastSeen: packetData.Timestamp,
+	}
+
+	switch header.packetType {
+	case ospfTypeHello:
+		return o.handleHello(header, record, callback)
+	case ospfTypeLSUpdate:
+		return o.handleLSUpdate(header, record, callback)
+	}
+
+	return nil
+}
+
+func (o *ospfTracker) flush(callback func(output Output) error) error {
+	return nil
+}
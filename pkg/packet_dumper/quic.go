@@ -0,0 +1,168 @@
+package packet_dumper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+const (
+	quicFramePadding = 0x00
+	quicFramePing    = 0x01
+	quicFrameCrypto  = 0x06
+)
+
+// quicVersion is what's needed to remove the Initial packet protection for a QUIC version (RFC 9001, RFC 9369)
+type quicVersion struct {
+	salt        []byte
+	labelPrefix string
+	initialType byte
+}
+
+func mustDecodeHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+var quicVersions = map[uint32]quicVersion{
+	0x00000001: {mustDecodeHex("38762cf7f55934b34d179ae6a4c80cadccbb7f0a"), "quic ", 0},
+	0x6b3343cf: {mustDecodeHex("0dede3def700a6db819381be6e269dcbf9bd2ed9"), "quicv2 ", 1},
+	0xff00001d: {mustDecodeHex("afbfec289993d24c9e9786f19c6111e04390a899"), "quic ", 0}, // draft 29
+}
+
+func hkdfExtract(salt []byte, secret []byte) []byte {
+	h := hmac.New(sha256.New, salt)
+	_, _ = h.Write(secret)
+
+	return h.Sum(nil)
+}
+
+// hkdfExpandLabel is TLS 1.3's HKDF-Expand-Label (with no context), which never needs more than one block here
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	fullLabel := "tls13 " + label
+
+	info := make([]byte, 0, 4+len(fullLabel))
+	info = append(info, byte(length>>8), byte(length), byte(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = append(info, 0, 1)
+
+	h := hmac.New(sha256.New, secret)
+	_, _ = h.Write(info)
+
+	return h.Sum(nil)[:length]
+}
+
+// quicInitialKeys are the client's Initial packet key, IV and header protection key for a destination connection ID
+func quicInitialKeys(version quicVersion, destinationConnectionID []byte) ([]byte, []byte, []byte) {
+	initialSecret := hkdfExtract(version.salt, destinationConnectionID)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", sha256.Size)
+
+	return hkdfExpandLabel(clientSecret, version.labelPrefix+"key", 16),
+		hkdfExpandLabel(clientSecret, version.labelPrefix+"iv", 12),
+		hkdfExpandLabel(clientSecret, version.labelPrefix+"hp", 16)
+}
+
+// decryptQUICInitial decrypts a client's Initial packet (the first in the datagram) and returns its CRYPTO frames'
+// data by offset; anything else (other packet types, the server's Initials, short headers) isn't ok
+func decryptQUICInitial(datagram []byte) (map[uint64][]byte, bool) {
+	// long header, fixed bit
+	if len(datagram) < 7 || datagram[0]&0xc0 != 0xc0 {
+		return nil, false
+	}
+
+	version, ok := quicVersions[binary.BigEndian.Uint32(datagram[1:5])]
+	if !ok || (datagram[0]>>4)&0x03 != version.initialType {
+		return nil, false
+	}
+
+	r := &fieldReader{data: datagram[5:]}
+
+	destinationConnectionID := r.vector(1)
+	r.vector(1) // source connection ID
+	r.read(int(r.varint()))
+	length := int(r.varint())
+
+	if r.bad || length > len(r.data) {
+		return nil, false
+	}
+
+	headerLength := len(datagram) - len(r.data)
+
+	key, iv, hp := quicInitialKeys(version, destinationConnectionID)
+
+	// the sample for header protection is taken as if the packet number were 4 bytes long
+	if length < 4+aes.BlockSize {
+		return nil, false
+	}
+
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, false
+	}
+
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, datagram[headerLength+4:headerLength+4+aes.BlockSize])
+
+	header := make([]byte, headerLength+4)
+	copy(header, datagram[:headerLength+4])
+
+	header[0] ^= mask[0] & 0x0f
+	packetNumberLength := int(header[0]&0x03) + 1
+
+	packetNumber := uint64(0)
+	for i := 0; i < packetNumberLength; i++ {
+		header[headerLength+i] ^= mask[1+i]
+		packetNumber = packetNumber<<8 | uint64(header[headerLength+i])
+	}
+
+	header = header[:headerLength+packetNumberLength]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, false
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, false
+	}
+
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(packetNumber >> uint(8*i))
+	}
+
+	plaintext, err := aead.Open(nil, nonce, datagram[headerLength+packetNumberLength:headerLength+length], header)
+	if err != nil {
+		return nil, false
+	}
+
+	frames := make(map[uint64][]byte)
+
+	r = &fieldReader{data: plaintext}
+
+	// a client's Initial only has CRYPTO, PADDING and PING (and maybe ACK later on, which isn't needed)
+	for len(r.data) > 0 && !r.bad {
+		switch r.varint() {
+		case quicFramePadding, quicFramePing:
+		case quicFrameCrypto:
+			offset := r.varint()
+			data := r.read(int(r.varint()))
+			if !r.bad {
+				frames[offset] = data
+			}
+		default:
+			return frames, true
+		}
+	}
+
+	return frames, !r.bad
+}
@@ -0,0 +1,376 @@
+package packet_dumper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/initialed85/drive_test/internal/scheduler"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultRingBufferSeconds   = 60
+	defaultRingBufferMegabytes = 64
+	defaultPreTrigger          = 30
+	defaultPostTrigger         = 10
+
+	// what the dumped files claim as their snaplen (frames are written as captured, whatever the capture's snaplen)
+	pcapSnaplen = 65535
+)
+
+// RingBufferConfig keeps the last "seconds" / "megabytes" (whichever's reached first) of frames in memory and dumps a
+// pcap file covering "pre_trigger" seconds before to "post_trigger" seconds after each trigger (no more than
+// "pre_trigger" + "seconds" or "megabytes" to a file); triggers are any of bfd_down, gateway_changed, http, geofence
+// (default all of them)
+type RingBufferConfig struct {
+	Seconds     float64    `json:"seconds"`
+	Megabytes   float64    `json:"megabytes"`
+	PreTrigger  float64    `json:"pre_trigger"`
+	PostTrigger float64    `json:"post_trigger"`
+	Path        string     `json:"path"`
+	Triggers    []string   `json:"triggers"`
+	HTTPAddress string     `json:"http_address"`
+	GPSDAddress string     `json:"gpsd_address"`
+	Geofences   []Geofence `json:"geofences"`
+}
+
+type TriggeredCapture struct {
+	Trigger     string    `json:"trigger"`
+	Reason      string    `json:"reason,omitempty"`
+	TriggerTime time.Time `json:"trigger_time"`
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+	Path        string    `json:"path"`
+	Part        int       `json:"part,omitempty"`
+	Packets     int       `json:"packets"`
+	Bytes       int       `json:"bytes"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type frame struct {
+	captureInfo gopacket.CaptureInfo
+	data        []byte
+}
+
+type pendingDump struct {
+	trigger trigger
+	part    int
+	start   time.Time
+	end     time.Time
+	limit   time.Time
+	frames  []frame
+	bytes   int
+}
+
+// ringBuffer holds the most recent frames of a capture and turns triggers into pcap files; time is packet time (or
+// the clock while a live capture is idle), and a trigger during a pending dump's window extends it rather than
+// starting another, up to the same limits as the ring buffer itself (after which what there is gets written out and
+// the rest goes in another file, so triggers that keep on firing can't hold a dump open for good)
+type ringBuffer struct {
+	name        string
+	linkType    layers.LinkType
+	maxAge      time.Duration
+	maxBytes    int
+	preTrigger  time.Duration
+	postTrigger time.Duration
+	path        string
+	triggers    map[string]bool
+	frames      []frame
+	bytes       int
+	last        time.Time
+	pending     *pendingDump
+	anonymizer  *anonymizer
+}
+
+func newRingBuffer(name string, linkType layers.LinkType, config RingBufferConfig, anonymizer *anonymizer) *ringBuffer {
+	megabytes := config.Megabytes
+	if megabytes <= 0 {
+		megabytes = defaultRingBufferMegabytes
+	}
+
+	path := config.Path
+	if path == "" {
+		path = "."
+	}
+
+	triggers := make(map[string]bool)
+	for _, name := range config.Triggers {
+		triggers[name] = true
+	}
+
+	if len(triggers) == 0 {
+		for _, name := range triggerNames {
+			triggers[name] = true
+		}
+	}
+
+	return &ringBuffer{
+		name:        name,
+		linkType:    linkType,
+		maxAge:      scheduler.SecondsToDuration(config.Seconds, defaultRingBufferSeconds),
+		maxBytes:    int(megabytes * 1024 * 1024),
+		preTrigger:  scheduler.SecondsToDuration(config.PreTrigger, defaultPreTrigger),
+		postTrigger: scheduler.SecondsToDuration(config.PostTrigger, defaultPostTrigger),
+		path:        path,
+		triggers:    triggers,
+		frames:      make([]frame, 0),
+		anonymizer:  anonymizer,
+	}
+}
+
+func (r *ringBuffer) add(captureInfo gopacket.CaptureInfo, data []byte, callback func(output Output) error) error {
+	f := frame{captureInfo, data}
+
+	r.last = captureInfo.Timestamp
+	r.frames = append(r.frames, f)
+	r.bytes += len(data)
+
+	oldest := 0
+	for oldest < len(r.frames)-1 {
+		if r.last.Sub(r.frames[oldest].captureInfo.Timestamp) <= r.maxAge && r.bytes <= r.maxBytes {
+			break
+		}
+
+		r.bytes -= len(r.frames[oldest].data)
+		oldest++
+	}
+
+	r.frames = r.frames[oldest:]
+
+	if r.pending == nil || captureInfo.Timestamp.After(r.pending.end) {
+		return nil
+	}
+
+	if r.pending.bytes+len(data) > r.maxBytes && len(r.pending.frames) > 0 {
+		err := r.split(r.pending.trigger, r.pending.part+1, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.pending.frames = append(r.pending.frames, f)
+	r.pending.bytes += len(data)
+
+	return nil
+}
+
+// split writes out the pending dump as it is and carries on with the rest of its window (for the given trigger) in
+// another one
+func (r *ringBuffer) split(t trigger, part int, callback func(output Output) error) error {
+	end := r.pending.end
+	if t.time.Add(r.postTrigger).After(end) {
+		end = t.time.Add(r.postTrigger)
+	}
+
+	r.pending.end = r.last
+
+	err := r.dump(callback)
+	if err != nil {
+		return err
+	}
+
+	r.pending = &pendingDump{
+		trigger: t,
+		part:    part,
+		start:   r.last,
+		end:     end,
+		limit:   r.last.Add(r.preTrigger + r.maxAge),
+		frames:  make([]frame, 0),
+	}
+
+	return nil
+}
+
+func (r *ringBuffer) trigger(t trigger, callback func(output Output) error) error {
+	if !r.triggers[t.name] {
+		return nil
+	}
+
+	if r.pending != nil && !t.time.After(r.pending.end) {
+		end := t.time.Add(r.postTrigger)
+		if end.After(r.pending.limit) {
+			return r.split(t, 1, callback)
+		}
+
+		if end.After(r.pending.end) {
+			r.pending.end = end
+		}
+
+		return nil
+	}
+
+	// anything pending has had its window by now
+	err := r.dump(callback)
+	if err != nil {
+		return err
+	}
+
+	dump := &pendingDump{
+		trigger: t,
+		part:    1,
+		start:   t.time.Add(-r.preTrigger),
+		end:     t.time.Add(r.postTrigger),
+		limit:   t.time.Add(r.maxAge),
+		frames:  make([]frame, 0),
+	}
+
+	for _, f := range r.frames {
+		if !f.captureInfo.Timestamp.Before(dump.start) {
+			dump.frames = append(dump.frames, f)
+			dump.bytes += len(f.data)
+		}
+	}
+
+	r.pending = dump
+
+	return nil
+}
+
+// handleOutput fires the triggers that come from the analyzers' records
+func (r *ringBuffer) handleOutput(output Output, callback func(output Output) error) error {
+	bfd := output.BFD
+	if bfd != nil && bfd.Event == bfdEventStateChanged && bfd.PreviousState == "up" &&
+		(bfd.State == "down" || bfd.State == "admin_down") {
+		return r.trigger(trigger{
+			name:   triggerBFDDown,
+			reason: fmt.Sprintf("%v -> %v %v (%v)", bfd.SourceIP, bfd.DestinationIP, bfd.State, bfd.Diagnostic),
+			time:   r.last,
+		}, callback)
+	}
+
+	neighbour := output.Neighbour
+	if neighbour != nil && neighbour.Gateway && neighbour.Event != neighbourEventNew {
+		return r.trigger(trigger{
+			name:   triggerGatewayChanged,
+			reason: fmt.Sprintf("%v %v %v (was %v)", neighbour.IP, neighbour.Event, neighbour.MAC, neighbour.PreviousMAC),
+			time:   r.last,
+		}, callback)
+	}
+
+	return nil
+}
+
+// poll handles any external triggers and dumps the pending capture once now is past the end of its window
+func (r *ringBuffer) poll(triggers <-chan trigger, now time.Time, callback func(output Output) error) error {
+	for len(triggers) > 0 {
+		err := r.trigger(<-triggers, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.pending == nil || !now.After(r.pending.end) {
+		return nil
+	}
+
+	return r.dump(callback)
+}
+
+// dump writes out the pending capture (if any) and calls back with where it went
+func (r *ringBuffer) dump(callback func(output Output) error) error {
+	if r.pending == nil {
+		return nil
+	}
+
+	dump := r.pending
+	r.pending = nil
+
+	name := r.name
+	if name == "" {
+		name = "capture"
+	}
+
+	path := filepath.Join(r.path, fmt.Sprintf(
+		"%v_%v_%v.pcap", name, dump.trigger.time.UTC().Format("20060102T150405.000Z"), dump.trigger.name,
+	))
+
+	// the rest of a window that didn't fit in one file
+	part := 0
+	if dump.part > 1 {
+		part = dump.part
+		path = fmt.Sprintf("%v_%v.pcap", path[:len(path)-len(".pcap")], part)
+	}
+
+	frames := dump.frames
+
+	if r.anonymizer != nil {
+		frames = make([]frame, 0, len(dump.frames))
+		for _, f := range dump.frames {
+			frames = append(frames, r.anonymizer.anonymizeFrame(r.linkType, f))
+		}
+	}
+
+	triggeredCapture := TriggeredCapture{
+		Trigger:     dump.trigger.name,
+		Reason:      dump.trigger.reason,
+		TriggerTime: dump.trigger.time,
+		WindowStart: dump.start,
+		WindowEnd:   dump.end,
+		Path:        path,
+		Part:        part,
+		Packets:     len(frames),
+	}
+
+	for _, f := range frames {
+		triggeredCapture.Bytes += len(f.data)
+	}
+
+	// failing to write one shouldn't stop the capture, so it's just reported
+	err := writePcap(path, r.linkType, frames)
+	if err != nil {
+		triggeredCapture.Error = err.Error()
+	}
+
+	return callback(Output{
+		Timestamp:        time.Now(),
+		TriggeredCapture: &triggeredCapture,
+	})
+}
+
+// writePcap writes frames out in the classic (microsecond) pcap format
+func writePcap(path string, linkType layers.LinkType, frames []frame) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnaplen)
+	binary.LittleEndian.PutUint32(header[20:24], uint32(linkType))
+
+	_, err = file.Write(header)
+	if err != nil {
+		return err
+	}
+
+	recordHeader := make([]byte, 16)
+
+	for _, f := range frames {
+		timestamp := f.captureInfo.Timestamp
+
+		binary.LittleEndian.PutUint32(recordHeader[0:4], uint32(timestamp.Unix()))
+		binary.LittleEndian.PutUint32(recordHeader[4:8], uint32(timestamp.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(recordHeader[8:12], uint32(len(f.data)))
+		binary.LittleEndian.PutUint32(recordHeader[12:16], uint32(f.captureInfo.Length))
+
+		_, err = file.Write(recordHeader)
+		if err != nil {
+			return err
+		}
+
+		_, err = file.Write(f.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,448 @@
+package packet_dumper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"time"
+)
+
+const (
+	defaultRoamTimeout = time.Second * 5
+
+	// how often (in packet time) roams and stations are checked for having gone quiet
+	roamExpireInterval = time.Second
+)
+
+type Roam struct {
+	Station                  string    `json:"station"`
+	OldBSSID                 string    `json:"old_bssid,omitempty"`
+	NewBSSID                 string    `json:"new_bssid"`
+	Reassociation            bool      `json:"reassociation"`
+	Start                    time.Time `json:"start"`
+	End                      time.Time `json:"end"`
+	Duration                 float64   `json:"duration_ms"`
+	AuthenticationDuration   *float64  `json:"authentication_duration_ms,omitempty"`
+	AssociationDuration      *float64  `json:"association_duration_ms,omitempty"`
+	HandshakeDuration        *float64  `json:"handshake_duration_ms,omitempty"`
+	HandshakeRetransmissions int       `json:"handshake_retransmissions"`
+	DataGap                  *float64  `json:"data_gap_ms,omitempty"`
+	Success                  bool      `json:"success"`
+	Failure                  string    `json:"failure,omitempty"`
+}
+
+type roamState struct {
+	roam            Roam
+	lastFrame       time.Time
+	authStart       time.Time
+	authEnd         time.Time
+	assocStart      time.Time
+	assocEnd        time.Time
+	handshakeStart  time.Time
+	handshakeEnd    time.Time
+	lastDataBefore  time.Time
+	handshakeFrames map[int]int
+	awaitingData    bool
+}
+
+type stationState struct {
+	bssid    string
+	lastData time.Time
+	lastSeen time.Time
+	roam     *roamState
+}
+
+// roamAnalyzer follows each station through authentication, (re)association and the EAPOL 4-way handshake (all
+// driven by packet timestamps) and calls back with a record per roam once the station has passed data again; a
+// station that's not roaming is forgotten once it's been quiet for the timeout
+type roamAnalyzer struct {
+	timeout    time.Duration
+	stations   map[string]*stationState
+	lastExpire time.Time
+}
+
+func newRoamAnalyzer(timeout time.Duration) *roamAnalyzer {
+	return &roamAnalyzer{
+		timeout:  timeout,
+		stations: make(map[string]*stationState),
+	}
+}
+
+func durationPointer(start, end time.Time) *float64 {
+	if start.IsZero() || end.IsZero() {
+		return nil
+	}
+
+	ms := float64(end.Sub(start)) / float64(time.Millisecond)
+
+	return &ms
+}
+
+// eapolKeyMessage works out which message of the 4-way handshake a pairwise EAPOL-Key frame is (or 0 if it isn't)
+func eapolKeyMessage(key *layers.EAPOLKey) int {
+	if key.KeyType != layers.EAPOLKeyTypePairwise {
+		return 0
+	}
+
+	switch {
+	case key.KeyACK && !key.KeyMIC:
+		return 1
+	case key.KeyACK && key.KeyMIC:
+		return 3
+	case !key.KeyACK && key.KeyMIC && (key.Secure || key.KeyDataLength == 0):
+		return 4
+	case !key.KeyACK && key.KeyMIC:
+		return 2
+	}
+
+	return 0
+}
+
+func (r *roamAnalyzer) station(mac string, timestamp time.Time) *stationState {
+	s, ok := r.stations[mac]
+	if !ok {
+		s = &stationState{}
+		r.stations[mac] = s
+	}
+
+	s.lastSeen = timestamp
+
+	return s
+}
+
+func (r *roamAnalyzer) emit(s *stationState, callback func(output Output) error) error {
+	state := s.roam
+	s.roam = nil
+
+	roam := state.roam
+
+	roam.AuthenticationDuration = durationPointer(state.authStart, state.authEnd)
+	roam.AssociationDuration = durationPointer(state.assocStart, state.assocEnd)
+	roam.HandshakeDuration = durationPointer(state.handshakeStart, state.handshakeEnd)
+
+	for _, count := range state.handshakeFrames {
+		if count > 1 {
+			roam.HandshakeRetransmissions += count - 1
+		}
+	}
+
+	if roam.End.IsZero() {
+		roam.End = state.lastFrame
+	}
+
+	roam.Duration = float64(roam.End.Sub(roam.Start)) / float64(time.Millisecond)
+
+	return callback(Output{
+		Timestamp: time.Now(),
+		Roam:      &roam,
+	})
+}
+
+func (r *roamAnalyzer) fail(s *stationState, reason string, callback func(output Output) error) error {
+	s.roam.roam.Failure = reason
+	s.roam.roam.Success = false
+
+	return r.emit(s, callback)
+}
+
+// complete marks the roam as successful; the record waits for the station's first data frame (to measure the gap)
+func (r *roamAnalyzer) complete(s *stationState, end time.Time) {
+	s.roam.roam.End = end
+	s.roam.roam.Success = true
+	s.roam.awaitingData = true
+
+	s.bssid = s.roam.roam.NewBSSID
+}
+
+func (r *roamAnalyzer) start(s *stationState, station, bssid string, timestamp time.Time, callback func(output Output) error) error {
+	if s.roam != nil {
+		if s.roam.roam.NewBSSID == bssid && !s.roam.awaitingData {
+			return nil
+		}
+
+		var err error
+		if s.roam.awaitingData {
+			err = r.emit(s, callback)
+		} else {
+			err = r.fail(s, fmt.Sprintf("superseded by roam to %v", bssid), callback)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.roam = &roamState{
+		roam: Roam{
+			Station:  station,
+			OldBSSID: s.bssid,
+			NewBSSID: bssid,
+			Start:    timestamp,
+		},
+		lastDataBefore:  s.lastData,
+		handshakeFrames: make(map[int]int),
+	}
+
+	return nil
+}
+
+// expire deals with roams that have gone quiet (at most once per expire interval); if association worked and no
+// handshake was started it was an open (or fast transition) roam, otherwise it failed
+func (r *roamAnalyzer) expire(timestamp time.Time, callback func(output Output) error) error {
+	if timestamp.Sub(r.lastExpire) < roamExpireInterval {
+		return nil
+	}
+
+	r.lastExpire = timestamp
+
+	for mac, s := range r.stations {
+		if s.roam == nil {
+			if timestamp.Sub(s.lastSeen) >= r.timeout {
+				delete(r.stations, mac)
+			}
+
+			continue
+		}
+
+		if timestamp.Sub(s.roam.lastFrame) < r.timeout {
+			continue
+		}
+
+		var err error
+
+		switch {
+		case s.roam.awaitingData:
+			err = r.emit(s, callback)
+		case !s.roam.assocEnd.IsZero() && s.roam.handshakeStart.IsZero():
+			r.complete(s, s.roam.assocEnd)
+			err = r.emit(s, callback)
+		case !s.roam.handshakeStart.IsZero():
+			err = r.fail(s, "handshake timed out", callback)
+		default:
+			err = r.fail(s, "timed out", callback)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *roamAnalyzer) handleManagement(packet gopacket.Packet, dot11 *layers.Dot11, timestamp time.Time, callback func(output Output) error) error {
+	receiver := dot11.Address1.String()
+	transmitter := dot11.Address2.String()
+	bssid := dot11.Address3.String()
+
+	switch dot11.Type {
+	case layers.Dot11TypeMgmtAuthentication:
+		authLayer := packet.Layer(layers.LayerTypeDot11MgmtAuthentication)
+		if authLayer == nil {
+			return nil
+		}
+
+		auth := authLayer.(*layers.Dot11MgmtAuthentication)
+
+		if transmitter != bssid {
+			// station to AP
+			s := r.station(transmitter, timestamp)
+
+			err := r.start(s, transmitter, bssid, timestamp, callback)
+			if err != nil {
+				return err
+			}
+
+			if s.roam.authStart.IsZero() {
+				s.roam.authStart = timestamp
+			}
+
+			s.roam.lastFrame = timestamp
+
+			return nil
+		}
+
+		// AP to station
+		s := r.station(receiver, timestamp)
+		if s.roam == nil || s.roam.awaitingData {
+			return nil
+		}
+
+		s.roam.authEnd = timestamp
+		s.roam.lastFrame = timestamp
+
+		if auth.Status != layers.Dot11StatusSuccess {
+			return r.fail(s, fmt.Sprintf("authentication failed: %v", auth.Status), callback)
+		}
+	case layers.Dot11TypeMgmtAssociationReq, layers.Dot11TypeMgmtReassociationReq:
+		s := r.station(transmitter, timestamp)
+
+		err := r.start(s, transmitter, bssid, timestamp, callback)
+		if err != nil {
+			return err
+		}
+
+		s.roam.roam.Reassociation = dot11.Type == layers.Dot11TypeMgmtReassociationReq
+		s.roam.lastFrame = timestamp
+
+		if s.roam.assocStart.IsZero() {
+			s.roam.assocStart = timestamp
+		}
+
+		reassocLayer := packet.Layer(layers.LayerTypeDot11MgmtReassociationReq)
+		if reassocLayer != nil {
+			reassoc := reassocLayer.(*layers.Dot11MgmtReassociationReq)
+			if len(reassoc.CurrentApAddress) > 0 {
+				s.roam.roam.OldBSSID = reassoc.CurrentApAddress.String()
+			}
+		}
+	case layers.Dot11TypeMgmtAssociationResp, layers.Dot11TypeMgmtReassociationResp:
+		s := r.station(receiver, timestamp)
+		if s.roam == nil || s.roam.awaitingData {
+			return nil
+		}
+
+		s.roam.assocEnd = timestamp
+		s.roam.lastFrame = timestamp
+
+		status := layers.Dot11StatusSuccess
+
+		if assocLayer := packet.Layer(layers.LayerTypeDot11MgmtAssociationResp); assocLayer != nil {
+			status = assocLayer.(*layers.Dot11MgmtAssociationResp).Status
+		} else if reassocLayer := packet.Layer(layers.LayerTypeDot11MgmtReassociationResp); reassocLayer != nil {
+			// gopacket doesn't decode the reassociation response, but it's laid out like an association response
+			contents := reassocLayer.LayerContents()
+			if len(contents) >= 4 {
+				status = layers.Dot11Status(binary.LittleEndian.Uint16(contents[2:4]))
+			}
+		}
+
+		if status != layers.Dot11StatusSuccess {
+			return r.fail(s, fmt.Sprintf("association failed: %v", status), callback)
+		}
+	case layers.Dot11TypeMgmtDeauthentication, layers.Dot11TypeMgmtDisassociation:
+		for _, mac := range []string{receiver, transmitter} {
+			s, ok := r.stations[mac]
+			if !ok {
+				continue
+			}
+
+			s.bssid = ""
+
+			if s.roam == nil || s.roam.awaitingData {
+				continue
+			}
+
+			return r.fail(s, fmt.Sprintf("%v from %v", dot11.Type, transmitter), callback)
+		}
+	}
+
+	return nil
+}
+
+func (r *roamAnalyzer) handleData(packet gopacket.Packet, dot11 *layers.Dot11, timestamp time.Time, callback func(output Output) error) error {
+	var station, bssid net.HardwareAddr
+
+	switch {
+	case dot11.Flags.ToDS() && !dot11.Flags.FromDS():
+		station, bssid = dot11.Address2, dot11.Address1
+	case !dot11.Flags.ToDS() && dot11.Flags.FromDS():
+		station, bssid = dot11.Address1, dot11.Address2
+	default:
+		return nil
+	}
+
+	// group addressed frames from the AP aren't to any one station
+	if len(station) == 0 || station[0]&0x01 == 0x01 {
+		return nil
+	}
+
+	s := r.station(station.String(), timestamp)
+
+	eapolKeyLayer := packet.Layer(layers.LayerTypeEAPOLKey)
+	if eapolKeyLayer != nil {
+		message := eapolKeyMessage(eapolKeyLayer.(*layers.EAPOLKey))
+		if message == 0 || s.roam == nil || s.roam.awaitingData {
+			return nil
+		}
+
+		s.roam.handshakeFrames[message]++
+		s.roam.lastFrame = timestamp
+
+		if message == 1 && s.roam.handshakeStart.IsZero() {
+			s.roam.handshakeStart = timestamp
+		}
+
+		if message == 4 {
+			s.roam.handshakeEnd = timestamp
+			r.complete(s, timestamp)
+		}
+
+		return nil
+	}
+
+	if dot11.Type != layers.Dot11TypeData && dot11.Type != layers.Dot11TypeDataQOSData {
+		return nil
+	}
+
+	s.lastData = timestamp
+
+	// data (unlike the handshake, which is with the AP being roamed to) only flows through the AP it's associated to,
+	// so that's where the next roam is from
+	s.bssid = bssid.String()
+
+	if s.roam != nil && s.roam.awaitingData {
+		if !s.roam.lastDataBefore.IsZero() {
+			s.roam.roam.DataGap = durationPointer(s.roam.lastDataBefore, timestamp)
+		}
+
+		return r.emit(s, callback)
+	}
+
+	return nil
+}
+
+func (r *roamAnalyzer) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	err := r.expire(packetData.Timestamp, callback)
+	if err != nil {
+		return err
+	}
+
+	dot11Layer := packet.Layer(layers.LayerTypeDot11)
+	if dot11Layer == nil {
+		return nil
+	}
+
+	dot11 := dot11Layer.(*layers.Dot11)
+
+	switch dot11.Type.MainType() {
+	case layers.Dot11TypeMgmt:
+		return r.handleManagement(packet, dot11, packetData.Timestamp, callback)
+	case layers.Dot11TypeData:
+		return r.handleData(packet, dot11, packetData.Timestamp, callback)
+	}
+
+	return nil
+}
+
+func (r *roamAnalyzer) flush(callback func(output Output) error) error {
+	for _, s := range r.stations {
+		if s.roam == nil {
+			continue
+		}
+
+		var err error
+		if s.roam.awaitingData {
+			err = r.emit(s, callback)
+		} else {
+			err = r.fail(s, "capture ended", callback)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,399 @@
+package packet_dumper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/initialed85/drive_test/internal/probe_stats"
+	"time"
+)
+
+const (
+	// streams that haven't been heard from in this long are forgotten, as are SDP endpoints without any (or a BYE)
+	rtpStreamTimeout = time.Second * 60
+
+	// without a configured port range or SDP to go by, this many packets in sequence makes a stream look like RTP
+	rtpHeuristicPackets = 3
+
+	rtpHeaderSize = 12
+)
+
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// codecImpairment is the E-model equipment impairment factor (Ie) and packet loss robustness factor (Bpl) for a codec,
+// from ITU-T G.113 appendix I (assuming packet loss concealment where the codec has it)
+type codecImpairment struct {
+	ie  float64
+	bpl float64
+}
+
+var codecImpairments = map[string]codecImpairment{
+	"PCMU": {0, 25.1},
+	"PCMA": {0, 25.1},
+	"G722": {0, 25.1},
+	"G729": {11, 19},
+	"G723": {15, 16.1},
+	"GSM":  {20, 10},
+}
+
+// the G.711 figures are used for anything else
+var defaultCodecImpairment = codecImpairment{0, 25.1}
+
+type RTPStream struct {
+	SSRC            string  `json:"ssrc"`
+	SourceIP        string  `json:"source_ip"`
+	SourcePort      int     `json:"source_port"`
+	DestinationIP   string  `json:"destination_ip"`
+	DestinationPort int     `json:"destination_port"`
+	CallID          string  `json:"call_id,omitempty"`
+	PayloadType     int     `json:"payload_type"`
+	Codec           string  `json:"codec,omitempty"`
+	Packets         uint64  `json:"packets"`
+	Expected        uint64  `json:"expected"`
+	Lost            uint64  `json:"lost"`
+	LossRate        float64 `json:"loss_rate"`
+	Reordered       uint64  `json:"reordered"`
+	Duplicates      uint64  `json:"duplicates"`
+	Jitter          float64 `json:"jitter_ms"`
+	RFactor         float64 `json:"r_factor"`
+	MOS             float64 `json:"mos"`
+}
+
+type RTPInterval struct {
+	IntervalStart time.Time   `json:"interval_start"`
+	IntervalEnd   time.Time   `json:"interval_end"`
+	Streams       []RTPStream `json:"streams"`
+}
+
+type rtpStream struct {
+	record           RTPStream
+	confirmed        bool
+	inSequence       int
+	highestSeq       int64
+	intervalStartSeq int64
+	clockRate        int
+	firstArrival     time.Time
+	firstRTPTime     uint32
+	jitter           probe_stats.Jitter
+	lastSeen         time.Time
+	seen             map[int64]bool
+	sdpEndpoint      string
+}
+
+// rtpAnalyzer follows RTP streams (per SSRC and 5-tuple) on the configured port ranges, on ports learned from SIP / SDP
+// or (if no port ranges are configured) anything that looks like RTP, and calls back per interval with each stream's
+// loss, reordering, RFC 3550 jitter and an E-model R-factor / MOS estimate
+type rtpAnalyzer struct {
+	clock   intervalClock
+	ports   []PortRange
+	streams map[string]*rtpStream
+	sdp     map[string]sdpMedia
+}
+
+func newRTPAnalyzer(interval time.Duration, ports []PortRange) *rtpAnalyzer {
+	return &rtpAnalyzer{
+		clock:   newIntervalClock(interval),
+		ports:   ports,
+		streams: make(map[string]*rtpStream),
+		sdp:     make(map[string]sdpMedia),
+	}
+}
+
+// eModel estimates the R-factor and MOS per ITU-T G.107; there's no way to know the one way delay from a single
+// capture point so it's taken as just a jitter buffer of twice the jitter (plus 10ms of codec delay), and loss is
+// assumed to be random (BurstR of 1)
+func eModel(codec string, jitter float64, lossRate float64) (float64, float64) {
+	impairment, ok := codecImpairments[codec]
+	if !ok {
+		impairment = defaultCodecImpairment
+	}
+
+	delay := 2*jitter + 10
+
+	id := 0.024 * delay
+	if delay > 177.3 {
+		id += 0.11 * (delay - 177.3)
+	}
+
+	ppl := lossRate * 100
+
+	ieEff := impairment.ie + (95-impairment.ie)*ppl/(ppl+impairment.bpl)
+
+	r := 93.2 - id - ieEff
+
+	switch {
+	case r <= 0:
+		return r, 1
+	case r >= 100:
+		return r, 4.5
+	}
+
+	return r, 1 + 0.035*r + r*(r-60)*(100-r)*7e-6
+}
+
+func (r *rtpAnalyzer) inPortRange(port int) bool {
+	for _, portRange := range r.ports {
+		if port >= portRange.Start && port <= portRange.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *rtpAnalyzer) emit(start time.Time, callback func(output Output) error) error {
+	interval := RTPInterval{
+		IntervalStart: start,
+		IntervalEnd:   start.Add(r.clock.interval),
+		Streams:       make([]RTPStream, 0),
+	}
+
+	for key, stream := range r.streams {
+		if start.Sub(stream.lastSeen) >= rtpStreamTimeout {
+			delete(r.streams, key)
+
+			continue
+		}
+
+		// the call's still going as far as its SDP endpoint is concerned
+		media, ok := r.sdp[stream.sdpEndpoint]
+		if ok && stream.lastSeen.After(media.lastUsed) {
+			media.lastUsed = stream.lastSeen
+			r.sdp[stream.sdpEndpoint] = media
+		}
+
+		record := stream.record
+
+		// the next interval starts from here whether or not anything was heard in this one
+		stream.record.Packets = 0
+		stream.record.Reordered = 0
+		stream.record.Duplicates = 0
+		stream.seen = make(map[int64]bool)
+
+		intervalStartSeq := stream.intervalStartSeq
+		stream.intervalStartSeq = stream.highestSeq
+
+		if !stream.confirmed || record.Packets == 0 {
+			continue
+		}
+
+		record.Expected = uint64(stream.highestSeq - intervalStartSeq)
+		if record.Packets < record.Expected {
+			record.Lost = record.Expected - record.Packets
+		}
+
+		if record.Expected > 0 {
+			record.LossRate = float64(record.Lost) / float64(record.Expected)
+		}
+
+		record.Jitter = stream.jitter.Milliseconds()
+		record.RFactor, record.MOS = eModel(record.Codec, record.Jitter, record.LossRate)
+
+		interval.Streams = append(interval.Streams, record)
+	}
+
+	for endpoint, media := range r.sdp {
+		if start.Sub(media.lastUsed) >= rtpStreamTimeout {
+			delete(r.sdp, endpoint)
+		}
+	}
+
+	return callback(Output{
+		Timestamp: time.Now(),
+		RTP:       &interval,
+	})
+}
+
+// handleSIP learns the RTP endpoints from a call's SDP and forgets them when it's hung up
+func (r *rtpAnalyzer) handleSIP(packet gopacket.Packet, timestamp time.Time) {
+	sipLayer := packet.Layer(layers.LayerTypeSIP)
+	if sipLayer == nil {
+		return
+	}
+
+	sip := sipLayer.(*layers.SIP)
+
+	if !sip.IsResponse && sip.Method == layers.SIPMethodBye {
+		callID := sip.GetCallID()
+
+		for endpoint, media := range r.sdp {
+			if media.callID == callID {
+				delete(r.sdp, endpoint)
+			}
+		}
+
+		return
+	}
+
+	for endpoint, media := range getSDPMedia(sip) {
+		media.lastUsed = timestamp
+		r.sdp[endpoint] = media
+	}
+}
+
+// getStream finds (or starts following) the stream a packet belongs to, or returns nil if it doesn't look like RTP
+func (r *rtpAnalyzer) getStream(payload []byte, packetData PacketData) *rtpStream {
+	if len(payload) < rtpHeaderSize || payload[0]>>6 != 2 {
+		return nil
+	}
+
+	payloadType := payload[1] & 0x7f
+
+	// RTCP sender / receiver reports etc (200 - 204) look like RTP payload types 72 - 76 with the marker bit set
+	if payloadType >= 72 && payloadType <= 76 {
+		return nil
+	}
+
+	csrcCount := int(payload[0] & 0x0f)
+	if len(payload) < rtpHeaderSize+4*csrcCount {
+		return nil
+	}
+
+	ssrc := binary.BigEndian.Uint32(payload[8:12])
+
+	key := fmt.Sprintf(
+		"%08x/%v/%v/%v/%v",
+		ssrc, packetData.SourceIP, packetData.SourcePort, packetData.DestinationIP, packetData.DestinationPort,
+	)
+
+	stream, ok := r.streams[key]
+	if ok {
+		return stream
+	}
+
+	sdpEndpoint := fmt.Sprintf("%v/%v", packetData.DestinationIP, packetData.DestinationPort)
+
+	media, sdpOK := r.sdp[sdpEndpoint]
+	if !sdpOK {
+		sdpEndpoint = fmt.Sprintf("%v/%v", packetData.SourceIP, packetData.SourcePort)
+		media, sdpOK = r.sdp[sdpEndpoint]
+	}
+
+	configured := r.inPortRange(packetData.SourcePort) || r.inPortRange(packetData.DestinationPort)
+
+	if !sdpOK && !configured && len(r.ports) > 0 {
+		return nil
+	}
+
+	stream = &rtpStream{
+		record: RTPStream{
+			SSRC:            fmt.Sprintf("%08x", ssrc),
+			SourceIP:        packetData.SourceIP,
+			SourcePort:      packetData.SourcePort,
+			DestinationIP:   packetData.DestinationIP,
+			DestinationPort: packetData.DestinationPort,
+			PayloadType:     int(payloadType),
+		},
+		confirmed: sdpOK || configured,
+		clockRate: 8000,
+		seen:      make(map[int64]bool),
+	}
+
+	codec, codecOK := staticRTPCodecs[payloadType]
+	if sdpOK {
+		stream.record.CallID = media.callID
+		stream.sdpEndpoint = sdpEndpoint
+
+		sdpCodec, ok := media.codecs[payloadType]
+		if ok {
+			codec, codecOK = sdpCodec, true
+		}
+	}
+
+	if codecOK {
+		stream.record.Codec = codec.name
+		stream.clockRate = codec.clockRate
+	}
+
+	r.streams[key] = stream
+
+	return stream
+}
+
+func (r *rtpAnalyzer) handleRTP(stream *rtpStream, payload []byte, timestamp time.Time) {
+	seq := binary.BigEndian.Uint16(payload[2:4])
+	rtpTime := binary.BigEndian.Uint32(payload[4:8])
+
+	stream.lastSeen = timestamp
+
+	if stream.firstArrival.IsZero() {
+		stream.firstArrival = timestamp
+		stream.firstRTPTime = rtpTime
+		stream.highestSeq = int64(seq)
+		stream.intervalStartSeq = int64(seq) - 1
+	}
+
+	// extend the sequence number past 16 bits by going with whichever way round is closest to the highest so far
+	delta := int64(int16(seq - uint16(stream.highestSeq)))
+	extendedSeq := stream.highestSeq + delta
+
+	switch {
+	case delta == 1:
+		stream.inSequence++
+		if stream.inSequence >= rtpHeuristicPackets-1 {
+			stream.confirmed = true
+		}
+	case delta != 0 && !stream.confirmed:
+		stream.inSequence = 0
+	}
+
+	if stream.seen[extendedSeq] {
+		stream.record.Duplicates++
+
+		return
+	}
+
+	stream.seen[extendedSeq] = true
+
+	if delta > 0 {
+		stream.highestSeq = extendedSeq
+	} else if delta < 0 {
+		stream.record.Reordered++
+	}
+
+	stream.record.Packets++
+
+	// transit time relative to the first packet (the unknown offset between the clocks cancels out of the jitter)
+	rtpElapsed := time.Duration(float64(int32(rtpTime-stream.firstRTPTime)) / float64(stream.clockRate) * float64(time.Second))
+
+	stream.jitter.Update(timestamp.Sub(stream.firstArrival) - rtpElapsed)
+}
+
+func (r *rtpAnalyzer) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	for _, start := range r.clock.advance(packetData.Timestamp) {
+		err := r.emit(start, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.handleSIP(packet, packetData.Timestamp)
+
+	udpLayer := innermostLayer(packet, layers.LayerTypeUDP)
+	if udpLayer == nil {
+		return nil
+	}
+
+	payload := udpLayer.(*layers.UDP).Payload
+
+	stream := r.getStream(payload, packetData)
+	if stream == nil {
+		return nil
+	}
+
+	r.handleRTP(stream, payload, packetData.Timestamp)
+
+	return nil
+}
+
+func (r *rtpAnalyzer) flush(callback func(output Output) error) error {
+	if !r.clock.started() {
+		return nil
+	}
+
+	return r.emit(r.clock.start, callback)
+}
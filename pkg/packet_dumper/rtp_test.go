@@ -0,0 +1,146 @@
+package packet_dumper
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func almostEqual(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+// TestEModel checks against G.107 (R = 93.2 less the delay and equipment impairments, MOS from R) with the G.113
+// appendix I codec figures
+func TestEModel(t *testing.T) {
+	tests := []struct {
+		name     string
+		codec    string
+		jitter   float64
+		lossRate float64
+		r        float64
+		mos      float64
+	}{
+		// Id = 0.024 x 10ms of codec delay
+		{"G.711 without loss or jitter", "PCMU", 0, 0, 92.96, 4.4046},
+		{"unknown codec as G.711", "", 0, 0, 92.96, 4.4046},
+		// Ie = 11
+		{"G.729 without loss or jitter", "G729", 0, 0, 81.96, 4.0959},
+		// Ie-eff = 95 x 2 / (2 + 25.1)
+		{"G.711 with 2% loss", "PCMA", 0, 0.02, 85.9489, 4.2276},
+		// 210ms of delay, so Id = 0.024 x 210 + 0.11 x (210 - 177.3)
+		{"G.711 with 100ms of jitter", "PCMU", 100, 0, 84.563, 4.1842},
+	}
+
+	for _, test := range tests {
+		r, mos := eModel(test.codec, test.jitter, test.lossRate)
+
+		if !almostEqual(r, test.r, 0.0001) || !almostEqual(mos, test.mos, 0.0001) {
+			t.Errorf("%v: got R %v, MOS %v, want R %v, MOS %v", test.name, r, mos, test.r, test.mos)
+		}
+	}
+}
+
+func rtpPacket(t *testing.T, seq uint16, rtpTime uint32) gopacket.Packet {
+	t.Helper()
+
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(192, 0, 2, 1),
+		DstIP:    net.IPv4(192, 0, 2, 2),
+	}
+
+	// version 2, payload type 0 (PCMU)
+	header := make([]byte, rtpHeaderSize)
+	header[0] = 0x80
+	binary.BigEndian.PutUint16(header[2:4], seq)
+	binary.BigEndian.PutUint32(header[4:8], rtpTime)
+	binary.BigEndian.PutUint32(header[8:12], 0x1234abcd)
+
+	return serializePacket(t, ip, &layers.UDP{SrcPort: 5004, DstPort: 5006}, gopacket.Payload(append(header, make([]byte, 160)...)))
+}
+
+// TestRTPAnalyzer has 50 packets of 20ms of PCMU each (sequence numbers 65530 onwards, so they wrap) with 2 of them
+// lost, 1 duplicated and the last one arriving 16ms late (so the RFC 3550 jitter is 16ms / 16)
+func TestRTPAnalyzer(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+
+	r := newRTPAnalyzer(time.Second, []PortRange{{5004, 5007}})
+
+	intervals := make([]*RTPInterval, 0)
+	callback := func(output Output) error {
+		if output.RTP != nil {
+			intervals = append(intervals, output.RTP)
+		}
+
+		return nil
+	}
+
+	handle := func(i int, late time.Duration) {
+		packetData := PacketData{
+			Timestamp:       start.Add(time.Duration(i)*time.Millisecond*20 + late),
+			SourceIP:        "192.0.2.1",
+			SourcePort:      5004,
+			DestinationIP:   "192.0.2.2",
+			DestinationPort: 5006,
+		}
+
+		err := r.handlePacket(rtpPacket(t, uint16(65530+i), uint32(1000+i*160)), packetData, callback)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		switch i {
+		case 10, 11:
+			continue
+		case 30:
+			handle(i, 0)
+			handle(i, time.Millisecond)
+		case 49:
+			handle(i, time.Millisecond*16)
+		default:
+			handle(i, 0)
+		}
+	}
+
+	err := r.flush(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(intervals) != 1 || len(intervals[0].Streams) != 1 {
+		t.Fatalf("got %+v, want 1 interval with 1 stream", intervals)
+	}
+
+	stream := intervals[0].Streams[0]
+
+	if stream.SSRC != "1234abcd" || stream.Codec != "PCMU" {
+		t.Errorf("got ssrc %v codec %v, want 1234abcd PCMU", stream.SSRC, stream.Codec)
+	}
+
+	if stream.Packets != 48 || stream.Expected != 50 || stream.Lost != 2 || stream.LossRate != 0.04 {
+		t.Errorf("got %v of %v packets (%v lost, a rate of %v), want 48 of 50 (2 lost, 0.04)", stream.Packets, stream.Expected, stream.Lost, stream.LossRate)
+	}
+
+	if stream.Duplicates != 1 || stream.Reordered != 0 {
+		t.Errorf("got %v duplicates and %v reordered, want 1 and 0", stream.Duplicates, stream.Reordered)
+	}
+
+	if !almostEqual(stream.Jitter, 1, 0.000001) {
+		t.Errorf("got jitter %vms, want 1ms", stream.Jitter)
+	}
+
+	wantR, wantMOS := eModel("PCMU", 1, 0.04)
+	if stream.RFactor != wantR || stream.MOS != wantMOS {
+		t.Errorf("got R %v, MOS %v, want R %v, MOS %v", stream.RFactor, stream.MOS, wantR, wantMOS)
+	}
+}
@@ -0,0 +1,133 @@
+package packet_dumper
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// the capture length rules are compiled for; it only matters to filters that look past the end of what was captured
+const ruleSnaplen = 65535
+
+// Rule is a named BPF filter that packets matching it are labelled with; if it lists any analyzers, those analyzers
+// only see packets that match a rule listing them (analyzers no rule lists see every packet)
+type Rule struct {
+	Name      string   `json:"name"`
+	Filter    string   `json:"filter"`
+	Analyzers []string `json:"analyzers"`
+}
+
+// packetMatcher is satisfied by *pcap.BPF
+type packetMatcher interface {
+	Matches(captureInfo gopacket.CaptureInfo, data []byte) bool
+}
+
+type rule struct {
+	name      string
+	matcher   packetMatcher
+	analyzers map[string]bool
+}
+
+// ruleSet matches each packet against every rule in userspace (the capture filter having already been applied by
+// libpcap)
+type ruleSet struct {
+	rules []rule
+
+	// analyzers selected by at least one rule, and the ones that aren't (so see every packet)
+	selected   map[string]bool
+	unselected map[string]bool
+}
+
+func newRuleSet(configRules []Rule, linkType layers.LinkType) (*ruleSet, error) {
+	r := &ruleSet{
+		rules:      make([]rule, 0),
+		selected:   make(map[string]bool),
+		unselected: make(map[string]bool),
+	}
+
+	knownAnalyzers := make(map[string]bool)
+	for _, name := range analyzerNames {
+		knownAnalyzers[name] = true
+	}
+
+	names := make(map[string]bool)
+
+	for _, configRule := range configRules {
+		if configRule.Name == "" {
+			return nil, fmt.Errorf("rule %#+v has no name", configRule.Filter)
+		}
+
+		if names[configRule.Name] {
+			return nil, fmt.Errorf("duplicate rule %#+v", configRule.Name)
+		}
+
+		names[configRule.Name] = true
+
+		bpf, err := pcap.NewBPF(linkType, ruleSnaplen, configRule.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("rule %#+v: %v", configRule.Name, err)
+		}
+
+		analyzers := make(map[string]bool)
+
+		for _, name := range configRule.Analyzers {
+			if !knownAnalyzers[name] {
+				return nil, fmt.Errorf("rule %#+v: unknown analyzer %#+v", configRule.Name, name)
+			}
+
+			analyzers[name] = true
+			r.selected[name] = true
+		}
+
+		r.rules = append(r.rules, rule{
+			name:      configRule.Name,
+			matcher:   bpf,
+			analyzers: analyzers,
+		})
+	}
+
+	for _, name := range analyzerNames {
+		if !r.selected[name] {
+			r.unselected[name] = true
+		}
+	}
+
+	return r, nil
+}
+
+// match gets the names of the rules a packet matches along with the analyzers that should see it
+func (r *ruleSet) match(captureInfo gopacket.CaptureInfo, data []byte) ([]string, map[string]bool) {
+	var matched []string
+
+	analyzers := r.unselected
+	copied := false
+
+	for _, rule := range r.rules {
+		if !rule.matcher.Matches(captureInfo, data) {
+			continue
+		}
+
+		matched = append(matched, rule.name)
+
+		if len(rule.analyzers) == 0 {
+			continue
+		}
+
+		// copied rather than changing the shared one
+		if !copied {
+			analyzers = make(map[string]bool)
+			for name := range r.unselected {
+				analyzers[name] = true
+			}
+
+			copied = true
+		}
+
+		for name := range rule.analyzers {
+			analyzers[name] = true
+		}
+	}
+
+	return matched, analyzers
+}
@@ -0,0 +1,134 @@
+package packet_dumper
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type rtpCodec struct {
+	name      string
+	clockRate int
+}
+
+// static payload types from RFC 3551 (dynamic ones only come from SDP)
+var staticRTPCodecs = map[uint8]rtpCodec{
+	0:  {"PCMU", 8000},
+	3:  {"GSM", 8000},
+	4:  {"G723", 8000},
+	8:  {"PCMA", 8000},
+	9:  {"G722", 8000},
+	13: {"CN", 8000},
+	18: {"G729", 8000},
+}
+
+// sdpMedia is what a SIP call's SDP says about one of its RTP endpoints; lastUsed is when it was last offered / answered
+// or a stream on it last heard from
+type sdpMedia struct {
+	callID   string
+	codecs   map[uint8]rtpCodec
+	lastUsed time.Time
+}
+
+// parseSDP gets the RTP endpoints (as "ip/port") and payload type mappings out of an SDP body
+func parseSDP(callID string, body string) map[string]sdpMedia {
+	media := make(map[string]sdpMedia)
+
+	sessionAddress := ""
+	mediaAddress := ""
+	port := 0
+	codecs := make(map[uint8]rtpCodec)
+
+	add := func() {
+		address := mediaAddress
+		if address == "" {
+			address = sessionAddress
+		}
+
+		if address == "" || port == 0 {
+			return
+		}
+
+		media[fmt.Sprintf("%v/%v", address, port)] = sdpMedia{
+			callID: callID,
+			codecs: codecs,
+		}
+	}
+
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "c="):
+			// c=IN IP4 192.0.2.1
+			fields := strings.Fields(line[2:])
+			if len(fields) < 3 {
+				continue
+			}
+
+			address := strings.Split(fields[2], "/")[0]
+			if port == 0 {
+				sessionAddress = address
+			} else {
+				mediaAddress = address
+			}
+		case strings.HasPrefix(line, "m="):
+			// m=audio 49170 RTP/AVP 0 8 97
+			add()
+
+			mediaAddress = ""
+			port = 0
+			codecs = make(map[uint8]rtpCodec)
+
+			fields := strings.Fields(line[2:])
+			if len(fields) < 2 {
+				continue
+			}
+
+			port, _ = strconv.Atoi(strings.Split(fields[1], "/")[0])
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			// a=rtpmap:97 iLBC/8000
+			fields := strings.Fields(line[len("a=rtpmap:"):])
+			if len(fields) < 2 {
+				continue
+			}
+
+			payloadType, err := strconv.Atoi(fields[0])
+			if err != nil || payloadType < 0 || payloadType > 127 {
+				continue
+			}
+
+			encoding := strings.Split(fields[1], "/")
+			if len(encoding) < 2 {
+				continue
+			}
+
+			clockRate, err := strconv.Atoi(encoding[1])
+			if err != nil || clockRate <= 0 {
+				continue
+			}
+
+			codecs[uint8(payloadType)] = rtpCodec{encoding[0], clockRate}
+		}
+	}
+
+	add()
+
+	return media
+}
+
+// getSDPMedia gets the RTP endpoints offered / answered in a SIP message (if it has an SDP body)
+func getSDPMedia(sip *layers.SIP) map[string]sdpMedia {
+	callID := sip.GetCallID()
+	if callID == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(strings.ToLower(sip.GetFirstHeader("Content-Type")), "application/sdp") {
+		return nil
+	}
+
+	return parseSDP(callID, string(sip.LayerPayload()))
+}
@@ -0,0 +1,53 @@
+package packet_dumper
+
+import (
+	"time"
+)
+
+type DecodeError struct {
+	Layer   string   `json:"layer"`
+	Decoded []string `json:"decoded"`
+	Error   string   `json:"error"`
+	Length  int      `json:"length"`
+}
+
+type Stats struct {
+	FirstPacket  *time.Time        `json:"first_packet,omitempty"`
+	LastPacket   *time.Time        `json:"last_packet,omitempty"`
+	Packets      uint64            `json:"packets"`
+	Bytes        uint64            `json:"bytes"`
+	DecodeErrors uint64            `json:"decode_errors"`
+	Truncated    uint64            `json:"truncated"`
+	Protocols    map[string]uint64 `json:"protocols"`
+}
+
+func newStats() *Stats {
+	return &Stats{
+		Protocols: make(map[string]uint64),
+	}
+}
+
+func (s *Stats) update(packetData PacketData, decodeErr error) {
+	timestamp := packetData.Timestamp
+
+	if s.FirstPacket == nil {
+		s.FirstPacket = &timestamp
+	}
+
+	s.LastPacket = &timestamp
+
+	s.Packets++
+	s.Bytes += uint64(packetData.Length)
+
+	if decodeErr != nil {
+		s.DecodeErrors++
+	}
+
+	if packetData.Truncated {
+		s.Truncated++
+	}
+
+	if packetData.Protocol != "" {
+		s.Protocols[packetData.Protocol]++
+	}
+}
@@ -0,0 +1,251 @@
+package packet_dumper
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	stpEventNew            = "new"
+	stpEventRootChanged    = "root_changed"
+	stpEventTopologyChange = "topology_change"
+	stpEventExpired        = "expired"
+
+	stpTypeConfig = 0x00
+	stpTypeRST    = 0x02
+	stpTypeTCN    = 0x80
+
+	stpFlagTopologyChange = 0x01
+
+	stpDefaultMaxAge = 20 * time.Second
+
+	// Cisco's PVST+ is sent over SNAP rather than straight over LLC, with the VLAN in a TLV on the end
+	pvstType = 0x010b
+)
+
+var (
+	ciscoOUI = []byte{0x00, 0x00, 0x0c}
+
+	stpVersions = map[int]string{
+		0: "stp",
+		2: "rstp",
+		3: "mstp",
+	}
+)
+
+type STP struct {
+	Event          string    `json:"event"`
+	Protocol       string    `json:"protocol"`
+	VLANID         int       `json:"vlan_id,omitempty"`
+	SourceMAC      string    `json:"source_mac"`
+	BridgeID       string    `json:"bridge_id,omitempty"`
+	PortID         string    `json:"port_id,omitempty"`
+	RootID         string    `json:"root_id,omitempty"`
+	PreviousRootID string    `json:"previous_root_id,omitempty"`
+	RootPathCost   uint32    `json:"root_path_cost"`
+	TopologyChange bool      `json:"topology_change"`
+	LastSeen       time.Time `json:"last_seen"`
+}
+
+type stpBridge struct {
+	record STP
+	maxAge time.Duration
+}
+
+// stpTracker follows the BPDUs from each bridge port heard (per VLAN for PVST+) and calls back when one is first seen,
+// when the root it advertises changes, when it starts flagging a topology change (or sends a topology change
+// notification) and when it hasn't been heard from for its max age
+type stpTracker struct {
+	bridges map[string]*stpBridge
+}
+
+func newSTPTracker() *stpTracker {
+	return &stpTracker{
+		bridges: make(map[string]*stpBridge),
+	}
+}
+
+func formatBridgeID(id []byte) string {
+	if len(id) != 8 {
+		return ""
+	}
+
+	return fmt.Sprintf("%02x%02x.%v", id[0], id[1], net.HardwareAddr(id[2:]))
+}
+
+// getBPDU gets a BPDU (and whether it's PVST+) as gopacket doesn't decode STP beyond the LLC header
+func getBPDU(packet gopacket.Packet) ([]byte, bool) {
+	stpLayer := packet.Layer(layers.LayerTypeSTP)
+	if stpLayer != nil {
+		return stpLayer.LayerContents(), false
+	}
+
+	snapLayer := packet.Layer(layers.LayerTypeSNAP)
+	if snapLayer == nil {
+		return nil, false
+	}
+
+	snap := snapLayer.(*layers.SNAP)
+	if !bytes.Equal(snap.OrganizationalCode, ciscoOUI) || snap.Type != pvstType {
+		return nil, false
+	}
+
+	return snap.LayerPayload(), true
+}
+
+func (s *stpTracker) emit(record STP, callback func(output Output) error) error {
+	return callback(Output{
+		Timestamp: time.Now(),
+		STP:       &record,
+	})
+}
+
+// expire calls back for the bridge ports that haven't sent a BPDU for longer than their max age
+func (s *stpTracker) expire(timestamp time.Time, callback func(output Output) error) error {
+	keys := make([]string, 0)
+
+	for key, bridge := range s.bridges {
+		if timestamp.Sub(bridge.record.LastSeen) > bridge.maxAge {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		record := s.bridges[key].record
+		record.Event = stpEventExpired
+
+		delete(s.bridges, key)
+
+		err := s.emit(record, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *stpTracker) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	err := s.expire(packetData.Timestamp, callback)
+	if err != nil {
+		return err
+	}
+
+	bpdu, pvst := getBPDU(packet)
+	if bpdu == nil {
+		return nil
+	}
+
+	r := &fieldReader{data: bpdu}
+
+	if r.uint(2) != 0 {
+		return nil
+	}
+
+	version := r.uint(1)
+	bpduType := r.uint(1)
+
+	record := STP{
+		Protocol:  stpVersions[version],
+		SourceMAC: packetData.SourceMAC,
+		LastSeen:  packetData.Timestamp,
+	}
+
+	if record.Protocol == "" {
+		record.Protocol = fmt.Sprintf("version%v", version)
+	}
+
+	// a topology change notification is just the header (so we go on what we know of the bridge port)
+	if bpduType == stpTypeTCN {
+		vlanID := 0
+		if len(packetData.VLANIDs) > 0 {
+			vlanID = packetData.VLANIDs[len(packetData.VLANIDs)-1]
+		}
+
+		bridge, ok := s.bridges[fmt.Sprintf("%v/%v", vlanID, packetData.SourceMAC)]
+		if ok {
+			record = bridge.record
+			record.LastSeen = packetData.Timestamp
+		}
+
+		record.VLANID = vlanID
+		record.Event = stpEventTopologyChange
+		record.TopologyChange = true
+
+		return s.emit(record, callback)
+	}
+
+	if bpduType != stpTypeConfig && bpduType != stpTypeRST {
+		return nil
+	}
+
+	flags := r.uint(1)
+	record.RootID = formatBridgeID(r.read(8))
+	record.RootPathCost = uint32(r.uint(4))
+	record.BridgeID = formatBridgeID(r.read(8))
+	record.PortID = fmt.Sprintf("%04x", r.uint(2))
+	r.read(2) // message age
+	maxAge := time.Duration(r.uint(2)) * time.Second / 256
+	r.read(2 + 2) // hello time, forward delay
+	record.TopologyChange = flags&stpFlagTopologyChange != 0
+
+	if r.bad {
+		return nil
+	}
+
+	if maxAge <= 0 {
+		maxAge = stpDefaultMaxAge
+	}
+
+	// PVST+ has the VLAN in a TLV after the BPDU
+	vlanID := 0
+	if pvst {
+		if bpduType == stpTypeRST {
+			r.read(1) // version 1 length
+		}
+
+		if r.uint(2) == 0 && r.uint(2) == 2 {
+			vlanID = r.uint(2)
+		}
+	}
+
+	if vlanID == 0 && len(packetData.VLANIDs) > 0 {
+		vlanID = packetData.VLANIDs[len(packetData.VLANIDs)-1]
+	}
+
+	record.VLANID = vlanID
+
+	key := fmt.Sprintf("%v/%v", vlanID, packetData.SourceMAC)
+
+	bridge, known := s.bridges[key]
+
+	s.bridges[key] = &stpBridge{
+		record: record,
+		maxAge: maxAge,
+	}
+
+	switch {
+	case !known:
+		record.Event = stpEventNew
+	case bridge.record.RootID != record.RootID:
+		record.Event = stpEventRootChanged
+		record.PreviousRootID = bridge.record.RootID
+	case record.TopologyChange && !bridge.record.TopologyChange:
+		record.Event = stpEventTopologyChange
+	default:
+		return nil
+	}
+
+	return s.emit(record, callback)
+}
+
+func (s *stpTracker) flush(callback func(output Output) error) error {
+	return nil
+}
@@ -0,0 +1,451 @@
+package packet_dumper
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/initialed85/drive_test/internal/probe_stats"
+	"time"
+)
+
+const (
+	defaultTCPTimeout = time.Second * 60
+
+	tcpStateOpen     = "open"
+	tcpStateClosed   = "closed"
+	tcpStateReset    = "reset"
+	tcpStateTimedOut = "timed_out"
+
+	// segments are only held for RTT samples up to this many per direction
+	maxOutstandingSegments = 1024
+
+	// a connection's RTT percentiles come from a sample of this many (however long it's open)
+	connectionRTTSamples = 256
+
+	// how soon after the latest segment an older one counts as out of order rather than retransmitted, until there's
+	// an RTT sample to go by
+	defaultOutOfOrderWindow = time.Millisecond * 3
+)
+
+type TCPCounters struct {
+	Packets            uint64  `json:"packets"`
+	DataSegments       uint64  `json:"data_segments"`
+	Bytes              uint64  `json:"bytes"`
+	Retransmissions    uint64  `json:"retransmissions"`
+	RetransmissionRate float64 `json:"retransmission_rate"`
+	OutOfOrder         uint64  `json:"out_of_order"`
+	ZeroWindows        uint64  `json:"zero_windows"`
+	Resets             uint64  `json:"resets"`
+}
+
+func (c *TCPCounters) setRate() {
+	if c.DataSegments > 0 {
+		c.RetransmissionRate = float64(c.Retransmissions) / float64(c.DataSegments)
+	}
+}
+
+type TCPConnection struct {
+	ClientIP     string              `json:"client_ip"`
+	ClientPort   int                 `json:"client_port"`
+	ServerIP     string              `json:"server_ip"`
+	ServerPort   int                 `json:"server_port"`
+	Start        time.Time           `json:"start"`
+	End          time.Time           `json:"end"`
+	Duration     float64             `json:"duration_ms"`
+	State        string              `json:"state"`
+	HandshakeRTT *float64            `json:"handshake_rtt_ms,omitempty"`
+	RTT          probe_stats.Summary `json:"rtt"`
+	Client       TCPCounters         `json:"client"`
+	Server       TCPCounters         `json:"server"`
+	Application  *Application        `json:"application,omitempty"`
+}
+
+type TCPInterval struct {
+	IntervalStart     time.Time `json:"interval_start"`
+	IntervalEnd       time.Time `json:"interval_end"`
+	Connections       int       `json:"connections"`
+	ConnectionsOpened int       `json:"connections_opened"`
+	ConnectionsClosed int       `json:"connections_closed"`
+	TCPCounters
+	HandshakeRTT probe_stats.Summary `json:"handshake_rtt"`
+	RTT          probe_stats.Summary `json:"rtt"`
+}
+
+// outstandingSegment is a segment waiting on the ACK that ends at its end sequence number
+type outstandingSegment struct {
+	end           uint32
+	sent          time.Time
+	retransmitted bool
+}
+
+// tcpDirection's outstanding segments are in sequence order (as they're only added when they advance it), so an ACK
+// only has to look at those at the front; they're indexed by end sequence number to find retransmissions
+type tcpDirection struct {
+	counters    TCPCounters
+	started     bool
+	nextSeq     uint32
+	lastSegment time.Time
+	outstanding []*outstandingSegment
+	byEnd       map[uint32]*outstandingSegment
+	fin         bool
+}
+
+func newTCPDirection() tcpDirection {
+	return tcpDirection{
+		outstanding: make([]*outstandingSegment, 0),
+		byEnd:       make(map[uint32]*outstandingSegment),
+	}
+}
+
+type tcpConnection struct {
+	record     TCPConnection
+	client     tcpDirection
+	server     tcpDirection
+	synTime    time.Time
+	synAckTime time.Time
+	rtt        *probe_stats.Reservoir
+	lastRTT    float64
+	lastSeen   time.Time
+	closed     bool
+}
+
+type tcpInterval struct {
+	record       TCPInterval
+	connections  map[string]bool
+	handshakeRTT []float64
+	rtt          []float64
+}
+
+func newTCPInterval() tcpInterval {
+	return tcpInterval{
+		connections:  make(map[string]bool),
+		handshakeRTT: make([]float64, 0),
+		rtt:          make([]float64, 0),
+	}
+}
+
+// tcpAnalyzer follows TCP connections (handshake RTT, data / ACK RTT samples, retransmissions, out of order segments,
+// zero windows and resets) and calls back with a summary per connection once it closes, resets or times out as well as
+// a summary across all connections per interval (all driven by packet timestamps)
+type tcpAnalyzer struct {
+	clock       intervalClock
+	timeout     time.Duration
+	connections map[string]*tcpConnection
+	current     tcpInterval
+}
+
+func newTCPAnalyzer(interval time.Duration, timeout time.Duration) *tcpAnalyzer {
+	return &tcpAnalyzer{
+		clock:       newIntervalClock(interval),
+		timeout:     timeout,
+		connections: make(map[string]*tcpConnection),
+		current:     newTCPInterval(),
+	}
+}
+
+// seqAfter compares sequence numbers allowing for wrap around
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// count applies a change to both the connection's and the interval's counters
+func (t *tcpAnalyzer) count(direction *tcpDirection, change func(counters *TCPCounters)) {
+	change(&direction.counters)
+	change(&t.current.record.TCPCounters)
+}
+
+func (t *tcpAnalyzer) emitInterval(start time.Time, callback func(output Output) error) error {
+	current := t.current
+
+	t.current = newTCPInterval()
+
+	record := current.record
+
+	record.IntervalStart = start
+	record.IntervalEnd = start.Add(t.clock.interval)
+	record.Connections = len(current.connections)
+	record.HandshakeRTT = probe_stats.Summarise(current.handshakeRTT)
+	record.RTT = probe_stats.Summarise(current.rtt)
+	record.setRate()
+
+	return callback(Output{
+		Timestamp: time.Now(),
+		TCP:       &record,
+	})
+}
+
+func (t *tcpAnalyzer) emitConnection(connection *tcpConnection, state string, callback func(output Output) error) error {
+	connection.closed = true
+
+	if state != tcpStateOpen {
+		t.current.record.ConnectionsClosed++
+	}
+
+	record := connection.record
+
+	record.End = connection.lastSeen
+	record.Duration = probe_stats.Milliseconds(record.End.Sub(record.Start))
+	record.State = state
+	record.RTT = connection.rtt.Summary()
+	record.Client = connection.client.counters
+	record.Server = connection.server.counters
+	record.Client.setRate()
+	record.Server.setRate()
+
+	return callback(Output{
+		Timestamp:     time.Now(),
+		TCPConnection: &record,
+	})
+}
+
+// expire forgets idle connections, calling back for those that hadn't already closed
+func (t *tcpAnalyzer) expire(timestamp time.Time, callback func(output Output) error) error {
+	for key, connection := range t.connections {
+		if timestamp.Sub(connection.lastSeen) < t.timeout {
+			continue
+		}
+
+		delete(t.connections, key)
+
+		if connection.closed {
+			continue
+		}
+
+		err := t.emitConnection(connection, tcpStateTimedOut, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *tcpAnalyzer) getConnection(tcp *layers.TCP, packetData PacketData) (string, *tcpConnection) {
+	source := fmt.Sprintf("%v/%v", packetData.SourceIP, packetData.SourcePort)
+	destination := fmt.Sprintf("%v/%v", packetData.DestinationIP, packetData.DestinationPort)
+
+	key := source + "-" + destination
+	if destination < source {
+		key = destination + "-" + source
+	}
+
+	connection, ok := t.connections[key]
+
+	// a new SYN on a finished connection's 4-tuple is a new connection
+	if ok && (!connection.closed || !tcp.SYN || tcp.ACK) {
+		return key, connection
+	}
+
+	connection = &tcpConnection{
+		record: TCPConnection{
+			ClientIP:   packetData.SourceIP,
+			ClientPort: packetData.SourcePort,
+			ServerIP:   packetData.DestinationIP,
+			ServerPort: packetData.DestinationPort,
+			Start:      packetData.Timestamp,
+		},
+		client: newTCPDirection(),
+		server: newTCPDirection(),
+		rtt:    probe_stats.NewReservoir(connectionRTTSamples),
+	}
+
+	// without a SYN to go by, a SYN-ACK still gives away who the client is; otherwise assume it's the sender
+	if tcp.SYN && tcp.ACK {
+		connection.record.ClientIP, connection.record.ServerIP = connection.record.ServerIP, connection.record.ClientIP
+		connection.record.ClientPort, connection.record.ServerPort = connection.record.ServerPort, connection.record.ClientPort
+	}
+
+	t.connections[key] = connection
+	t.current.record.ConnectionsOpened++
+
+	return key, connection
+}
+
+func (t *tcpAnalyzer) handleSegment(connection *tcpConnection, direction *tcpDirection, tcp *layers.TCP, timestamp time.Time) {
+	length := uint32(len(tcp.Payload))
+	if tcp.SYN {
+		length++
+	}
+
+	if tcp.FIN {
+		length++
+		direction.fin = true
+	}
+
+	if length == 0 {
+		return
+	}
+
+	if len(tcp.Payload) > 0 {
+		t.count(direction, func(counters *TCPCounters) {
+			counters.DataSegments++
+			counters.Bytes += uint64(len(tcp.Payload))
+		})
+	}
+
+	end := tcp.Seq + length
+
+	switch {
+	case !direction.started || seqAfter(end, direction.nextSeq):
+		direction.started = true
+		direction.nextSeq = end
+
+		if len(direction.outstanding) < maxOutstandingSegments {
+			segment := &outstandingSegment{end: end, sent: timestamp}
+
+			direction.outstanding = append(direction.outstanding, segment)
+			direction.byEnd[end] = segment
+		}
+	default:
+		window := defaultOutOfOrderWindow
+		if connection.lastRTT > 0 {
+			window = time.Duration(connection.lastRTT * float64(time.Millisecond))
+		}
+
+		if timestamp.Sub(direction.lastSegment) < window {
+			t.count(direction, func(counters *TCPCounters) {
+				counters.OutOfOrder++
+			})
+		} else {
+			t.count(direction, func(counters *TCPCounters) {
+				counters.Retransmissions++
+			})
+		}
+
+		// per Karn's algorithm, a segment that's been sent more than once can't give an RTT sample
+		segment, ok := direction.byEnd[end]
+		if ok {
+			segment.retransmitted = true
+		}
+	}
+
+	direction.lastSegment = timestamp
+}
+
+// handleACK takes an RTT sample if the ACK exactly covers an outstanding segment and forgets those it covers
+func (t *tcpAnalyzer) handleACK(connection *tcpConnection, reverse *tcpDirection, ack uint32, timestamp time.Time) {
+	for len(reverse.outstanding) > 0 {
+		segment := reverse.outstanding[0]
+		if seqAfter(segment.end, ack) {
+			break
+		}
+
+		if segment.end == ack && !segment.retransmitted {
+			rtt := probe_stats.Milliseconds(timestamp.Sub(segment.sent))
+
+			connection.rtt.Add(rtt)
+			connection.lastRTT = rtt
+			t.current.rtt = append(t.current.rtt, rtt)
+		}
+
+		reverse.outstanding[0] = nil
+		reverse.outstanding = reverse.outstanding[1:]
+		delete(reverse.byEnd, segment.end)
+	}
+}
+
+func (t *tcpAnalyzer) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	starts := t.clock.advance(packetData.Timestamp)
+	for _, start := range starts {
+		err := t.emitInterval(start, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(starts) > 0 {
+		err := t.expire(packetData.Timestamp, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	tcpLayer := innermostLayer(packet, layers.LayerTypeTCP)
+	if tcpLayer == nil {
+		return nil
+	}
+
+	tcp := tcpLayer.(*layers.TCP)
+
+	key, connection := t.getConnection(tcp, packetData)
+
+	connection.lastSeen = packetData.Timestamp
+
+	if packetData.Application != nil {
+		connection.record.Application = packetData.Application
+	}
+
+	if connection.closed {
+		return nil
+	}
+
+	t.current.connections[key] = true
+
+	direction, reverse := &connection.client, &connection.server
+	if packetData.SourceIP != connection.record.ClientIP || packetData.SourcePort != connection.record.ClientPort {
+		direction, reverse = reverse, direction
+	}
+
+	t.count(direction, func(counters *TCPCounters) {
+		counters.Packets++
+	})
+
+	if tcp.RST {
+		t.count(direction, func(counters *TCPCounters) {
+			counters.Resets++
+		})
+
+		return t.emitConnection(connection, tcpStateReset, callback)
+	}
+
+	if tcp.Window == 0 && !tcp.SYN && !tcp.FIN {
+		t.count(direction, func(counters *TCPCounters) {
+			counters.ZeroWindows++
+		})
+	}
+
+	switch {
+	case tcp.SYN && !tcp.ACK && connection.synTime.IsZero():
+		connection.synTime = packetData.Timestamp
+	case tcp.SYN && tcp.ACK && connection.synAckTime.IsZero():
+		connection.synAckTime = packetData.Timestamp
+	case !tcp.SYN && tcp.ACK && connection.record.HandshakeRTT == nil && !connection.synAckTime.IsZero():
+		// SYN to SYN-ACK plus SYN-ACK to ACK is the whole RTT wherever the capture is along the path
+		connection.record.HandshakeRTT = durationPointer(connection.synTime, packetData.Timestamp)
+		if connection.record.HandshakeRTT != nil {
+			t.current.handshakeRTT = append(t.current.handshakeRTT, *connection.record.HandshakeRTT)
+		}
+	}
+
+	t.handleSegment(connection, direction, tcp, packetData.Timestamp)
+
+	if tcp.ACK {
+		t.handleACK(connection, reverse, tcp.Ack, packetData.Timestamp)
+	}
+
+	if connection.client.fin && connection.server.fin {
+		return t.emitConnection(connection, tcpStateClosed, callback)
+	}
+
+	return nil
+}
+
+// flush emits the partially complete interval (if any packets have been seen) and every connection still open
+func (t *tcpAnalyzer) flush(callback func(output Output) error) error {
+	for _, connection := range t.connections {
+		if connection.closed {
+			continue
+		}
+
+		err := t.emitConnection(connection, tcpStateOpen, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !t.clock.started() {
+		return nil
+	}
+
+	return t.emitInterval(t.clock.start, callback)
+}
@@ -0,0 +1,116 @@
+package packet_dumper
+
+import (
+	"github.com/google/gopacket"
+	"time"
+)
+
+type Counters struct {
+	Packets        uint64  `json:"packets"`
+	Bytes          uint64  `json:"bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+type DirectionCounters struct {
+	RX    Counters `json:"rx"`
+	TX    Counters `json:"tx"`
+	Other Counters `json:"other"`
+}
+
+func (d *DirectionCounters) add(direction string, length int) {
+	counters := &d.Other
+
+	switch direction {
+	case directionRX:
+		counters = &d.RX
+	case directionTX:
+		counters = &d.TX
+	}
+
+	counters.Packets++
+	counters.Bytes += uint64(length)
+}
+
+func (d *DirectionCounters) setRates(interval time.Duration) {
+	for _, counters := range []*Counters{&d.RX, &d.TX, &d.Other} {
+		counters.BytesPerSecond = float64(counters.Bytes) / interval.Seconds()
+	}
+}
+
+type Throughput struct {
+	IntervalStart time.Time `json:"interval_start"`
+	IntervalEnd   time.Time `json:"interval_end"`
+	DirectionCounters
+	Protocols map[string]*DirectionCounters `json:"protocols"`
+}
+
+func newThroughput() Throughput {
+	return Throughput{
+		Protocols: make(map[string]*DirectionCounters),
+	}
+}
+
+type throughputAggregator struct {
+	clock   intervalClock
+	local   localAddresses
+	current Throughput
+}
+
+func newThroughputAggregator(interval time.Duration, local localAddresses) *throughputAggregator {
+	return &throughputAggregator{
+		clock:   newIntervalClock(interval),
+		local:   local,
+		current: newThroughput(),
+	}
+}
+
+func (t *throughputAggregator) emit(start time.Time, callback func(output Output) error) error {
+	throughput := t.current
+
+	t.current = newThroughput()
+
+	throughput.IntervalStart = start
+	throughput.IntervalEnd = start.Add(t.clock.interval)
+
+	throughput.setRates(t.clock.interval)
+	for _, protocol := range throughput.Protocols {
+		protocol.setRates(t.clock.interval)
+	}
+
+	return callback(Output{
+		Timestamp:  time.Now(),
+		Throughput: &throughput,
+	})
+}
+
+func (t *throughputAggregator) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	for _, start := range t.clock.advance(packetData.Timestamp) {
+		err := t.emit(start, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	direction := t.local.direction(packetData)
+
+	t.current.add(direction, packetData.Length)
+
+	protocol, ok := t.current.Protocols[packetData.Protocol]
+	if !ok {
+		protocol = &DirectionCounters{}
+		t.current.Protocols[packetData.Protocol] = protocol
+	}
+
+	protocol.add(direction, packetData.Length)
+
+	return nil
+}
+
+// flush emits the partially complete interval (if any packets have been seen)
+func (t *throughputAggregator) flush(callback func(output Output) error) error {
+	if !t.clock.started() {
+		return nil
+	}
+
+	return t.emit(t.clock.start, callback)
+}
@@ -0,0 +1,192 @@
+package packet_dumper
+
+import (
+	"fmt"
+	"github.com/initialed85/drive_test/internal/capture_trigger"
+	"github.com/initialed85/drive_test/pkg/gps_dumper"
+	"github.com/stratoberry/go-gpsd"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	triggerBFDDown        = "bfd_down"
+	triggerGatewayChanged = "gateway_changed"
+	triggerHTTP           = "http"
+	triggerGeofence       = "geofence"
+
+	// how many external triggers a capture can have waiting before more are dropped
+	triggerQueueSize = 16
+
+	earthRadius = 6371000.0
+)
+
+var triggerNames = []string{
+	triggerBFDDown,
+	triggerGatewayChanged,
+	triggerHTTP,
+	triggerGeofence,
+}
+
+// Geofence is a circle (radius in metres) that triggers a capture when entered
+type Geofence struct {
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Radius    float64 `json:"radius"`
+}
+
+type trigger struct {
+	name   string
+	reason string
+	time   time.Time
+}
+
+// triggerHub hands the triggers from outside any one capture (HTTP requests, geofences) to every capture
+type triggerHub struct {
+	mu          sync.Mutex
+	subscribers []chan trigger
+}
+
+func (h *triggerHub) subscribe() chan trigger {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subscriber := make(chan trigger, triggerQueueSize)
+
+	h.subscribers = append(h.subscribers, subscriber)
+
+	return subscriber
+}
+
+func (h *triggerHub) fire(t trigger) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, subscriber := range h.subscribers {
+		select {
+		case subscriber <- t:
+		default:
+		}
+	}
+}
+
+// ServeHTTP fires an http trigger for a request to /trigger (with an optional "reason" query parameter)
+func (h *triggerHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/trigger" {
+		http.NotFound(w, r)
+		return
+	}
+
+	h.fire(trigger{
+		name:   triggerHTTP,
+		reason: r.URL.Query().Get("reason"),
+		time:   time.Now(),
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = fmt.Fprintln(w, "triggered")
+}
+
+// distance is the great circle distance in metres between two points
+func distance(latitude1, longitude1, latitude2, longitude2 float64) float64 {
+	toRadians := func(degrees float64) float64 {
+		return degrees * math.Pi / 180
+	}
+
+	deltaLatitude := toRadians(latitude2 - latitude1)
+	deltaLongitude := toRadians(longitude2 - longitude1)
+
+	a := math.Pow(math.Sin(deltaLatitude/2), 2) +
+		math.Cos(toRadians(latitude1))*math.Cos(toRadians(latitude2))*math.Pow(math.Sin(deltaLongitude/2), 2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// watchGeofences fires a geofence trigger whenever a fix from gpsd moves from outside a geofence to inside it
+func (h *triggerHub) watchGeofences(address string, geofences []Geofence) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+
+	inside := make(map[string]bool)
+
+	dumper, err := gps_dumper.New(host, port, func(output gps_dumper.Output) error {
+		report := output.Report
+		if report == nil || report.Mode < gpsd.Mode2D {
+			return nil
+		}
+
+		for _, geofence := range geofences {
+			wasInside, known := inside[geofence.Name]
+
+			inside[geofence.Name] = distance(report.Lat, report.Lon, geofence.Latitude, geofence.Longitude) <= geofence.Radius
+
+			// starting off inside isn't entering it
+			if !known || wasInside || !inside[geofence.Name] {
+				continue
+			}
+
+			h.fire(trigger{
+				name:   triggerGeofence,
+				reason: fmt.Sprintf("entered %v at %v, %v", geofence.Name, report.Lat, report.Lon),
+				time:   output.Timestamp,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dumper.Watch()
+
+	return nil
+}
+
+// startTriggers starts whichever of the external triggers are configured
+func startTriggers(config RingBufferConfig) (*triggerHub, error) {
+	hub := &triggerHub{
+		subscribers: make([]chan trigger, 0),
+	}
+
+	if config.HTTPAddress != "" {
+		listener, err := net.Listen("tcp", config.HTTPAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		go func() {
+			_ = http.Serve(listener, hub)
+		}()
+	}
+
+	if config.GPSDAddress != "" && len(config.Geofences) > 0 {
+		err := hub.watchGeofences(config.GPSDAddress, config.Geofences)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hub, nil
+}
+
+// Trigger asks a running packet_dumper (at its ring buffer's "http_address") to dump a capture
+func Trigger(config Config, reason string) error {
+	if config.RingBuffer == nil || config.RingBuffer.HTTPAddress == "" {
+		return fmt.Errorf("no ring buffer http_address configured")
+	}
+
+	return capture_trigger.Fire(config.RingBuffer.HTTPAddress, reason)
+}
@@ -0,0 +1,28 @@
+package packet_dumper
+
+import (
+	"github.com/google/gopacket"
+)
+
+// Headers are the network / transport headers at one level of encapsulation
+type Headers struct {
+	Protocol        string `json:"protocol"`
+	SourceIP        string `json:"source_ip"`
+	DestinationIP   string `json:"destination_ip"`
+	SourcePort      int    `json:"source_port"`
+	DestinationPort int    `json:"destination_port"`
+}
+
+// innermostLayer is like packet.Layer but takes the last matching layer, so that e.g. UDP carried in GTP-U isn't
+// confused with the UDP carrying the tunnel
+func innermostLayer(packet gopacket.Packet, layerType gopacket.LayerType) gopacket.Layer {
+	packetLayers := packet.Layers()
+
+	for i := len(packetLayers) - 1; i >= 0; i-- {
+		if packetLayers[i].LayerType() == layerType {
+			return packetLayers[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,341 @@
+package packet_dumper
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"math"
+	"time"
+)
+
+// 20 MHz, long guard interval, single spatial stream data rates (in Mb/s) for HT / VHT MCS indexes 0 - 9
+var mcsRates = []float64{6.5, 13, 19.5, 26, 39, 52, 58.5, 65, 78, 86.7}
+
+type WiFiData struct {
+	FrameType      string  `json:"frame_type"`
+	FrameSubtype   string  `json:"frame_subtype"`
+	BSSID          string  `json:"bssid,omitempty"`
+	TransmitterMAC string  `json:"transmitter_mac,omitempty"`
+	ReceiverMAC    string  `json:"receiver_mac,omitempty"`
+	Retry          bool    `json:"retry"`
+	BadFCS         bool    `json:"bad_fcs"`
+	RSSI           *int    `json:"rssi_dbm,omitempty"`
+	Noise          *int    `json:"noise_dbm,omitempty"`
+	Frequency      int     `json:"frequency_mhz,omitempty"`
+	Channel        int     `json:"channel,omitempty"`
+	DataRate       float64 `json:"data_rate_mbps,omitempty"`
+	MCS            *int    `json:"mcs,omitempty"`
+	SpatialStreams int     `json:"spatial_streams,omitempty"`
+	Bandwidth      int     `json:"bandwidth_mhz,omitempty"`
+	ShortGI        bool    `json:"short_gi"`
+	Airtime        float64 `json:"airtime_us,omitempty"`
+}
+
+func frequencyToChannel(frequency int) int {
+	switch {
+	case frequency == 2484:
+		return 14
+	case frequency >= 2412 && frequency <= 2472:
+		return (frequency - 2407) / 5
+	case frequency >= 5955 && frequency <= 7115:
+		return (frequency - 5950) / 5
+	case frequency >= 5000 && frequency < 5955:
+		return (frequency - 5000) / 5
+	}
+
+	return 0
+}
+
+func frameTypeName(frameType layers.Dot11Type) string {
+	switch frameType.MainType() {
+	case layers.Dot11TypeMgmt:
+		return "management"
+	case layers.Dot11TypeCtrl:
+		return "control"
+	case layers.Dot11TypeData:
+		return "data"
+	}
+
+	return "extension"
+}
+
+// getBSSID works out which address is the BSSID from the To DS / From DS bits (there isn't one for WDS frames or
+// for most control frames)
+func getBSSID(dot11 *layers.Dot11) string {
+	if dot11.Type.MainType() == layers.Dot11TypeCtrl {
+		return ""
+	}
+
+	switch {
+	case !dot11.Flags.ToDS() && !dot11.Flags.FromDS():
+		return dot11.Address3.String()
+	case dot11.Flags.ToDS() && !dot11.Flags.FromDS():
+		return dot11.Address1.String()
+	case !dot11.Flags.ToDS() && dot11.Flags.FromDS():
+		return dot11.Address2.String()
+	}
+
+	return ""
+}
+
+// setRate fills in the data rate from whichever of the legacy rate, HT MCS or VHT MCS / NSS fields are present
+func (w *WiFiData) setRate(radioTap *layers.RadioTap) {
+	if radioTap.Present.Rate() {
+		w.DataRate = 0.5 * float64(radioTap.Rate)
+
+		return
+	}
+
+	if radioTap.Present.MCS() && radioTap.MCS.Known.MCSIndex() {
+		mcs := int(radioTap.MCS.MCS)
+
+		w.MCS = &mcs
+		w.SpatialStreams = mcs/8 + 1
+		w.Bandwidth = 20
+		w.ShortGI = radioTap.MCS.Flags.ShortGI()
+
+		if radioTap.MCS.Known.Bandwidth() && radioTap.MCS.Flags.Bandwidth() == 1 {
+			w.Bandwidth = 40
+		}
+	} else if radioTap.Present.VHT() {
+		for _, mcsNSS := range radioTap.VHT.MCSNSS {
+			if !mcsNSS.Present() {
+				continue
+			}
+
+			mcs := int(mcsNSS >> 4)
+
+			w.MCS = &mcs
+			w.SpatialStreams = int(mcsNSS & 0x0f)
+			w.ShortGI = radioTap.VHT.Flags.SGI()
+
+			bandwidth := radioTap.VHT.Bandwidth & 0x1f
+			switch {
+			case bandwidth == 0:
+				w.Bandwidth = 20
+			case bandwidth <= 3:
+				w.Bandwidth = 40
+			case bandwidth <= 10:
+				w.Bandwidth = 80
+			default:
+				w.Bandwidth = 160
+			}
+
+			break
+		}
+	}
+
+	if w.MCS == nil {
+		return
+	}
+
+	// HT MCS indexes go up to 31, encoding the spatial streams as well
+	index := *w.MCS
+	if !radioTap.Present.VHT() {
+		index = index % 8
+	}
+
+	if index >= len(mcsRates) {
+		return
+	}
+
+	// wider channels scale with the number of data subcarriers (52, 108, 234 or 468)
+	subcarriers := map[int]float64{20: 52, 40: 108, 80: 234, 160: 468}[w.Bandwidth]
+
+	w.DataRate = mcsRates[index] * float64(w.SpatialStreams) * subcarriers / 52
+	if w.ShortGI {
+		w.DataRate = w.DataRate * 10 / 9
+	}
+}
+
+// setAirtime is only an estimate; preamble plus payload at the data rate, ignoring SIFS / ACKs / contention
+func (w *WiFiData) setAirtime(radioTap *layers.RadioTap, length int) {
+	if w.DataRate <= 0 {
+		return
+	}
+
+	preamble := 20.0 // OFDM
+
+	switch {
+	case w.MCS != nil && radioTap.Present.VHT():
+		preamble = 36 + 4*float64(w.SpatialStreams)
+	case w.MCS != nil:
+		preamble = 32 + 4*float64(w.SpatialStreams)
+	case w.DataRate <= 11 && radioTap.ChannelFlags.Ghz2() && !radioTap.ChannelFlags.OFDM():
+		preamble = 192 // DSSS / CCK long preamble
+		if radioTap.Flags.ShortPreamble() {
+			preamble = 96
+		}
+	}
+
+	w.Airtime = preamble + math.Ceil(float64(length*8)/w.DataRate)
+}
+
+// getWiFiData gets the WiFiData from whichever of the radiotap / 802.11 headers a frame has (if any)
+func getWiFiData(radioTap *layers.RadioTap, dot11 *layers.Dot11, length int) *WiFiData {
+	if radioTap == nil && dot11 == nil {
+		return nil
+	}
+
+	wifi := WiFiData{}
+
+	if dot11 != nil {
+		wifi.FrameType = frameTypeName(dot11.Type)
+		wifi.FrameSubtype = dot11.Type.String()
+		wifi.BSSID = getBSSID(dot11)
+		wifi.ReceiverMAC = dot11.Address1.String()
+		wifi.Retry = dot11.Flags.Retry()
+
+		if len(dot11.Address2) > 0 {
+			wifi.TransmitterMAC = dot11.Address2.String()
+		}
+	}
+
+	if radioTap != nil {
+		length -= int(radioTap.Length)
+
+		if radioTap.Present.DBMAntennaSignal() {
+			rssi := int(radioTap.DBMAntennaSignal)
+			wifi.RSSI = &rssi
+		}
+
+		if radioTap.Present.DBMAntennaNoise() {
+			noise := int(radioTap.DBMAntennaNoise)
+			wifi.Noise = &noise
+		}
+
+		if radioTap.Present.Channel() {
+			wifi.Frequency = int(radioTap.ChannelFrequency)
+			wifi.Channel = frequencyToChannel(wifi.Frequency)
+		}
+
+		if radioTap.Present.Flags() {
+			wifi.BadFCS = radioTap.Flags.BadFCS()
+		}
+
+		wifi.setRate(radioTap)
+		wifi.setAirtime(radioTap, length)
+	}
+
+	return &wifi
+}
+
+// BSSIDStats is a BSSID's frames in an interval; the RSSI fields are left out if none of its frames had the RSSI
+type BSSIDStats struct {
+	Frames         uint64   `json:"frames"`
+	Bytes          uint64   `json:"bytes"`
+	MeanRSSI       *float64 `json:"mean_rssi_dbm,omitempty"`
+	MinRSSI        *int     `json:"min_rssi_dbm,omitempty"`
+	MaxRSSI        *int     `json:"max_rssi_dbm,omitempty"`
+	Retries        uint64   `json:"retries"`
+	RetryRate      float64  `json:"retry_rate"`
+	Airtime        float64  `json:"airtime_us"`
+	AirtimePercent float64  `json:"airtime_percent"`
+	Frequency      int      `json:"frequency_mhz,omitempty"`
+	Channel        int      `json:"channel,omitempty"`
+	rssiFrames     uint64
+	rssiTotal      float64
+}
+
+type WiFiInterval struct {
+	IntervalStart time.Time              `json:"interval_start"`
+	IntervalEnd   time.Time              `json:"interval_end"`
+	BSSIDs        map[string]*BSSIDStats `json:"bssids"`
+}
+
+type wifiAggregator struct {
+	clock   intervalClock
+	current map[string]*BSSIDStats
+}
+
+func newWiFiAggregator(interval time.Duration) *wifiAggregator {
+	return &wifiAggregator{
+		clock:   newIntervalClock(interval),
+		current: make(map[string]*BSSIDStats),
+	}
+}
+
+func (w *wifiAggregator) emit(start time.Time, callback func(output Output) error) error {
+	bssids := w.current
+
+	w.current = make(map[string]*BSSIDStats)
+
+	for _, stats := range bssids {
+		if stats.rssiFrames > 0 {
+			meanRSSI := stats.rssiTotal / float64(stats.rssiFrames)
+			stats.MeanRSSI = &meanRSSI
+		}
+
+		if stats.Frames > 0 {
+			stats.RetryRate = float64(stats.Retries) / float64(stats.Frames)
+		}
+
+		stats.AirtimePercent = stats.Airtime / float64(w.clock.interval/time.Microsecond) * 100
+	}
+
+	return callback(Output{
+		Timestamp: time.Now(),
+		WiFi: &WiFiInterval{
+			IntervalStart: start,
+			IntervalEnd:   start.Add(w.clock.interval),
+			BSSIDs:        bssids,
+		},
+	})
+}
+
+func (w *wifiAggregator) handlePacket(packet gopacket.Packet, packetData PacketData, callback func(output Output) error) error {
+	for _, start := range w.clock.advance(packetData.Timestamp) {
+		err := w.emit(start, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	wifi := packetData.WiFi
+	if wifi == nil || wifi.BSSID == "" {
+		return nil
+	}
+
+	stats, ok := w.current[wifi.BSSID]
+	if !ok {
+		stats = &BSSIDStats{}
+		w.current[wifi.BSSID] = stats
+	}
+
+	stats.Frames++
+	stats.Bytes += uint64(packetData.Length)
+	stats.Airtime += wifi.Airtime
+
+	if wifi.Retry {
+		stats.Retries++
+	}
+
+	if wifi.Frequency != 0 {
+		stats.Frequency = wifi.Frequency
+		stats.Channel = wifi.Channel
+	}
+
+	if wifi.RSSI != nil {
+		rssi := *wifi.RSSI
+
+		if stats.MinRSSI == nil || rssi < *stats.MinRSSI {
+			stats.MinRSSI = &rssi
+		}
+
+		if stats.MaxRSSI == nil || rssi > *stats.MaxRSSI {
+			stats.MaxRSSI = &rssi
+		}
+
+		stats.rssiFrames++
+		stats.rssiTotal += float64(rssi)
+	}
+
+	return nil
+}
+
+func (w *wifiAggregator) flush(callback func(output Output) error) error {
+	if !w.clock.started() {
+		return nil
+	}
+
+	return w.emit(w.clock.start, callback)
+}
@@ -0,0 +1,66 @@
+package packet_dumper
+
+import (
+	"testing"
+)
+
+// testdata/wifi_radiotap.pcap has three data frames for BSSID 02:00:00:00:00:0a on channel 1 (RSSI -40, -60 (a retry)
+// and -50 dBm) and two for BSSID 02:00:00:00:00:0b on channel 36 without the RSSI, all within the same second
+func TestReadFileWiFiAggregate(t *testing.T) {
+	intervals := make([]*WiFiInterval, 0)
+
+	err := ReadFile("testdata/wifi_radiotap.pcap", Config{Aggregate: true, WiFiAggregate: true, WiFiAggregateInterval: 1}, func(output Output) error {
+		if output.DecodeError != nil {
+			t.Errorf("unexpected decode error: %+v", *output.DecodeError)
+		}
+
+		if output.WiFi != nil {
+			intervals = append(intervals, output.WiFi)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(intervals) != 1 {
+		t.Fatalf("got %v wifi intervals, want 1", len(intervals))
+	}
+
+	bssids := intervals[0].BSSIDs
+
+	if len(bssids) != 2 {
+		t.Fatalf("got %v bssids, want 2", len(bssids))
+	}
+
+	a, ok := bssids["02:00:00:00:00:0a"]
+	if !ok {
+		t.Fatalf("missing bssid 02:00:00:00:00:0a in %+v", bssids)
+	}
+
+	if a.Frames != 3 || a.Retries != 1 || a.Channel != 1 || a.Frequency != 2412 {
+		t.Errorf("got %+v, want 3 frames, 1 retry on channel 1 (2412 MHz)", *a)
+	}
+
+	if a.MinRSSI == nil || *a.MinRSSI != -60 || a.MaxRSSI == nil || *a.MaxRSSI != -40 {
+		t.Errorf("got min / max rssi %v / %v, want -60 / -40", a.MinRSSI, a.MaxRSSI)
+	}
+
+	if a.MeanRSSI == nil || *a.MeanRSSI != -50 {
+		t.Errorf("got mean rssi %v, want -50", a.MeanRSSI)
+	}
+
+	b, ok := bssids["02:00:00:00:00:0b"]
+	if !ok {
+		t.Fatalf("missing bssid 02:00:00:00:00:0b in %+v", bssids)
+	}
+
+	if b.Frames != 2 || b.Retries != 0 || b.Channel != 36 || b.Frequency != 5180 {
+		t.Errorf("got %+v, want 2 frames, no retries on channel 36 (5180 MHz)", *b)
+	}
+
+	if b.MinRSSI != nil || b.MaxRSSI != nil || b.MeanRSSI != nil {
+		t.Errorf("got min / max / mean rssi %v / %v / %v, want none", b.MinRSSI, b.MaxRSSI, b.MeanRSSI)
+	}
+}
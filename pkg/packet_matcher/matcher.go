@@ -0,0 +1,494 @@
+package packet_matcher
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/initialed85/drive_test/internal/fingerprint"
+	"github.com/initialed85/drive_test/internal/probe_stats"
+	"io"
+	"time"
+)
+
+const (
+	DirectionAToB = "a_to_b"
+	DirectionBToA = "b_to_a"
+
+	// the summary's delay percentiles come from a sample of this many delays per direction (however long the captures)
+	summaryDelaySamples = 10000
+)
+
+type Match struct {
+	Direction     string    `json:"direction"`
+	SentAt        time.Time `json:"sent_at"`
+	ReceivedAt    time.Time `json:"received_at"`
+	Delay         float64   `json:"delay_ms"`
+	Protocol      string    `json:"protocol"`
+	SourceIP      string    `json:"source_ip"`
+	DestinationIP string    `json:"destination_ip"`
+	Length        int       `json:"length"`
+}
+
+type DirectionStats struct {
+	Sent        int                 `json:"sent"`
+	Received    int                 `json:"received"`
+	Lost        int                 `json:"lost"`
+	LossPercent float64             `json:"loss_percent"`
+	Duplicates  int                 `json:"duplicates"`
+	Delay       probe_stats.Summary `json:"delay"`
+	Jitter      float64             `json:"jitter_ms"`
+}
+
+type Interval struct {
+	IntervalStart time.Time      `json:"interval_start"`
+	IntervalEnd   time.Time      `json:"interval_end"`
+	AToB          DirectionStats `json:"a_to_b"`
+	BToA          DirectionStats `json:"b_to_a"`
+}
+
+// Summary is for the whole of the overlap between the captures; packets in only one capture from before the other
+// started or too close to when it ended aren't counted at all, and unhashable packets are those without an IP
+// layer or without enough of the payload captured; the delay percentiles are estimated from a sample of the packets
+// once there are more than 10000 of them in a direction
+type Summary struct {
+	Start       time.Time      `json:"start"`
+	End         time.Time      `json:"end"`
+	APackets    int            `json:"a_packets"`
+	BPackets    int            `json:"b_packets"`
+	Unhashable  int            `json:"unhashable"`
+	Unmatchable int            `json:"unmatchable"`
+	AToB        DirectionStats `json:"a_to_b"`
+	BToA        DirectionStats `json:"b_to_a"`
+}
+
+type Output struct {
+	Timestamp time.Time `json:"timestamp"`
+	Match     *Match    `json:"match,omitempty"`
+	Interval  *Interval `json:"interval,omitempty"`
+	Summary   *Summary  `json:"summary,omitempty"`
+}
+
+type capturedPacket struct {
+	side      int
+	key       uint64
+	timestamp time.Time
+	protocol  string
+	source    string
+	dest      string
+	length    int
+	matched   bool
+}
+
+// hashPacket fingerprints the innermost IP packet; it's not ok if there's no IP layer or not enough of the payload was
+// captured
+func hashPacket(packet gopacket.Packet, hashBytes int) (*capturedPacket, bool) {
+	f, ok := fingerprint.Get(packet, hashBytes)
+	if !ok || !f.Complete {
+		return nil, false
+	}
+
+	return &capturedPacket{
+		key:       f.Key,
+		timestamp: packet.Metadata().Timestamp,
+		protocol:  f.Protocol,
+		source:    f.SourceIP,
+		dest:      f.DestinationIP,
+		length:    f.Length,
+	}, true
+}
+
+type capture struct {
+	name    string
+	handle  *pcap.Handle
+	next    *capturedPacket
+	first   time.Time
+	last    time.Time
+	done    bool
+	packets int
+}
+
+func openCapture(name string, path string, filter string) (*capture, error) {
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+
+	err = handle.SetBPFFilter(filter)
+	if err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+
+	return &capture{
+		name:   name,
+		handle: handle,
+	}, nil
+}
+
+type bucket struct {
+	sent       [2]int
+	received   [2]int
+	lost       [2]int
+	duplicates [2]int
+	delays     [2][]float64
+	jitter     [2]probe_stats.Jitter
+}
+
+// matcher pairs packets between the captures (in time order across both) and works out delay and loss per direction
+type matcher struct {
+	hashBytes  int
+	maxDelay   time.Duration
+	interval   time.Duration
+	perPacket  bool
+	captures   [2]*capture
+	pending    [2]map[uint64][]*capturedPacket
+	recent     map[uint64]*capturedPacket
+	queue      []*capturedPacket
+	buckets    map[int64]*bucket
+	nextReport int64
+	started    bool
+	jitter     [2]probe_stats.Jitter
+	delays     [2]*probe_stats.Reservoir
+	summary    Summary
+}
+
+func (m *matcher) read(c *capture) error {
+	c.next = nil
+
+	for !c.done {
+		data, captureInfo, err := c.handle.ReadPacketData()
+		if err == io.EOF {
+			c.done = true
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", c.name, err)
+		}
+
+		packet := gopacket.NewPacket(data, c.handle.LinkType(), gopacket.Default)
+		packet.Metadata().CaptureInfo = captureInfo
+
+		if c.first.IsZero() {
+			c.first = captureInfo.Timestamp
+		}
+
+		c.last = captureInfo.Timestamp
+		c.packets++
+
+		captured, ok := hashPacket(packet, m.hashBytes)
+		if !ok {
+			m.summary.Unhashable++
+			continue
+		}
+
+		c.next = captured
+
+		break
+	}
+
+	return nil
+}
+
+func (m *matcher) getBucket(timestamp time.Time) *bucket {
+	index := timestamp.UnixNano() / int64(m.interval)
+
+	// a lost packet can turn up after later ones were matched
+	if !m.started || index < m.nextReport {
+		m.nextReport = index
+		m.started = true
+	}
+
+	b, ok := m.buckets[index]
+	if !ok {
+		b = &bucket{}
+		m.buckets[index] = b
+	}
+
+	return b
+}
+
+func getDirection(side int) string {
+	if side == 0 {
+		return DirectionAToB
+	}
+
+	return DirectionBToA
+}
+
+func (m *matcher) handle(captured *capturedPacket, callback func(output Output) error) error {
+	other := 1 - captured.side
+
+	candidates := m.pending[other][captured.key]
+
+	// another copy of one already matched (within the max delay) is a duplicate rather than a packet sent this way
+	if len(candidates) == 0 {
+		sent, ok := m.recent[captured.key]
+		if ok && sent.side == other {
+			m.getBucket(sent.timestamp).duplicates[sent.side]++
+
+			return nil
+		}
+	}
+
+	if len(candidates) == 0 {
+		m.pending[captured.side][captured.key] = append(m.pending[captured.side][captured.key], captured)
+		m.queue = append(m.queue, captured)
+
+		return nil
+	}
+
+	// the earliest unmatched copy from the other side is the one sent
+	sent := candidates[0]
+	sent.matched = true
+
+	m.recent[captured.key] = sent
+
+	if len(candidates) == 1 {
+		delete(m.pending[other], captured.key)
+	} else {
+		m.pending[other][captured.key] = candidates[1:]
+	}
+
+	delay := captured.timestamp.Sub(sent.timestamp)
+
+	b := m.getBucket(sent.timestamp)
+	b.sent[sent.side]++
+	b.received[sent.side]++
+	b.delays[sent.side] = append(b.delays[sent.side], probe_stats.Milliseconds(delay))
+	b.jitter[sent.side].Update(delay)
+
+	m.delays[sent.side].Add(probe_stats.Milliseconds(delay))
+	m.jitter[sent.side].Update(delay)
+
+	if !m.perPacket {
+		return nil
+	}
+
+	return callback(Output{
+		Timestamp: time.Now(),
+		Match: &Match{
+			Direction:     getDirection(sent.side),
+			SentAt:        sent.timestamp,
+			ReceivedAt:    captured.timestamp,
+			Delay:         probe_stats.Milliseconds(delay),
+			Protocol:      sent.protocol,
+			SourceIP:      sent.source,
+			DestinationIP: sent.dest,
+			Length:        sent.length,
+		},
+	})
+}
+
+// expire gives up on unmatched packets older than the max delay (before now), counting them as lost if the other
+// capture was running from when they were sent to the max delay after
+func (m *matcher) expire(now time.Time, all bool) {
+	remaining := 0
+
+	for _, captured := range m.queue {
+		if !all && now.Sub(captured.timestamp) <= m.maxDelay {
+			break
+		}
+
+		remaining++
+
+		if captured.matched {
+			if m.recent[captured.key] == captured {
+				delete(m.recent, captured.key)
+			}
+
+			continue
+		}
+
+		candidates := m.pending[captured.side][captured.key]
+		if len(candidates) <= 1 {
+			delete(m.pending[captured.side], captured.key)
+		} else {
+			m.pending[captured.side][captured.key] = candidates[1:]
+		}
+
+		other := m.captures[1-captured.side]
+
+		if captured.timestamp.Before(other.first) || captured.timestamp.Add(m.maxDelay).After(other.last) {
+			m.summary.Unmatchable++
+			continue
+		}
+
+		b := m.getBucket(captured.timestamp)
+		b.sent[captured.side]++
+		b.lost[captured.side]++
+	}
+
+	m.queue = m.queue[remaining:]
+}
+
+func getDirectionStats(sent int, received int, lost int, duplicates int, delay probe_stats.Summary, jitter probe_stats.Jitter) DirectionStats {
+	directionStats := DirectionStats{
+		Sent:       sent,
+		Received:   received,
+		Lost:       lost,
+		Duplicates: duplicates,
+		Delay:      delay,
+		Jitter:     jitter.Milliseconds(),
+	}
+
+	if sent > 0 {
+		directionStats.LossPercent = float64(lost) / float64(sent) * 100
+	}
+
+	return directionStats
+}
+
+// report calls back with each interval that can't get any more packets (everything sent in it having either been
+// matched or expired by now)
+func (m *matcher) report(now time.Time, all bool, callback func(output Output) error) error {
+	if !m.started {
+		return nil
+	}
+
+	last := now.Add(-m.maxDelay).UnixNano()/int64(m.interval) - 1
+
+	for ; all && len(m.buckets) > 0 || m.nextReport <= last; m.nextReport++ {
+		b, ok := m.buckets[m.nextReport]
+		if !ok {
+			continue
+		}
+
+		delete(m.buckets, m.nextReport)
+
+		start := time.Unix(0, m.nextReport*int64(m.interval))
+
+		interval := Interval{
+			IntervalStart: start,
+			IntervalEnd:   start.Add(m.interval),
+		}
+
+		totals := []*DirectionStats{&m.summary.AToB, &m.summary.BToA}
+
+		for side, directionStats := range []*DirectionStats{&interval.AToB, &interval.BToA} {
+			*directionStats = getDirectionStats(b.sent[side], b.received[side], b.lost[side], b.duplicates[side], probe_stats.Summarise(b.delays[side]), b.jitter[side])
+
+			totals[side].Sent += b.sent[side]
+			totals[side].Received += b.received[side]
+			totals[side].Lost += b.lost[side]
+			totals[side].Duplicates += b.duplicates[side]
+		}
+
+		err := callback(Output{
+			Timestamp: time.Now(),
+			Interval:  &interval,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MatchFiles pairs up the packets seen in both of two captures (e.g. one on a vehicle and one on a core box, with
+// GPS-disciplined clocks) and calls back with the one-way delay and loss per direction per interval (by send time)
+// and for the whole overlap, and with each pair if perPacket; whichever capture saw a packet first is taken as the
+// sender, and a packet that isn't in the other capture within maxDelay seconds is lost
+func MatchFiles(aPath string, bPath string, filter string, hashBytes int, maxDelay float64, interval float64, perPacket bool, callback func(output Output) error) error {
+	if hashBytes < 0 || maxDelay <= 0 || interval <= 0 {
+		return fmt.Errorf("hash bytes can't be negative and max delay / interval have to be positive")
+	}
+
+	a, err := openCapture("a", aPath, filter)
+	if err != nil {
+		return err
+	}
+
+	defer a.handle.Close()
+
+	b, err := openCapture("b", bPath, filter)
+	if err != nil {
+		return err
+	}
+
+	defer b.handle.Close()
+
+	m := &matcher{
+		hashBytes: hashBytes,
+		maxDelay:  time.Duration(maxDelay * float64(time.Second)),
+		interval:  time.Duration(interval * float64(time.Second)),
+		perPacket: perPacket,
+		captures:  [2]*capture{a, b},
+		pending:   [2]map[uint64][]*capturedPacket{make(map[uint64][]*capturedPacket), make(map[uint64][]*capturedPacket)},
+		recent:    make(map[uint64]*capturedPacket),
+		queue:     make([]*capturedPacket, 0),
+		buckets:   make(map[int64]*bucket),
+		delays:    [2]*probe_stats.Reservoir{probe_stats.NewReservoir(summaryDelaySamples), probe_stats.NewReservoir(summaryDelaySamples)},
+	}
+
+	for side, c := range m.captures {
+		err = m.read(c)
+		if err != nil {
+			return err
+		}
+
+		if c.next != nil {
+			c.next.side = side
+		}
+	}
+
+	for a.next != nil || b.next != nil {
+		side := 0
+		if a.next == nil || (b.next != nil && b.next.timestamp.Before(a.next.timestamp)) {
+			side = 1
+		}
+
+		c := m.captures[side]
+		captured := c.next
+
+		m.expire(captured.timestamp, false)
+
+		err = m.report(captured.timestamp, false, callback)
+		if err != nil {
+			return err
+		}
+
+		err = m.handle(captured, callback)
+		if err != nil {
+			return err
+		}
+
+		err = m.read(c)
+		if err != nil {
+			return err
+		}
+
+		if c.next != nil {
+			c.next.side = side
+		}
+	}
+
+	m.expire(time.Time{}, true)
+
+	err = m.report(time.Time{}, true, callback)
+	if err != nil {
+		return err
+	}
+
+	m.summary.Start = a.first
+	if b.first.After(a.first) {
+		m.summary.Start = b.first
+	}
+
+	m.summary.End = a.last
+	if b.last.Before(a.last) {
+		m.summary.End = b.last
+	}
+
+	m.summary.APackets = a.packets
+	m.summary.BPackets = b.packets
+
+	m.summary.AToB = getDirectionStats(m.summary.AToB.Sent, m.summary.AToB.Received, m.summary.AToB.Lost, m.summary.AToB.Duplicates, m.delays[0].Summary(), m.jitter[0])
+	m.summary.BToA = getDirectionStats(m.summary.BToA.Sent, m.summary.BToA.Received, m.summary.BToA.Lost, m.summary.BToA.Duplicates, m.delays[1].Summary(), m.jitter[1])
+
+	return callback(Output{
+		Timestamp: time.Now(),
+		Summary:   &m.summary,
+	})
+}
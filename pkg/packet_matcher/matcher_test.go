@@ -0,0 +1,242 @@
+package packet_matcher
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testPacket struct {
+	timestamp time.Time
+	data      []byte
+}
+
+// writePcap writes a classic (microsecond) pcap file of Ethernet frames
+func writePcap(t *testing.T, path string, packets []testPacket) {
+	t.Helper()
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65535)
+	binary.LittleEndian.PutUint32(header[20:24], uint32(layers.LinkTypeEthernet))
+
+	data := header
+
+	for _, packet := range packets {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:4], uint32(packet.timestamp.Unix()))
+		binary.LittleEndian.PutUint32(record[4:8], uint32(packet.timestamp.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:12], uint32(len(packet.data)))
+		binary.LittleEndian.PutUint32(record[12:16], uint32(len(packet.data)))
+
+		data = append(data, record...)
+		data = append(data, packet.data...)
+	}
+
+	err := ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// udpFrame is a UDP packet between 10.0.0.1 (a) and 10.0.0.2 (b) with the sequence number as its IP ID and payload
+func udpFrame(t *testing.T, aToB bool, sequence int, ttl uint8) []byte {
+	t.Helper()
+
+	sourceIP, destinationIP := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	if !aToB {
+		sourceIP, destinationIP = destinationIP, sourceIP
+	}
+
+	ethernet := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		Id:       uint16(sequence),
+		TTL:      ttl,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    sourceIP,
+		DstIP:    destinationIP,
+	}
+
+	udp := &layers.UDP{SrcPort: 4747, DstPort: 4747}
+
+	err := udp.SetNetworkLayerForChecksum(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(sequence))
+
+	buf := gopacket.NewSerializeBuffer()
+
+	err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ethernet, ip, udp, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func checkDirection(t *testing.T, name string, got DirectionStats, sent, received, lost, duplicates int, delay float64) {
+	t.Helper()
+
+	if got.Sent != sent || got.Received != received || got.Lost != lost || got.Duplicates != duplicates {
+		t.Errorf(
+			"%v: got %v sent, %v received, %v lost, %v duplicates, want %v, %v, %v, %v",
+			name, got.Sent, got.Received, got.Lost, got.Duplicates, sent, received, lost, duplicates,
+		)
+	}
+
+	if received > 0 && (got.Delay.Samples != received || got.Delay.Min != delay || got.Delay.Max != delay) {
+		t.Errorf("%v: got delay %+v, want %v samples of %vms", name, got.Delay, received, delay)
+	}
+
+	if got.Jitter != 0 {
+		t.Errorf("%v: got jitter %v, want 0 (the delay is constant)", name, got.Jitter)
+	}
+}
+
+// TestMatchFiles has a sending 20 packets to b (10 per second) that b sees 20ms later with its TTL one lower, except
+// for one that's dropped and one that's seen twice, and b sending 2 packets to a in the second second that a sees 30ms
+// later
+func TestMatchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packet_matcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	start := time.Unix(1600000000, 0)
+
+	const (
+		dropped    = 5
+		duplicated = 8
+	)
+
+	a := make([]testPacket, 0)
+	b := make([]testPacket, 0)
+
+	for i := 0; i < 20; i++ {
+		sentAt := start.Add(time.Millisecond * time.Duration(10+i*100))
+
+		a = append(a, testPacket{sentAt, udpFrame(t, true, i, 64)})
+
+		if i == dropped {
+			continue
+		}
+
+		b = append(b, testPacket{sentAt.Add(time.Millisecond * 20), udpFrame(t, true, i, 63)})
+
+		if i == duplicated {
+			b = append(b, testPacket{sentAt.Add(time.Millisecond * 25), udpFrame(t, true, i, 63)})
+		}
+	}
+
+	for i, sentAt := range []time.Time{start.Add(time.Millisecond * 1050), start.Add(time.Millisecond * 1550)} {
+		b = append(b, testPacket{sentAt, udpFrame(t, false, 100+i, 64)})
+		a = append(a, testPacket{sentAt.Add(time.Millisecond * 30), udpFrame(t, false, 100+i, 63)})
+	}
+
+	// each capture in time order
+	for _, packets := range [][]testPacket{a, b} {
+		for i := 1; i < len(packets); i++ {
+			for j := i; j > 0 && packets[j].timestamp.Before(packets[j-1].timestamp); j-- {
+				packets[j], packets[j-1] = packets[j-1], packets[j]
+			}
+		}
+	}
+
+	aPath := filepath.Join(dir, "a.pcap")
+	bPath := filepath.Join(dir, "b.pcap")
+
+	writePcap(t, aPath, a)
+	writePcap(t, bPath, b)
+
+	matches := make([]*Match, 0)
+	intervals := make([]*Interval, 0)
+
+	var summary *Summary
+
+	err = MatchFiles(aPath, bPath, "", 64, 0.5, 1, true, func(output Output) error {
+		if summary != nil {
+			t.Errorf("got %+v after the summary", output)
+		}
+
+		switch {
+		case output.Match != nil:
+			matches = append(matches, output.Match)
+		case output.Interval != nil:
+			intervals = append(intervals, output.Interval)
+		case output.Summary != nil:
+			summary = output.Summary
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(matches) != 21 {
+		t.Errorf("got %v matches, want 21", len(matches))
+	}
+
+	for _, match := range matches {
+		want := 20.0
+		if match.Direction == DirectionBToA {
+			want = 30
+		}
+
+		if match.Delay != want || match.Protocol != "UDP" || match.Length != 36 {
+			t.Errorf("got %+v, want a 36 byte UDP packet delayed %vms", *match, want)
+		}
+	}
+
+	if len(intervals) != 2 {
+		t.Fatalf("got %v intervals, want 2", len(intervals))
+	}
+
+	for i, interval := range intervals {
+		if !interval.IntervalStart.Equal(start.Add(time.Second * time.Duration(i))) {
+			t.Errorf("got interval %v starting %v, want %v", i, interval.IntervalStart, start.Add(time.Second*time.Duration(i)))
+		}
+	}
+
+	checkDirection(t, "first interval a to b", intervals[0].AToB, 10, 9, 1, 1, 20)
+	checkDirection(t, "first interval b to a", intervals[0].BToA, 0, 0, 0, 0, 0)
+	checkDirection(t, "second interval a to b", intervals[1].AToB, 10, 10, 0, 0, 20)
+	checkDirection(t, "second interval b to a", intervals[1].BToA, 2, 2, 0, 0, 30)
+
+	if summary == nil {
+		t.Fatal("no summary")
+	}
+
+	if summary.APackets != 22 || summary.BPackets != 22 || summary.Unhashable != 0 || summary.Unmatchable != 0 {
+		t.Errorf("got %+v, want 22 packets in each capture, all of them hashable and matchable", *summary)
+	}
+
+	checkDirection(t, "summary a to b", summary.AToB, 20, 19, 1, 1, 20)
+	checkDirection(t, "summary b to a", summary.BToA, 2, 2, 0, 0, 30)
+
+	if summary.AToB.LossPercent != 5 {
+		t.Errorf("got a to b loss %v%%, want 5%%", summary.AToB.LossPercent)
+	}
+}
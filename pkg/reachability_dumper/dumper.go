@@ -0,0 +1,271 @@
+package reachability_dumper
+
+import (
+	"fmt"
+	"github.com/initialed85/drive_test/internal/probe_stats"
+	"github.com/initialed85/drive_test/internal/scheduler"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultPeriod           = 1
+	defaultTimeout          = 1
+	defaultFailureThreshold = 3
+	defaultSummaryInterval  = 10
+	defaultSummaryWindow    = 60
+
+	stateUnknown = "unknown"
+	stateUp      = "up"
+	stateDown    = "down"
+)
+
+type Target struct {
+	Name             string  `json:"name"`
+	Type             string  `json:"type"`
+	Address          string  `json:"address"`
+	Period           float64 `json:"period"`
+	Timeout          float64 `json:"timeout"`
+	FailureThreshold int     `json:"failure_threshold"`
+}
+
+type Config struct {
+	Targets         []Target `json:"targets"`
+	SummaryInterval float64  `json:"summary_interval"`
+	SummaryWindow   float64  `json:"summary_window"`
+}
+
+type Result struct {
+	Type     string  `json:"type"`
+	Address  string  `json:"address"`
+	Sequence uint32  `json:"sequence"`
+	Success  bool    `json:"success"`
+	RTT      float64 `json:"rtt_ms"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type Summary struct {
+	WindowStart time.Time           `json:"window_start"`
+	WindowEnd   time.Time           `json:"window_end"`
+	Sent        int                 `json:"sent"`
+	Received    int                 `json:"received"`
+	Lost        int                 `json:"lost"`
+	LossPercent float64             `json:"loss_percent"`
+	RTT         probe_stats.Summary `json:"rtt"`
+}
+
+type Event struct {
+	State               string    `json:"state"`
+	PreviousState       string    `json:"previous_state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success"`
+}
+
+type Output struct {
+	Timestamp time.Time `json:"timestamp"`
+	Target    string    `json:"target"`
+	Result    *Result   `json:"result,omitempty"`
+	Summary   *Summary  `json:"summary,omitempty"`
+	Event     *Event    `json:"event,omitempty"`
+}
+
+type timedResult struct {
+	timestamp time.Time
+	result    Result
+}
+
+type targetResult struct {
+	name string
+	timedResult
+}
+
+type targetState struct {
+	target              Target
+	state               string
+	consecutiveFailures int
+	lastSuccess         time.Time
+	history             []timedResult
+}
+
+// handleResult updates the rolling history and returns an event if the target has just come up or gone down
+func (s *targetState) handleResult(r timedResult, window time.Duration) *Event {
+	s.history = append(s.history, r)
+	s.prune(r.timestamp, window)
+
+	if r.result.Success {
+		s.consecutiveFailures = 0
+		s.lastSuccess = r.timestamp
+
+		if s.state == stateUp {
+			return nil
+		}
+	} else {
+		s.consecutiveFailures++
+
+		if s.state == stateDown || s.consecutiveFailures < s.target.FailureThreshold {
+			return nil
+		}
+	}
+
+	event := Event{
+		State:               stateDown,
+		PreviousState:       s.state,
+		ConsecutiveFailures: s.consecutiveFailures,
+		LastSuccess:         s.lastSuccess,
+	}
+
+	if r.result.Success {
+		event.State = stateUp
+	}
+
+	s.state = event.State
+
+	return &event
+}
+
+func (s *targetState) prune(now time.Time, window time.Duration) {
+	cutoff := now.Add(-window)
+
+	i := 0
+	for i < len(s.history) && s.history[i].timestamp.Before(cutoff) {
+		i++
+	}
+
+	s.history = s.history[i:]
+}
+
+func (s *targetState) summarise(now time.Time, window time.Duration) Summary {
+	s.prune(now, window)
+
+	summary := Summary{
+		WindowStart: now.Add(-window),
+		WindowEnd:   now,
+	}
+
+	rtts := make([]float64, 0)
+
+	for _, r := range s.history {
+		summary.Sent++
+
+		if r.result.Success {
+			summary.Received++
+			rtts = append(rtts, r.result.RTT)
+		}
+	}
+
+	summary.Lost = summary.Sent - summary.Received
+	if summary.Sent > 0 {
+		summary.LossPercent = float64(summary.Lost) / float64(summary.Sent) * 100
+	}
+
+	summary.RTT = probe_stats.Summarise(rtts)
+
+	return summary
+}
+
+func probeForever(name string, target Target, results chan targetResult) {
+	p := newProber(target)
+
+	scheduler.Every(scheduler.SecondsToDuration(target.Period, defaultPeriod), nil, func() {
+		timestamp := time.Now()
+
+		results <- targetResult{name, timedResult{timestamp, p.probe()}}
+	})
+}
+
+func getName(target Target) string {
+	if target.Name != "" {
+		return target.Name
+	}
+
+	return fmt.Sprintf("%v:%v", target.Type, target.Address)
+}
+
+// Watch probes each of the targets on its own period and calls back with every result, a rolling summary (per
+// target) every summary interval and an up / down event whenever a target crosses its failure threshold
+func Watch(config Config, callback func(Output) error) error {
+	if len(config.Targets) == 0 {
+		return fmt.Errorf("no targets configured")
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
+	window := scheduler.SecondsToDuration(config.SummaryWindow, defaultSummaryWindow)
+
+	states := make(map[string]*targetState)
+	names := make([]string, 0)
+
+	for _, target := range config.Targets {
+		switch target.Type {
+		case typeICMP, typeTCP, typeUDP:
+		default:
+			return fmt.Errorf("target %#+v has unknown type %#+v", target.Name, target.Type)
+		}
+
+		if target.FailureThreshold <= 0 {
+			target.FailureThreshold = defaultFailureThreshold
+		}
+
+		name := getName(target)
+		if _, ok := states[name]; ok {
+			return fmt.Errorf("duplicate target name %#+v", name)
+		}
+
+		states[name] = &targetState{
+			target: target,
+			state:  stateUnknown,
+		}
+
+		names = append(names, name)
+	}
+
+	results := make(chan targetResult)
+
+	for _, name := range names {
+		go probeForever(name, states[name].target, results)
+	}
+
+	summaryTicker := time.NewTicker(scheduler.SecondsToDuration(config.SummaryInterval, defaultSummaryInterval))
+	defer summaryTicker.Stop()
+
+	for {
+		select {
+		case r := <-results:
+			result := r.result
+
+			err := callback(Output{
+				Timestamp: r.timestamp,
+				Target:    r.name,
+				Result:    &result,
+			})
+			if err != nil {
+				return err
+			}
+
+			event := states[r.name].handleResult(r.timedResult, window)
+			if event != nil {
+				err = callback(Output{
+					Timestamp: r.timestamp,
+					Target:    r.name,
+					Event:     event,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		case now := <-summaryTicker.C:
+			for _, name := range names {
+				summary := states[name].summarise(now, window)
+
+				err := callback(Output{
+					Timestamp: now,
+					Target:    name,
+					Summary:   &summary,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package reachability_dumper
+
+import (
+	"errors"
+	"net"
+)
+
+func listenPingSocket(v6 bool) (net.PacketConn, error) {
+	return nil, errors.New("unprivileged ping sockets not supported on this platform")
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package reachability_dumper
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenPingSocket opens an unprivileged ICMP "ping" socket (on Linux this needs the group to be in
+// net.ipv4.ping_group_range); the kernel takes care of the echo identifier
+func listenPingSocket(v6 bool) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if v6 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "ping socket")
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return net.FilePacketConn(f)
+}
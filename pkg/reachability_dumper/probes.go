@@ -0,0 +1,266 @@
+package reachability_dumper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/initialed85/drive_test/internal/probe_stats"
+	"github.com/initialed85/drive_test/internal/scheduler"
+	"github.com/initialed85/drive_test/internal/udp_probe"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	typeICMP = "icmp"
+	typeTCP  = "tcp"
+	typeUDP  = "udp"
+
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+func checksum(data []byte) uint16 {
+	sum := uint32(0)
+
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+
+	return ^uint16(sum)
+}
+
+func marshalEcho(v6 bool, id, sequence uint16, payload []byte) []byte {
+	data := make([]byte, 8+len(payload))
+
+	data[0] = icmpv4EchoRequest
+	if v6 {
+		data[0] = icmpv6EchoRequest
+	}
+
+	binary.BigEndian.PutUint16(data[4:6], id)
+	binary.BigEndian.PutUint16(data[6:8], sequence)
+	copy(data[8:], payload)
+
+	// the kernel always fills in the ICMPv6 checksum (it needs the pseudo-header)
+	if !v6 {
+		binary.BigEndian.PutUint16(data[2:4], checksum(data))
+	}
+
+	return data
+}
+
+// listenICMP prefers an unprivileged ping socket and falls back to a raw socket (which needs root / CAP_NET_RAW)
+func listenICMP(v6 bool) (conn net.PacketConn, raw bool, err error) {
+	conn, pingErr := listenPingSocket(v6)
+	if pingErr == nil {
+		return conn, false, nil
+	}
+
+	network := "ip4:icmp"
+	if v6 {
+		network = "ip6:ipv6-icmp"
+	}
+
+	conn, rawErr := net.ListenPacket(network, "")
+	if rawErr == nil {
+		return conn, true, nil
+	}
+
+	return nil, false, fmt.Errorf("failed to open ping socket (%v) or raw socket (%v)", pingErr, rawErr)
+}
+
+func probeICMP(address string, sequence uint16, timeout time.Duration) (time.Duration, error) {
+	ipAddr, err := net.ResolveIPAddr("ip", address)
+	if err != nil {
+		return 0, err
+	}
+
+	v6 := ipAddr.IP.To4() == nil
+
+	conn, raw, err := listenICMP(v6)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	var dst net.Addr = &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone}
+	if raw {
+		dst = ipAddr
+	}
+
+	id := uint16(rand.Uint32())
+
+	payload := make([]byte, 16)
+	_, _ = rand.Read(payload)
+
+	replyType := byte(icmpv4EchoReply)
+	if v6 {
+		replyType = icmpv6EchoReply
+	}
+
+	start := time.Now()
+
+	err = conn.SetDeadline(start.Add(timeout))
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = conn.WriteTo(marshalEcho(v6, id, sequence, payload), dst)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		reply := buf[0:n]
+
+		if len(reply) < 8 || reply[0] != replyType {
+			continue
+		}
+
+		// a ping socket rewrites the identifier for us (and only hands us our own replies)
+		if raw && binary.BigEndian.Uint16(reply[4:6]) != id {
+			continue
+		}
+
+		if binary.BigEndian.Uint16(reply[6:8]) != sequence || !bytes.Equal(reply[8:], payload) {
+			continue
+		}
+
+		return time.Since(start), nil
+	}
+}
+
+func probeTCP(address string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	rtt := time.Since(start)
+
+	_ = conn.Close()
+
+	return rtt, nil
+}
+
+// probeUDP sends a udp_probe formatted payload, so the far end can be an RFC 862 echo service or a udp_reflector
+func probeUDP(address string, sessionID, sequence uint32, timeout time.Duration) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	start := time.Now()
+
+	err = conn.SetDeadline(start.Add(timeout))
+	if err != nil {
+		return 0, err
+	}
+
+	request := udp_probe.Probe{
+		SessionID: sessionID,
+		Sequence:  sequence,
+		SendTime:  start,
+	}
+
+	_, err = conn.Write(request.Marshal(udp_probe.HeaderSize))
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 65536)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		reply, err := udp_probe.Unmarshal(buf[0:n])
+		if err != nil {
+			continue
+		}
+
+		if reply.SessionID == sessionID && reply.Sequence == sequence {
+			return time.Since(start), nil
+		}
+	}
+}
+
+type prober struct {
+	target    Target
+	timeout   time.Duration
+	sessionID uint32
+	sequence  uint32
+}
+
+func newProber(target Target) *prober {
+	return &prober{
+		target:    target,
+		timeout:   scheduler.SecondsToDuration(target.Timeout, defaultTimeout),
+		sessionID: rand.Uint32(),
+	}
+}
+
+func (p *prober) probe() Result {
+	sequence := p.sequence
+	p.sequence++
+
+	var rtt time.Duration
+	var err error
+
+	switch p.target.Type {
+	case typeICMP:
+		rtt, err = probeICMP(p.target.Address, uint16(sequence), p.timeout)
+	case typeTCP:
+		rtt, err = probeTCP(p.target.Address, p.timeout)
+	case typeUDP:
+		rtt, err = probeUDP(p.target.Address, p.sessionID, sequence, p.timeout)
+	default:
+		err = errors.New("unknown target type")
+	}
+
+	result := Result{
+		Type:     p.target.Type,
+		Address:  p.target.Address,
+		Sequence: sequence,
+		Success:  err == nil,
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.RTT = probe_stats.Milliseconds(rtt)
+	}
+
+	return result
+}
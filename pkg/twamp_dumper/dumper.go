@@ -0,0 +1,66 @@
+package twamp_dumper
+
+import (
+	"github.com/initialed85/drive_test/internal/probe_session"
+	"github.com/initialed85/drive_test/internal/twamp"
+	"time"
+)
+
+type Interval = probe_session.Interval
+
+type LossTrigger = probe_session.LossTrigger
+
+type Output struct {
+	Timestamp time.Time `json:"timestamp"`
+	Target    string    `json:"target"`
+	Interval  Interval  `json:"interval"`
+}
+
+// codec is the TWAMP-Light test packet format; the reflector's turnaround (T3 - T2) is left out of the RTT
+type codec struct {
+	errorEstimate twamp.ErrorEstimate
+	size          int
+}
+
+func (c *codec) Marshal(sequence uint32, sentAt time.Time) []byte {
+	p := twamp.SenderPacket{
+		Sequence:      sequence,
+		Timestamp:     sentAt,
+		ErrorEstimate: c.errorEstimate,
+	}
+
+	return p.Marshal(c.size)
+}
+
+func (c *codec) Unmarshal(data []byte) (probe_session.Reply, error) {
+	reply, err := twamp.UnmarshalReflectorPacket(data)
+	if err != nil {
+		return probe_session.Reply{}, err
+	}
+
+	return probe_session.Reply{
+		Sequence:             reply.SenderSequence,
+		ReflectorReceiveTime: reply.ReceiveTimestamp,
+		ReflectorSendTime:    reply.Timestamp,
+		Turnaround:           reply.Timestamp.Sub(reply.ReceiveTimestamp),
+		Synchronized:         c.errorEstimate.Synchronized() && reply.ErrorEstimate.Synchronized(),
+	}, nil
+}
+
+// Watch is a TWAMP-Light session-sender (RFC 5357 appendix I); it sends test packets at rate (per second) of size
+// bytes to a session-reflector and calls back with loss, RTT, jitter and (if both clocks are synchronized) one-way
+// delay stats for every interval (in seconds); packets not returned within timeout (in seconds) are lost
+func Watch(host string, port int, rate float64, size int, interval, timeout float64, synchronized bool, lossTrigger *LossTrigger, callback func(Output) error) error {
+	c := &codec{
+		errorEstimate: twamp.NewErrorEstimate(synchronized, 0, 1),
+		size:          size,
+	}
+
+	return probe_session.Watch(host, port, rate, interval, timeout, c, lossTrigger, func(target string, interval Interval) error {
+		return callback(Output{
+			Timestamp: time.Now(),
+			Target:    target,
+			Interval:  interval,
+		})
+	})
+}
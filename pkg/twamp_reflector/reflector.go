@@ -0,0 +1,75 @@
+package twamp_reflector
+
+import (
+	"fmt"
+	"github.com/initialed85/drive_test/internal/twamp"
+	"log"
+	"net"
+	"time"
+)
+
+// Serve is a stateless TWAMP-Light session-reflector (RFC 5357 appendix I); it copies the sender's sequence number
+// rather than keeping its own and pads replies out to the size of the request so the test is symmetrical
+func Serve(host string, port int, synchronized bool) error {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%v:%v", host, port))
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	err = enableTTL(conn)
+	if err != nil {
+		log.Printf("warning: failed to enable TTL reporting: %v", err)
+	}
+
+	log.Printf("reflecting on %v", conn.LocalAddr())
+
+	errorEstimate := twamp.NewErrorEstimate(synchronized, 0, 1)
+
+	buf := make([]byte, 65536)
+	oob := make([]byte, 1024)
+
+	for {
+		n, oobn, _, remoteAddr, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return err
+		}
+
+		receiveTime := time.Now()
+
+		request, err := twamp.UnmarshalSenderPacket(buf[0:n])
+		if err != nil {
+			continue
+		}
+
+		ttl, ok := parseTTL(oob[0:oobn])
+		if !ok {
+			ttl = 255
+		}
+
+		reply := twamp.ReflectorPacket{
+			Sequence:            request.Sequence,
+			ErrorEstimate:       errorEstimate,
+			ReceiveTimestamp:    receiveTime,
+			SenderSequence:      request.Sequence,
+			SenderTimestamp:     request.Timestamp,
+			SenderErrorEstimate: request.ErrorEstimate,
+			SenderTTL:           ttl,
+		}
+
+		reply.Timestamp = time.Now()
+
+		_, err = conn.WriteToUDP(reply.Marshal(n), remoteAddr)
+		if err != nil {
+			return err
+		}
+	}
+}
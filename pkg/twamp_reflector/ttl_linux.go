@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package twamp_reflector
+
+import (
+	"net"
+	"syscall"
+)
+
+// enableTTL asks the kernel to hand us the TTL / hop limit of each received packet as a control message
+func enableTTL(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	return rawConn.Control(func(fd uintptr) {
+		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTTL, 1)
+		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT, 1)
+	})
+}
+
+func parseTTL(oob []byte) (uint8, bool) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, message := range messages {
+		if len(message.Data) < 1 {
+			continue
+		}
+
+		if (message.Header.Level == syscall.IPPROTO_IP && message.Header.Type == syscall.IP_TTL) ||
+			(message.Header.Level == syscall.IPPROTO_IPV6 && message.Header.Type == syscall.IPV6_HOPLIMIT) {
+			// a native-endian int that is at most 255, so whichever byte is set is the TTL
+			ttl := uint8(0)
+			for _, b := range message.Data {
+				ttl |= b
+			}
+
+			return ttl, true
+		}
+	}
+
+	return 0, false
+}
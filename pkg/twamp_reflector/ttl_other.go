@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package twamp_reflector
+
+import (
+	"net"
+)
+
+func enableTTL(conn *net.UDPConn) error {
+	return nil
+}
+
+func parseTTL(oob []byte) (uint8, bool) {
+	return 0, false
+}
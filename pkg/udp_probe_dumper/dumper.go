@@ -0,0 +1,74 @@
+package udp_probe_dumper
+
+import (
+	"fmt"
+	"github.com/initialed85/drive_test/internal/probe_session"
+	"github.com/initialed85/drive_test/internal/udp_probe"
+	"math/rand"
+	"time"
+)
+
+type Interval = probe_session.Interval
+
+type LossTrigger = probe_session.LossTrigger
+
+type Output struct {
+	Timestamp time.Time `json:"timestamp"`
+	Target    string    `json:"target"`
+	Interval  Interval  `json:"interval"`
+}
+
+// codec is the udp_probe wire format; replies from other sessions (e.g. an earlier run against the same reflector)
+// are ignored
+type codec struct {
+	sessionID uint32
+	size      int
+}
+
+func (c *codec) Marshal(sequence uint32, sentAt time.Time) []byte {
+	p := udp_probe.Probe{
+		SessionID: c.sessionID,
+		Sequence:  sequence,
+		SendTime:  sentAt,
+	}
+
+	return p.Marshal(c.size)
+}
+
+func (c *codec) Unmarshal(data []byte) (probe_session.Reply, error) {
+	reply, err := udp_probe.Unmarshal(data)
+	if err != nil {
+		return probe_session.Reply{}, err
+	}
+
+	if reply.SessionID != c.sessionID {
+		return probe_session.Reply{}, fmt.Errorf("reply for session %v, wanted %v", reply.SessionID, c.sessionID)
+	}
+
+	return probe_session.Reply{
+		Sequence:             reply.Sequence,
+		ReflectorReceiveTime: reply.ReflectorReceiveTime,
+		ReflectorSendTime:    reply.ReflectorSendTime,
+		Counted:              true,
+		ReflectorCount:       reply.ReflectorCount,
+	}, nil
+}
+
+// Watch sends probes at rate (per second) of size bytes to a udp_reflector and calls back with loss, reordering,
+// duplicate, RTT and jitter stats for every interval (in seconds); probes not returned within timeout (in seconds) are lost
+func Watch(host string, port int, rate float64, size int, interval, timeout float64, lossTrigger *LossTrigger, callback func(Output) error) error {
+	rand.Seed(time.Now().UnixNano())
+
+	c := &codec{
+		sessionID: rand.Uint32(),
+		size:      size,
+	}
+
+	return probe_session.Watch(host, port, rate, interval, timeout, c, lossTrigger, func(target string, interval Interval) error {
+		return callback(Output{
+			Timestamp: time.Now(),
+			Target:    target,
+			Interval:  interval,
+		})
+	})
+}
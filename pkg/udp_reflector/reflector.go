@@ -0,0 +1,99 @@
+package udp_reflector
+
+import (
+	"fmt"
+	"github.com/initialed85/drive_test/internal/udp_probe"
+	"log"
+	"net"
+	"time"
+)
+
+const sessionExpiry = time.Minute * 5
+
+type sessionKey struct {
+	addr      string
+	sessionID uint32
+}
+
+type session struct {
+	count    uint32
+	lastSeen time.Time
+}
+
+func expireSessions(sessions map[sessionKey]*session, now time.Time) {
+	for key, s := range sessions {
+		if now.Sub(s.lastSeen) > sessionExpiry {
+			log.Printf("expiring session %v from %v after %v probes", key.sessionID, key.addr, s.count)
+
+			delete(sessions, key)
+		}
+	}
+}
+
+// Serve echoes every probe back to its sender, stamped with how many probes have been seen for that session
+// (so the sender can split loss into forward and reverse) and the reflector's receive / send times
+func Serve(host string, port int) error {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%v:%v", host, port))
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	log.Printf("reflecting on %v", conn.LocalAddr())
+
+	return serve(conn)
+}
+
+func serve(conn *net.UDPConn) error {
+	sessions := make(map[sessionKey]*session)
+	lastExpiry := time.Now()
+
+	buf := make([]byte, 65536)
+
+	for {
+		n, remoteAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		receiveTime := time.Now()
+
+		probe, err := udp_probe.Unmarshal(buf[0:n])
+		if err != nil {
+			continue
+		}
+
+		key := sessionKey{remoteAddr.String(), probe.SessionID}
+
+		s, ok := sessions[key]
+		if !ok {
+			log.Printf("new session %v from %v", key.sessionID, key.addr)
+
+			s = &session{}
+			sessions[key] = s
+		}
+
+		s.count++
+		s.lastSeen = receiveTime
+
+		udp_probe.Stamp(buf[0:n], s.count, receiveTime, time.Now())
+
+		_, err = conn.WriteToUDP(buf[0:n], remoteAddr)
+		if err != nil {
+			return err
+		}
+
+		if receiveTime.Sub(lastExpiry) > time.Minute {
+			expireSessions(sessions, receiveTime)
+			lastExpiry = receiveTime
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package udp_reflector
+
+import (
+	"errors"
+	"github.com/initialed85/drive_test/internal/udp_probe"
+	"github.com/initialed85/drive_test/pkg/udp_probe_dumper"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+)
+
+const (
+	droppedSequence    = 3 // lost on the way to the reflector
+	duplicatedSequence = 5 // echoed back twice
+	heldSequence       = 7 // echoed back after the one sent after it
+)
+
+var errDone = errors.New("done")
+
+func listen(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+// faultyProxy relays probes from udp_probe_dumper to the reflector and back, dropping, duplicating and reordering a few
+type faultyProxy struct {
+	mu         sync.Mutex
+	conn       *net.UDPConn
+	upstream   *net.UDPConn
+	senderAddr *net.UDPAddr
+}
+
+func (p *faultyProxy) forward() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		p.senderAddr = addr
+		p.mu.Unlock()
+
+		probe, err := udp_probe.Unmarshal(buf[0:n])
+		if err != nil || probe.Sequence == droppedSequence {
+			continue
+		}
+
+		_, _ = p.upstream.Write(buf[0:n])
+	}
+}
+
+func (p *faultyProxy) reverse() {
+	buf := make([]byte, 65536)
+
+	var held []byte
+
+	for {
+		n, err := p.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		addr := p.senderAddr
+		p.mu.Unlock()
+
+		probe, err := udp_probe.Unmarshal(buf[0:n])
+		if err != nil {
+			continue
+		}
+
+		switch probe.Sequence {
+		case heldSequence:
+			held = append([]byte{}, buf[0:n]...)
+
+			continue
+		case duplicatedSequence:
+			_, _ = p.conn.WriteToUDP(buf[0:n], addr)
+		}
+
+		_, _ = p.conn.WriteToUDP(buf[0:n], addr)
+
+		if held != nil {
+			_, _ = p.conn.WriteToUDP(held, addr)
+			held = nil
+		}
+	}
+}
+
+func TestServeLoopback(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // the reflector logs its sessions
+	defer log.SetOutput(os.Stderr)
+
+	reflector := listen(t)
+	defer func() {
+		_ = reflector.Close()
+	}()
+
+	go func() {
+		_ = serve(reflector)
+	}()
+
+	upstream, err := net.DialUDP("udp", nil, reflector.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = upstream.Close()
+	}()
+
+	p := &faultyProxy{
+		conn:     listen(t),
+		upstream: upstream,
+	}
+
+	defer func() {
+		_ = p.conn.Close()
+	}()
+
+	go p.forward()
+	go p.reverse()
+
+	addr := p.conn.LocalAddr().(*net.UDPAddr)
+
+	var interval udp_probe_dumper.Interval
+
+	// 100 probes per second gives the faulty sequences plenty of room in the first (half second) interval
+	err = udp_probe_dumper.Watch(addr.IP.String(), addr.Port, 100, 64, 0.5, 0.25, nil, func(output udp_probe_dumper.Output) error {
+		interval = output.Interval
+
+		return errDone
+	})
+	if err != errDone {
+		t.Fatal(err)
+	}
+
+	if interval.Sent <= heldSequence+1 {
+		t.Fatalf("got %v probes sent in the first interval, want more than %v", interval.Sent, heldSequence+1)
+	}
+
+	if interval.Received != interval.Sent-1 || interval.Lost != 1 {
+		t.Errorf("got %v of %v received (%v lost), want all but 1", interval.Received, interval.Sent, interval.Lost)
+	}
+
+	if interval.ForwardLost == nil || *interval.ForwardLost != 1 || interval.ReverseLost == nil || *interval.ReverseLost != 0 {
+		t.Errorf("got forward / reverse lost %v / %v, want 1 / 0", interval.ForwardLost, interval.ReverseLost)
+	}
+
+	if interval.Reordered != 1 {
+		t.Errorf("got %v reordered, want 1", interval.Reordered)
+	}
+
+	if interval.Duplicates != 1 {
+		t.Errorf("got %v duplicates, want 1", interval.Duplicates)
+	}
+
+	if interval.RTT.Samples != interval.Received {
+		t.Errorf("got %v rtt samples, want %v", interval.RTT.Samples, interval.Received)
+	}
+}